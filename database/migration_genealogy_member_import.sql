@@ -0,0 +1,27 @@
+-- Migration: Add imported member attributes to genealogy_nodes
+-- Genealogies imported from a client's member list keep the client's member ID, the sponsor
+-- (enroller, which can differ from the placement parent), the join date and purchases
+
+ALTER TABLE genealogy_nodes
+ADD COLUMN IF NOT EXISTS member_id VARCHAR(100);
+
+ALTER TABLE genealogy_nodes
+ADD COLUMN IF NOT EXISTS sponsor_node_id INTEGER REFERENCES genealogy_nodes(id) ON DELETE SET NULL;
+
+ALTER TABLE genealogy_nodes
+ADD COLUMN IF NOT EXISTS joined_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE genealogy_nodes
+ADD COLUMN IF NOT EXISTS purchase_volume DECIMAL(12,2) NOT NULL DEFAULT 0.00;
+
+-- Member IDs are unique within a genealogy
+CREATE UNIQUE INDEX IF NOT EXISTS idx_genealogy_nodes_member
+ON genealogy_nodes(genealogy_type_id, member_id) WHERE member_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_genealogy_nodes_sponsor ON genealogy_nodes(sponsor_node_id);
+
+-- Add comments for documentation
+COMMENT ON COLUMN genealogy_nodes.member_id IS 'Member ID from the imported client genealogy';
+COMMENT ON COLUMN genealogy_nodes.sponsor_node_id IS 'Node of the member who enrolled this member, when it differs from the placement parent';
+COMMENT ON COLUMN genealogy_nodes.joined_at IS 'Date the member joined, from the imported client genealogy';
+COMMENT ON COLUMN genealogy_nodes.purchase_volume IS 'Purchases of the member, from the imported client genealogy';
@@ -0,0 +1,22 @@
+-- Migration: Add status column to genealogy_nodes
+-- Removed members can leave a placeholder node that keeps their position in the tree
+
+-- Add the status column; existing nodes are active members
+ALTER TABLE genealogy_nodes
+ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active';
+
+-- Add check constraint for the new column, unless an earlier run added it
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'genealogy_nodes_status_check') THEN
+        ALTER TABLE genealogy_nodes
+        ADD CONSTRAINT genealogy_nodes_status_check
+        CHECK (status IN ('active', 'placeholder'));
+    END IF;
+END $$;
+
+-- Add index for filtering nodes by status
+CREATE INDEX IF NOT EXISTS idx_genealogy_nodes_status ON genealogy_nodes(genealogy_type_id, status);
+
+-- Add comment for documentation
+COMMENT ON COLUMN genealogy_nodes.status IS 'active for members, placeholder for the vacated position of a removed member';
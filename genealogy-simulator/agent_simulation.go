@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Default member traits for agent-based simulations
+const (
+	defaultRecruitingPropensity = 0.5
+	defaultPurchasePropensity   = 0.8
+	defaultChurnRisk            = 0.05
+	defaultTraitVariance        = 0.5
+)
+
+// AgentModelConfig sets the average member behaviour of an agent-based simulation
+type AgentModelConfig struct {
+	RecruitingPropensity float64  `json:"recruiting_propensity"`         // expected recruits per active member per cycle
+	PurchasePropensity   *float64 `json:"purchase_propensity,omitempty"` // probability a new member buys a product
+	ChurnRisk            float64  `json:"churn_risk"`                    // probability an active member quits each cycle
+	TraitVariance        float64  `json:"trait_variance"`                // 0 = identical members, 1 = widely varying members
+}
+
+// AgentTraits shows the behaviour drawn for one member and its outcome
+type AgentTraits struct {
+	NodeID               int     `json:"node_id"`
+	UserID               int     `json:"user_id"`
+	RecruitingPropensity float64 `json:"recruiting_propensity"`
+	PurchasePropensity   float64 `json:"purchase_propensity"`
+	ChurnRisk            float64 `json:"churn_risk"`
+	Purchased            bool    `json:"purchased"`
+	RecruitedCount       int     `json:"recruited_count"`
+	ChurnedCycle         *int    `json:"churned_cycle,omitempty"`
+}
+
+// validateSimulationMode validates the simulation mode and agent model of a simulation request
+func validateSimulationMode(mode string, model *AgentModelConfig) error {
+	switch mode {
+	case "", "fill", "agent":
+	default:
+		return fmt.Errorf("simulation_mode must be fill or agent")
+	}
+	if model == nil {
+		return nil
+	}
+	if model.RecruitingPropensity < 0 {
+		return fmt.Errorf("agent_model recruiting_propensity must not be negative")
+	}
+	if model.PurchasePropensity != nil && (*model.PurchasePropensity < 0 || *model.PurchasePropensity > 1) {
+		return fmt.Errorf("agent_model purchase_propensity must be between 0 and 1")
+	}
+	if model.ChurnRisk < 0 || model.ChurnRisk > 1 {
+		return fmt.Errorf("agent_model churn_risk must be between 0 and 1")
+	}
+	if model.TraitVariance < 0 || model.TraitVariance > 1 {
+		return fmt.Errorf("agent_model trait_variance must be between 0 and 1")
+	}
+	return nil
+}
+
+// AgentBasedSimulator grows a genealogy from member behaviour: each active member recruits a random
+// number of new members every cycle and places them in their own downline by the plan's placement rules
+type AgentBasedSimulator struct {
+	simulationID     string
+	planKind         string // binary, unilevel or matrix
+	maxChildrenCount int
+	model            AgentModelConfig
+	rng              *rand.Rand
+	nodes            []GenealogyNode
+	traits           []AgentTraits
+	children         [][]int // node indexes of each node's children in join order
+	active           []bool
+}
+
+// NewAgentBasedSimulator creates a new agent-based simulator for a plan kind
+func NewAgentBasedSimulator(simulationID, planKind string, maxChildrenCount int) *AgentBasedSimulator {
+	if planKind == "binary" {
+		maxChildrenCount = 2
+	}
+	return &AgentBasedSimulator{
+		simulationID:     simulationID,
+		planKind:         planKind,
+		maxChildrenCount: maxChildrenCount,
+		nodes:            make([]GenealogyNode, 0),
+		traits:           make([]AgentTraits, 0),
+		children:         make([][]int, 0),
+		active:           make([]bool, 0),
+	}
+}
+
+// Simulate runs the agent-based simulation
+func (a *AgentBasedSimulator) Simulate(ctx context.Context, req SimulationRequest) (SimulationResponse, error) {
+	a.model = resolveAgentModel(req.AgentModel, req.RecruitmentRate)
+	seed := req.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	a.rng = rand.New(rand.NewSource(seed))
+
+	var growthAnalysis *GrowthAnalysis
+	if req.AddressableMarket > 0 {
+		growthAnalysis = &GrowthAnalysis{
+			AddressableMarket: req.AddressableMarket,
+			RecruitmentRate:   a.model.RecruitingPropensity,
+			Cycles:            make([]GrowthCycle, 0, req.NumberOfCycles),
+		}
+	}
+
+	newUsersPerCycle := make([]int, req.NumberOfCycles)
+	for cycle := 1; cycle <= req.NumberOfCycles; cycle++ {
+		if err := ctx.Err(); err != nil {
+			return SimulationResponse{}, err
+		}
+		if len(a.nodes) == 0 {
+			// The founder joins in the first cycle
+			a.join(-1, cycle, 1, req.GenealogyTypeID)
+		}
+
+		// Members active at the start of the cycle recruit; recruits start recruiting next cycle
+		saturation := 1.0
+		if req.AddressableMarket > 0 {
+			saturation = math.Max(0, 1-float64(len(a.nodes))/float64(req.AddressableMarket))
+		}
+		recruiters := make([]int, 0, len(a.nodes))
+		for i := range a.nodes {
+			if a.active[i] {
+				recruiters = append(recruiters, i)
+			}
+		}
+
+		newUsers := 0
+		if cycle == 1 {
+			newUsers = 1
+		}
+		for _, recruiter := range recruiters {
+			recruits := poissonSample(a.rng, a.traits[recruiter].RecruitingPropensity*saturation)
+			for r := 0; r < recruits && len(a.nodes) < req.MaxExpectedUsers; r++ {
+				newUsers++
+				a.join(recruiter, cycle, newUsers, req.GenealogyTypeID)
+				a.traits[recruiter].RecruitedCount++
+			}
+		}
+		newUsersPerCycle[cycle-1] = newUsers
+		reportProgress(ctx, SimulationProgress{Stage: "placing_users", Cycle: cycle, TotalCycles: req.NumberOfCycles, UsersPlaced: len(a.nodes)})
+
+		// Members (other than the founder) may quit at the close of the cycle
+		for i := 1; i < len(a.nodes); i++ {
+			if a.active[i] && a.rng.Float64() < a.traits[i].ChurnRisk {
+				churnedCycle := cycle
+				a.active[i] = false
+				a.traits[i].ChurnedCycle = &churnedCycle
+			}
+		}
+
+		if growthAnalysis != nil {
+			expected := 0.0
+			for _, recruiter := range recruiters {
+				expected += a.traits[recruiter].RecruitingPropensity * saturation
+			}
+			if len(recruiters) > 0 {
+				expected /= float64(len(recruiters))
+			}
+			growthAnalysis.Cycles = append(growthAnalysis.Cycles, GrowthCycle{
+				CycleNumber:            cycle,
+				NewUsers:               newUsers,
+				TotalUsers:             len(a.nodes),
+				RecruitmentProbability: expected,
+				MarketPenetration:      float64(len(a.nodes)) / float64(req.AddressableMarket) * 100,
+			})
+			if growthAnalysis.StallCycle == nil && cycle > 1 && newUsers*100 < len(a.nodes) {
+				stallCycle := cycle
+				growthAnalysis.StallCycle = &stallCycle
+			}
+		}
+	}
+	if growthAnalysis != nil {
+		growthAnalysis.FinalPenetration = float64(len(a.nodes)) / float64(req.AddressableMarket) * 100
+	}
+
+	a.assignBounds()
+
+	cycles := make([]CycleData, 0, req.NumberOfCycles)
+	nextNode := 0
+	for cycle := 1; cycle <= req.NumberOfCycles; cycle++ {
+		count := newUsersPerCycle[cycle-1]
+		cycles = append(cycles, CycleData{
+			CycleNumber:  cycle,
+			StartUser:    nextNode + 1,
+			EndUser:      nextNode + count,
+			UsersInCycle: count,
+			NodesInCycle: append([]GenealogyNode(nil), a.nodes[nextNode:nextNode+count]...),
+		})
+		reportCycle(ctx, cycles[len(cycles)-1])
+		nextNode += count
+	}
+
+	usersPerCycle := len(a.nodes) / req.NumberOfCycles
+	if len(a.nodes)%req.NumberOfCycles != 0 {
+		usersPerCycle++
+	}
+
+	return SimulationResponse{
+		SimulationID:        a.simulationID,
+		GenealogyTypeID:     req.GenealogyTypeID,
+		MaxExpectedUsers:    req.MaxExpectedUsers,
+		PayoutCycleType:     req.PayoutCycleType,
+		NumberOfCycles:      req.NumberOfCycles,
+		UsersPerCycle:       usersPerCycle,
+		TotalNodesGenerated: len(a.nodes),
+		Nodes:               a.nodes,
+		Cycles:              cycles,
+		TreeStructure:       a.buildTreeStructure(),
+		GrowthAnalysis:      growthAnalysis,
+		SimulationMode:      "agent",
+		Seed:                seed,
+		AgentTraits:         a.traits,
+		CreatedAt:           time.Now(),
+	}, nil
+}
+
+// resolveAgentModel fills in defaults for the agent model settings that were not given. Without an
+// agent model every default applies; with one, a zero recruiting propensity and an unset purchase
+// propensity fall back to their defaults.
+func resolveAgentModel(config *AgentModelConfig, recruitmentRate float64) AgentModelConfig {
+	purchasePropensity := defaultPurchasePropensity
+	model := AgentModelConfig{
+		RecruitingPropensity: defaultRecruitingPropensity,
+		PurchasePropensity:   &purchasePropensity,
+		ChurnRisk:            defaultChurnRisk,
+		TraitVariance:        defaultTraitVariance,
+	}
+	if recruitmentRate > 0 {
+		model.RecruitingPropensity = recruitmentRate
+	}
+	if config == nil {
+		return model
+	}
+	if config.RecruitingPropensity > 0 {
+		model.RecruitingPropensity = config.RecruitingPropensity
+	}
+	if config.PurchasePropensity != nil {
+		// A propensity of 0 models members who never buy
+		purchasePropensity = *config.PurchasePropensity
+	}
+	// Zero is meaningful here: no churn, identical members
+	model.ChurnRisk = config.ChurnRisk
+	model.TraitVariance = config.TraitVariance
+	return model
+}
+
+// join adds a member recruited by the given node index (-1 for the founder) and draws their traits
+func (a *AgentBasedSimulator) join(recruiter, cycle, cyclePosition, genealogyTypeID int) {
+	var parentID *int
+	position := "child"
+	depth := 0
+
+	if recruiter >= 0 {
+		parent := a.placementParent(recruiter)
+		// Copy the ID, as a.nodes is appended to after this node
+		id := a.nodes[parent].ID
+		parentID = &id
+		depth = a.nodes[parent].Depth + 1
+		if a.planKind == "binary" {
+			position = "left"
+			if len(a.children[parent]) == 1 {
+				position = "right"
+			}
+		}
+		a.children[parent] = append(a.children[parent], len(a.nodes))
+	} else if a.planKind == "binary" {
+		position = "left"
+	}
+
+	node := GenealogyNode{
+		ID:              len(a.nodes) + 1, // temporary ID for this simulation
+		UserID:          len(a.nodes) + 1,
+		GenealogyTypeID: genealogyTypeID,
+		ParentID:        parentID,
+		Depth:           depth,
+		Position:        position,
+		SimulationID:    &a.simulationID,
+		PayoutCycle:     cycle,
+		CyclePosition:   cyclePosition,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	traits := AgentTraits{
+		NodeID:               node.ID,
+		UserID:               node.UserID,
+		RecruitingPropensity: a.varyTrait(a.model.RecruitingPropensity, math.Inf(1)),
+		PurchasePropensity:   a.varyTrait(*a.model.PurchasePropensity, 1),
+		ChurnRisk:            a.varyTrait(a.model.ChurnRisk, 1),
+	}
+	traits.Purchased = a.rng.Float64() < traits.PurchasePropensity
+
+	a.nodes = append(a.nodes, node)
+	a.traits = append(a.traits, traits)
+	a.children = append(a.children, make([]int, 0))
+	a.active = append(a.active, true)
+}
+
+// placementParent returns the node index a recruit of the given member is placed under. Unilevel
+// recruits are placed directly under their recruiter; binary and matrix recruits spill over to the
+// first open position in the recruiter's downline, level by level.
+func (a *AgentBasedSimulator) placementParent(recruiter int) int {
+	if a.planKind == "unilevel" || a.maxChildrenCount <= 0 {
+		return recruiter
+	}
+
+	queue := []int{recruiter}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if len(a.children[current]) < a.maxChildrenCount {
+			return current
+		}
+		queue = append(queue, a.children[current]...)
+	}
+	return recruiter
+}
+
+// varyTrait draws a member's trait around the model average, within [0, limit]
+func (a *AgentBasedSimulator) varyTrait(average, limit float64) float64 {
+	value := average * (1 + a.model.TraitVariance*a.rng.NormFloat64())
+	return math.Max(0, math.Min(limit, value))
+}
+
+// assignBounds numbers the nodes depth-first to give each one its nested set bounds
+func (a *AgentBasedSimulator) assignBounds() {
+	if len(a.nodes) == 0 {
+		return
+	}
+
+	counter := 1
+	var visit func(index int)
+	visit = func(index int) {
+		a.nodes[index].LeftBound = counter
+		counter++
+		for _, child := range a.children[index] {
+			visit(child)
+		}
+		a.nodes[index].RightBound = counter
+		counter++
+	}
+	visit(0)
+}
+
+// buildTreeStructure builds a tree structure for visualization
+func (a *AgentBasedSimulator) buildTreeStructure() map[string]interface{} {
+	if len(a.nodes) == 0 {
+		return map[string]interface{}{}
+	}
+
+	tree := a.buildTreeNode(0)
+	return map[string]interface{}{
+		"root":        tree,
+		"total_nodes": len(a.nodes),
+	}
+}
+
+// buildTreeNode recursively builds the tree structure
+func (a *AgentBasedSimulator) buildTreeNode(index int) TreeNode {
+	children := make([]TreeNode, 0, len(a.children[index]))
+	for _, child := range a.children[index] {
+		children = append(children, a.buildTreeNode(child))
+	}
+
+	node := a.nodes[index]
+	return TreeNode{
+		ID:       node.ID,
+		UserID:   node.UserID,
+		Position: node.Position,
+		Children: children,
+		Cycle:    node.PayoutCycle,
+	}
+}
+
+// poissonSample draws from a Poisson distribution with the given mean
+func poissonSample(rng *rand.Rand, mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+	if mean > 30 {
+		// Normal approximation for large means
+		return int(math.Max(0, math.Round(mean+math.Sqrt(mean)*rng.NormFloat64())))
+	}
+
+	limit := math.Exp(-mean)
+	count := 0
+	product := rng.Float64()
+	for product > limit {
+		count++
+		product *= rng.Float64()
+	}
+	return count
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+)
+
+// RankDefinition qualifies users for a rank from their accumulated volumes
+type RankDefinition struct {
+	Name              string   `json:"name"`
+	MinPersonalVolume float64  `json:"min_personal_volume"`
+	MinTeamVolume     float64  `json:"min_team_volume"`
+	MinDirectRecruits int      `json:"min_direct_recruits"`
+	Shares            *float64 `json:"shares,omitempty"` // pool shares held at this rank, defaults to 1
+}
+
+// BonusPoolDefinition configures a leadership or global bonus pool
+type BonusPoolDefinition struct {
+	Name            string   `json:"name"`
+	Percentage      float64  `json:"percentage"` // % of company-wide personal volume per period
+	QualifyingRanks []string `json:"qualifying_ranks"`
+	Distribution    string   `json:"distribution,omitempty"` // shares (default) or volume
+	PayoutCycle     string   `json:"payout_cycle,omitempty"` // weekly, biweekly, monthly, quarterly; defaults to the simulation payout cycle
+}
+
+// BonusPoolPeriod shows the size and distribution of a bonus pool in one payout period
+type BonusPoolPeriod struct {
+	PeriodNumber   int     `json:"period_number"`
+	StartDate      string  `json:"start_date,omitempty"`
+	EndDate        string  `json:"end_date,omitempty"`
+	BaseCycles     []int   `json:"base_cycles"`
+	CompanyVolume  float64 `json:"company_volume"`
+	PoolSize       float64 `json:"pool_size"`
+	QualifierCount int     `json:"qualifier_count"`
+	TotalShares    float64 `json:"total_shares"`
+	PerShareValue  float64 `json:"per_share_value"`
+	Flushed        float64 `json:"flushed"` // pool amount left unpaid for lack of qualifiers
+}
+
+// BonusPoolResult shows a bonus pool across all of its payout periods
+type BonusPoolResult struct {
+	Name         string            `json:"name"`
+	Percentage   float64           `json:"percentage"`
+	Distribution string            `json:"distribution"`
+	PayoutCycle  string            `json:"payout_cycle"`
+	Periods      []BonusPoolPeriod `json:"periods"`
+	TotalPaid    float64           `json:"total_paid"`
+	TotalFlushed float64           `json:"total_flushed"`
+}
+
+// bonusPoolDistribution is a pool result together with the simulation cycles its payouts fall in
+type bonusPoolDistribution struct {
+	BonusPoolResult
+	paidByCycle map[int]float64
+}
+
+// validateBonusPools validates the rank and bonus pool settings of a business simulation request
+func validateBonusPools(req BusinessSimulationRequest) error {
+	rankNames := make(map[string]bool)
+	for _, rank := range req.Ranks {
+		if rank.Name == "" {
+			return fmt.Errorf("every rank requires a name")
+		}
+		if rankNames[rank.Name] {
+			return fmt.Errorf("rank %s is defined more than once", rank.Name)
+		}
+		if rank.Shares != nil && *rank.Shares <= 0 {
+			return fmt.Errorf("rank %s shares must be greater than 0", rank.Name)
+		}
+		rankNames[rank.Name] = true
+	}
+
+	for i, pool := range req.BonusPools {
+		label := pool.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+
+		if pool.Percentage <= 0 || pool.Percentage > 100 {
+			return fmt.Errorf("bonus pool %s percentage must be between 0 and 100", label)
+		}
+		if len(pool.QualifyingRanks) == 0 {
+			return fmt.Errorf("bonus pool %s requires at least one qualifying rank", label)
+		}
+		for _, rankName := range pool.QualifyingRanks {
+			if !rankNames[rankName] {
+				return fmt.Errorf("bonus pool %s refers to undefined rank %q", label, rankName)
+			}
+		}
+		if pool.Distribution != "" && pool.Distribution != "shares" && pool.Distribution != "volume" {
+			return fmt.Errorf("bonus pool %s distribution must be shares or volume", label)
+		}
+		if err := validateScheduledPayoutCycle("bonus pool "+label, pool.PayoutCycle, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evaluateRanks returns the index of the highest rank each user holds at the close of the given
+// simulation cycle, or -1 when no rank is reached. Volumes and recruits are counted cumulatively.
+func (t *commissionTree) evaluateRanks(ranks []RankDefinition, throughCycle int) []int {
+	cycles := make([]int, throughCycle)
+	for i := range cycles {
+		cycles[i] = i + 1
+	}
+	personalVolumes := t.periodVolumes(cycles)
+	groupVolumes := t.subtreeVolumes(personalVolumes)
+
+	userRanks := make([]int, len(t.users))
+	for i := range t.users {
+		userRanks[i] = -1
+
+		directRecruits := 0
+		for _, child := range t.children[i] {
+			if t.users[child].PayoutCycle <= throughCycle {
+				directRecruits++
+			}
+		}
+		teamVolume := groupVolumes[i] - personalVolumes[i]
+
+		for rankIndex, rank := range ranks {
+			if personalVolumes[i] >= rank.MinPersonalVolume &&
+				teamVolume >= rank.MinTeamVolume &&
+				directRecruits >= rank.MinDirectRecruits {
+				userRanks[i] = rankIndex
+			}
+		}
+	}
+
+	return userRanks
+}
+
+// distributeBonusPool funds a pool from the company-wide personal volume of each of its payout
+// periods and shares it among the users holding a qualifying rank, or a higher one, at the close
+// of the period, in proportion to their rank shares or to their group volume in the period
+func (t *commissionTree) distributeBonusPool(pool BonusPoolDefinition, ranks []RankDefinition, calendar *PayoutCalendar, simulationCycleType string, numberOfCycles int) (bonusPoolDistribution, error) {
+	periods, err := scheduledPayoutPeriods(pool.Name, pool.PayoutCycle, calendar, simulationCycleType, numberOfCycles)
+	if err != nil {
+		return bonusPoolDistribution{}, err
+	}
+
+	distribution := pool.Distribution
+	if distribution == "" {
+		distribution = "shares"
+	}
+	payoutCycle := normalizeCycleType(pool.PayoutCycle)
+	if payoutCycle == "" {
+		payoutCycle = simulationCycleType
+	}
+
+	// Ranks are listed from lowest to highest, so a user qualifies at the lowest qualifying rank
+	// or any rank above it
+	lowestQualifying := len(ranks)
+	for _, rankName := range pool.QualifyingRanks {
+		for rankIndex, rank := range ranks {
+			if rank.Name == rankName && rankIndex < lowestQualifying {
+				lowestQualifying = rankIndex
+			}
+		}
+	}
+
+	result := bonusPoolDistribution{
+		BonusPoolResult: BonusPoolResult{
+			Name:         pool.Name,
+			Percentage:   pool.Percentage,
+			Distribution: distribution,
+			PayoutCycle:  payoutCycle,
+			Periods:      make([]BonusPoolPeriod, 0, len(periods)),
+		},
+		paidByCycle: make(map[int]float64),
+	}
+
+	for _, period := range periods {
+		closingCycle := period.BaseCycles[len(period.BaseCycles)-1]
+		volumes := t.periodVolumes(period.BaseCycles)
+		groupVolumes := t.subtreeVolumes(volumes)
+		userRanks := t.evaluateRanks(ranks, closingCycle)
+
+		poolPeriod := BonusPoolPeriod{
+			PeriodNumber: period.CycleNumber,
+			StartDate:    period.StartDate,
+			EndDate:      period.EndDate,
+			BaseCycles:   period.BaseCycles,
+		}
+		for _, volume := range volumes {
+			poolPeriod.CompanyVolume += volume
+		}
+		poolPeriod.PoolSize = poolPeriod.CompanyVolume * pool.Percentage / 100
+
+		// Collect the shares held by each qualifier
+		shares := make(map[int]float64)
+		for i := range t.users {
+			if userRanks[i] < lowestQualifying {
+				continue
+			}
+			userShares := 1.0
+			if ranks[userRanks[i]].Shares != nil {
+				userShares = *ranks[userRanks[i]].Shares
+			}
+			if distribution == "volume" {
+				userShares = groupVolumes[i]
+			}
+			poolPeriod.QualifierCount++
+			if userShares > 0 {
+				shares[i] = userShares
+				poolPeriod.TotalShares += userShares
+			}
+		}
+
+		if poolPeriod.TotalShares > 0 {
+			poolPeriod.PerShareValue = poolPeriod.PoolSize / poolPeriod.TotalShares
+			for i, userShares := range shares {
+				amount := userShares * poolPeriod.PerShareValue
+				t.users[i].EarningsPerCycle[closingCycle] += amount
+				t.users[i].EarningsByCommission[pool.Name] += amount
+				t.users[i].TotalEarnings += amount
+			}
+			result.TotalPaid += poolPeriod.PoolSize
+			result.paidByCycle[closingCycle] += poolPeriod.PoolSize
+		} else {
+			poolPeriod.Flushed = poolPeriod.PoolSize
+			result.TotalFlushed += poolPeriod.PoolSize
+		}
+
+		result.Periods = append(result.Periods, poolPeriod)
+	}
+
+	return result, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -28,6 +29,7 @@ type SimulationUser struct {
 	Name                 string             `json:"name"`
 	Level                int                `json:"level"`
 	ParentID             *string            `json:"parent_id,omitempty"`
+	SponsorID            *string            `json:"sponsor_id,omitempty"` // enroller of an imported member
 	Children             []string           `json:"children"`
 	GenealogyPosition    string             `json:"genealogy_position"`
 	ProductID            *int               `json:"product_id,omitempty"`
@@ -44,6 +46,15 @@ type SimulationUser struct {
 	LegVolumePerCycle        map[string]map[int]float64 `json:"leg_volume_per_cycle"`
 	TeamVolumePerCycle       map[int]float64            `json:"team_volume_per_cycle"`
 	VolumeGenerationPerCycle map[int]VolumeGeneration   `json:"volume_generation_per_cycle"`
+	// Commission earnings, keyed by the simulation cycle in which they are paid
+	EarningsPerCycle     map[int]float64    `json:"earnings_per_cycle,omitempty"`
+	EarningsByCommission map[string]float64 `json:"earnings_by_commission,omitempty"`
+	TotalEarnings        float64            `json:"total_earnings,omitempty"`
+	Rank                 string             `json:"rank,omitempty"`
+	// Net position (earnings minus purchases), cumulative at the close of each cycle since joining
+	TotalPurchases      float64         `json:"total_purchases,omitempty"`
+	NetPositionPerCycle map[int]float64 `json:"net_position_per_cycle,omitempty"`
+	BreakEvenCycle      *int            `json:"break_even_cycle,omitempty"`
 }
 
 // BusinessSimulationRequest represents the enhanced simulation request
@@ -55,23 +66,49 @@ type BusinessSimulationRequest struct {
 	MaxChildrenCount     int               `json:"max_children_count"`
 	PayoutCap            float64           `json:"payout_cap"`
 	Products             []BusinessProduct `json:"products"`
+	// Optional calendar settings: first day of cycle 1 (YYYY-MM-DD) and extra payout frequencies
+	StartDate       string                 `json:"start_date,omitempty"`
+	PayoutSchedules []PayoutScheduleConfig `json:"payout_schedules,omitempty"`
+	// Optional commissions and bonus pools, each paid on its own payout cycle
+	Commissions []CommissionDefinition `json:"commissions,omitempty"`
+	Ranks       []RankDefinition       `json:"ranks,omitempty"` // lowest to highest
+	BonusPools  []BonusPoolDefinition  `json:"bonus_pools,omitempty"`
+	// Optional market saturation: recruitment slows as the tree approaches the addressable market
+	AddressableMarket int     `json:"addressable_market,omitempty"`
+	RecruitmentRate   float64 `json:"recruitment_rate,omitempty"`
+	// Optional agent-based mode: the tree grows from member behaviour instead of fill order
+	SimulationMode string            `json:"simulation_mode,omitempty"` // fill (default) or agent
+	AgentModel     *AgentModelConfig `json:"agent_model,omitempty"`
+	Seed           int64             `json:"seed,omitempty"`
+	// Leaves the per-user personal, team and leg volume breakdowns out, which are slow for large trees
+	SkipVolumeBreakdowns bool `json:"skip_volume_breakdowns,omitempty"`
 }
 
 // BusinessSimulationResponse represents the enhanced simulation response
 type BusinessSimulationResponse struct {
-	ID                   string              `json:"id"`
-	GenealogyType        string              `json:"genealogy_type"`
-	MaxExpectedUsers     int                 `json:"max_expected_users"`
-	PayoutCycle          string              `json:"payout_cycle"`
-	NumberOfPayoutCycles int                 `json:"number_of_payout_cycles"`
-	MaxChildrenCount     int                 `json:"max_children_count"`
-	Products             []BusinessProduct   `json:"products"`
-	Users                []SimulationUser    `json:"users"`
-	GenealogyStructure   map[string][]string `json:"genealogy_structure"`
-	SimulationSummary    SimulationSummary   `json:"simulation_summary"`
-	VolumeCalculations   VolumeCalculations  `json:"volume_calculations"`
-	CreatedAt            time.Time           `json:"created_at"`
-	UpdatedAt            time.Time           `json:"updated_at"`
+	ID                   string                 `json:"id"`
+	GenealogyType        string                 `json:"genealogy_type"`
+	MaxExpectedUsers     int                    `json:"max_expected_users"`
+	PayoutCycle          string                 `json:"payout_cycle"`
+	NumberOfPayoutCycles int                    `json:"number_of_payout_cycles"`
+	MaxChildrenCount     int                    `json:"max_children_count"`
+	Products             []BusinessProduct      `json:"products"`
+	Users                []SimulationUser       `json:"users"`
+	GenealogyStructure   map[string][]string    `json:"genealogy_structure"`
+	SimulationSummary    SimulationSummary      `json:"simulation_summary"`
+	VolumeCalculations   VolumeCalculations     `json:"volume_calculations"`
+	CommissionResults    *CommissionSummary     `json:"commission_results,omitempty"`
+	IncomeDisclosure     *IncomeDisclosure      `json:"income_disclosure,omitempty"`
+	ParticipantROI       *ParticipantROISummary `json:"participant_roi,omitempty"`
+	GrowthAnalysis       *GrowthAnalysis        `json:"growth_analysis,omitempty"`
+	SimulationCycleType  string                 `json:"simulation_cycle_type,omitempty"`
+	SimulationCycles     int                    `json:"simulation_cycles,omitempty"`
+	StartDate            string                 `json:"start_date,omitempty"`
+	Calendar             []PayoutPeriod         `json:"calendar,omitempty"`
+	PayoutSchedules      []PayoutSchedule       `json:"payout_schedules,omitempty"`
+	Seed                 int64                  `json:"seed,omitempty"` // replays the same run when sent back with the request
+	CreatedAt            time.Time              `json:"created_at"`
+	UpdatedAt            time.Time              `json:"updated_at"`
 }
 
 // SimulationSummary provides analytics for the simulation
@@ -119,6 +156,8 @@ type PayoutCycleVolume struct {
 	ProductDistribution map[string]ProductCycleDistribution `json:"product_distribution"`
 	LevelBreakdown      map[int]LevelVolumeData             `json:"level_breakdown"`
 	CycleSummary        string                              `json:"cycle_summary"`
+	StartDate           string                              `json:"start_date,omitempty"`
+	EndDate             string                              `json:"end_date,omitempty"`
 
 	// Binary Plan Specifics
 	CarryForwardLeft  float64 `json:"carry_forward_left"`
@@ -218,7 +257,7 @@ type VolumeGeneration struct {
 	PersonalVolume float64            `json:"personal_volume"`
 	LegVolumes     map[string]float64 `json:"leg_volumes"`
 	TeamVolume     float64            `json:"team_volume"`
-	Source         string             `json:"source"` // "enrollment", "purchase", "downline"
+	Source         string             `json:"source"` // "enrollment", "import", "purchase", "downline"
 }
 
 // handleBusinessSimulation handles the enhanced business simulation with products and volumes
@@ -240,82 +279,106 @@ func handleBusinessSimulation(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Business simulation request: %+v", req)
 
-	// Validate request
-	if err := validateBusinessSimulationRequest(req); err != nil {
-		log.Printf("Validation error: %v", err)
+	// Optional ?detail= and ?fields= parameters trim the response
+	shape, err := parseResponseShape(r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	shape.prepare(&req)
+
+	businessResponse, err := runBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Business simulation cancelled: %v", err)
+			return
+		}
+		log.Printf("Business simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Business simulation completed. Generated %d users", len(businessResponse.Users))
+
+	shapedResponse, err := shape.apply(businessResponse)
+	if err != nil {
+		log.Printf("Error shaping response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shapedResponse); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Business simulation response sent successfully")
+}
+
+// runBusinessSimulation validates a business simulation request, runs the genealogy simulation for it
+// and applies the business logic. Runs without a seed are given one so they can be replayed.
+// It stops with the context's error when the context is cancelled.
+func runBusinessSimulation(ctx context.Context, req BusinessSimulationRequest) (BusinessSimulationResponse, error) {
+	if err := validateBusinessSimulationRequest(req); err != nil {
+		return BusinessSimulationResponse{}, err
+	}
+	if req.Seed == 0 {
+		req.Seed = time.Now().UnixNano()
+	}
 
 	// Convert business request to traditional simulation request
 	genealogyTypeID, err := getGenealogyTypeIDByName(req.GenealogyType)
 	if err != nil {
 		log.Printf("Error getting genealogy type ID: %v", err)
-		http.Error(w, "Invalid genealogy type", http.StatusBadRequest)
-		return
+		return BusinessSimulationResponse{}, fmt.Errorf("invalid genealogy type %q", req.GenealogyType)
+	}
+
+	// Commissions paying more often than the payout cycle make the simulation run at their frequency
+	simulationCycleType, simulationCycles, err := resolveSimulationCycles(req)
+	if err != nil {
+		return BusinessSimulationResponse{}, err
 	}
 
 	simReq := SimulationRequest{
-		GenealogyTypeID:  genealogyTypeID,
-		MaxExpectedUsers: req.MaxExpectedUsers,
-		PayoutCycleType:  req.PayoutCycle,
-		NumberOfCycles:   req.NumberOfPayoutCycles,
-		MaxChildrenCount: req.MaxChildrenCount,
+		GenealogyTypeID:   genealogyTypeID,
+		MaxExpectedUsers:  req.MaxExpectedUsers,
+		PayoutCycleType:   simulationCycleType,
+		NumberOfCycles:    simulationCycles,
+		MaxChildrenCount:  req.MaxChildrenCount,
+		StartDate:         req.StartDate,
+		PayoutSchedules:   req.PayoutSchedules,
+		AddressableMarket: req.AddressableMarket,
+		RecruitmentRate:   req.RecruitmentRate,
+		SimulationMode:    req.SimulationMode,
+		AgentModel:        req.AgentModel,
+		Seed:              req.Seed,
 	}
 
 	// Run genealogy simulation using existing stable code
 	genealogyType, err := getGenealogyTypeByID(genealogyTypeID)
 	if err != nil {
 		log.Printf("Error getting genealogy type: %v", err)
-		http.Error(w, "Invalid genealogy type", http.StatusBadRequest)
-		return
+		return BusinessSimulationResponse{}, fmt.Errorf("invalid genealogy type %q", req.GenealogyType)
 	}
 
 	simulationID := fmt.Sprintf("biz_sim_%d", time.Now().UnixNano())
 	log.Printf("Generated business simulation ID: %s", simulationID)
 	log.Printf("Genealogy type name from DB: %s", genealogyType.Name)
 
-	var simResponse SimulationResponse
-	genealogyTypeLower := strings.ToLower(genealogyType.Name)
-
-	// Match genealogy type - support both "binary" and "binary plan" formats
-	// Also fallback to max_children_per_node for custom named types
-	switch {
-	case strings.Contains(genealogyTypeLower, "binary"):
-		simulator := NewBinaryPlanSimulator(simulationID)
-		simResponse = simulator.Simulate(simReq)
-	case strings.Contains(genealogyTypeLower, "unilevel"):
-		simulator := NewUnilevelPlanSimulator(simulationID, req.MaxChildrenCount)
-		simResponse = simulator.Simulate(simReq)
-	case strings.Contains(genealogyTypeLower, "matrix"):
-		simulator := NewMatrixPlanSimulator(simulationID, req.MaxChildrenCount)
-		simResponse = simulator.Simulate(simReq)
-	default:
-		// Fallback: Use max_children_per_node to determine plan type
-		// 2 children = binary-like, >2 = matrix-like
-		log.Printf("Custom genealogy type '%s', using max_children_per_node=%d to determine plan type", genealogyType.Name, req.MaxChildrenCount)
-		if req.MaxChildrenCount <= 2 {
-			simulator := NewBinaryPlanSimulator(simulationID)
-			simResponse = simulator.Simulate(simReq)
-		} else {
-			simulator := NewMatrixPlanSimulator(simulationID, req.MaxChildrenCount)
-			simResponse = simulator.Simulate(simReq)
-		}
+	simResponse, err := runPlanSimulation(ctx, genealogyType, simulationID, simReq)
+	if err != nil {
+		return BusinessSimulationResponse{}, err
 	}
 
-	// Enhance simulation with business logic
-	businessResponse := enhanceSimulationWithBusinessLogic(simResponse, req)
-
-	log.Printf("Business simulation completed. Generated %d users", len(businessResponse.Users))
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(businessResponse); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	calendar, _ := NewPayoutCalendar(simulationCycleType, req.StartDate)
+	if err := applyPayoutCalendar(&simResponse, calendar, req.PayoutSchedules); err != nil {
+		return BusinessSimulationResponse{}, err
 	}
 
-	log.Println("Business simulation response sent successfully")
+	// Enhance simulation with business logic
+	return enhanceSimulationWithBusinessLogic(ctx, simResponse, req)
 }
 
 // validateBusinessSimulationRequest validates the simulation request
@@ -332,6 +395,31 @@ func validateBusinessSimulationRequest(req BusinessSimulationRequest) error {
 		return fmt.Errorf("max_children_count must be greater than 0")
 	}
 
+	// Validate commissions, bonus pools and calendar settings
+	if err := validateCommissionDefinitions(req); err != nil {
+		return err
+	}
+	if err := validateBonusPools(req); err != nil {
+		return err
+	}
+	if err := validateGrowthModel(req.AddressableMarket, req.RecruitmentRate); err != nil {
+		return err
+	}
+	if err := validateSimulationMode(req.SimulationMode, req.AgentModel); err != nil {
+		return err
+	}
+	simulationCycleType, _, err := resolveSimulationCycles(req)
+	if err != nil {
+		return err
+	}
+	calendar, err := NewPayoutCalendar(simulationCycleType, req.StartDate)
+	if err != nil {
+		return err
+	}
+	if err := validatePayoutSchedules(calendar, req.PayoutSchedules); err != nil {
+		return err
+	}
+
 	// Validate genealogy type constraints
 	if req.GenealogyType == "binary" && req.MaxChildrenCount != 2 {
 		return fmt.Errorf("binary genealogy type requires exactly 2 children per user")
@@ -369,27 +457,50 @@ func getGenealogyTypeIDByName(name string) (int, error) {
 }
 
 // enhanceSimulationWithBusinessLogic adds business logic to genealogy simulation
-func enhanceSimulationWithBusinessLogic(simResponse SimulationResponse, req BusinessSimulationRequest) BusinessSimulationResponse {
+func enhanceSimulationWithBusinessLogic(ctx context.Context, simResponse SimulationResponse, req BusinessSimulationRequest) (BusinessSimulationResponse, error) {
 	log.Println("Enhancing simulation with business logic")
+	progress := SimulationProgress{TotalCycles: simResponse.NumberOfCycles, Cycle: simResponse.NumberOfCycles, UsersPlaced: len(simResponse.Nodes)}
+	reportStage := func(stage string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.Stage = stage
+		reportProgress(ctx, progress)
+		return nil
+	}
+	if err := reportStage("assigning_products"); err != nil {
+		return BusinessSimulationResponse{}, err
+	}
 
 	// Convert genealogy nodes to simulation users
 	users := make([]SimulationUser, 0)
 	genealogyStructure := make(map[string][]string)
 
-	// Create simulation users from genealogy nodes
+	// Index the nodes by ID so parents are found without scanning the whole tree
+	nodeIndex := make(map[int]int, len(simResponse.Nodes))
 	for i, node := range simResponse.Nodes {
+		nodeIndex[node.ID] = i
+	}
+
+	// Create simulation users from genealogy nodes
+	for i := range simResponse.Nodes {
+		node := &simResponse.Nodes[i]
 		userID := fmt.Sprintf("user_%d", i+1)
 		userName := fmt.Sprintf("User %d", i+1)
 
 		var parentID *string
 		if node.ParentID != nil {
-			// Find parent user ID
-			for j, parentNode := range simResponse.Nodes {
-				if parentNode.ID == *node.ParentID {
-					parentUserID := fmt.Sprintf("user_%d", j+1)
-					parentID = &parentUserID
-					break
-				}
+			if j, exists := nodeIndex[*node.ParentID]; exists {
+				parentUserID := fmt.Sprintf("user_%d", j+1)
+				parentID = &parentUserID
+			}
+		}
+
+		var sponsorID *string
+		if node.SponsorNodeID != nil {
+			if j, exists := nodeIndex[*node.SponsorNodeID]; exists {
+				sponsorUserID := fmt.Sprintf("user_%d", j+1)
+				sponsorID = &sponsorUserID
 			}
 		}
 
@@ -398,11 +509,12 @@ func enhanceSimulationWithBusinessLogic(simResponse SimulationResponse, req Busi
 			Name:              userName,
 			Level:             node.Depth,
 			ParentID:          parentID,
+			SponsorID:         sponsorID,
 			Children:          make([]string, 0),
 			GenealogyPosition: node.Position,
 			PayoutCycle:       node.PayoutCycle,
 			CreatedAt:         node.CreatedAt,
-			GenealogyNode:     &node,
+			GenealogyNode:     node,
 			TeamLegVolumes:    make(map[string]float64),
 			// Initialize new fields
 			PersonalVolumePerCycle:   make(map[int]float64),
@@ -414,15 +526,11 @@ func enhanceSimulationWithBusinessLogic(simResponse SimulationResponse, req Busi
 		users = append(users, user)
 	}
 
-	// Build children relationships
+	// Build children relationships; user i was created from node i
 	for i := range users {
-		if users[i].ParentID != nil {
-			// Find parent and add this user as child
-			for j := range users {
-				if users[j].ID == *users[i].ParentID {
-					users[j].Children = append(users[j].Children, users[i].ID)
-					break
-				}
+		if parentNodeID := simResponse.Nodes[i].ParentID; parentNodeID != nil {
+			if j, exists := nodeIndex[*parentNodeID]; exists {
+				users[j].Children = append(users[j].Children, users[i].ID)
 			}
 		}
 	}
@@ -434,19 +542,65 @@ func enhanceSimulationWithBusinessLogic(simResponse SimulationResponse, req Busi
 		}
 	}
 
-	// Assign products to users based on sales ratios
-	assignProductsToUsers(users, req.Products)
+	// Assign products to users based on sales ratios; agent-based members may decline to buy and
+	// placeholders of removed members in a stored genealogy do not buy
+	nonPurchasers := make(map[int]bool)
+	for _, traits := range simResponse.AgentTraits {
+		if !traits.Purchased {
+			nonPurchasers[traits.NodeID] = true
+		}
+	}
+	for _, node := range simResponse.Nodes {
+		if node.Status == "placeholder" {
+			nonPurchasers[node.ID] = true
+		}
+	}
+	rng := rand.New(rand.NewSource(req.Seed))
+	assignProductsToUsers(users, req.Products, nonPurchasers, rng)
 
 	// Calculate volumes
-	calculateVolumes(users, req.GenealogyType)
+	if err := reportStage("calculating_volumes"); err != nil {
+		return BusinessSimulationResponse{}, err
+	}
+	if err := calculateVolumes(ctx, users, req.GenealogyType); err != nil {
+		return BusinessSimulationResponse{}, err
+	}
 
 	// Generate simulation summary
-	summary := generateSimulationSummary(users, req.Products, req.NumberOfPayoutCycles)
+	summary := generateSimulationSummary(users, req.Products, simResponse.NumberOfCycles)
 
 	// Generate volume calculations breakdown
-	volumeCalculations := generateVolumeCalculations(users, req.Products, req.GenealogyType, req.PayoutCap)
+	volumeCalculations := generateVolumeCalculations(users, req.Products, req.GenealogyType, req.PayoutCap, !req.SkipVolumeBreakdowns)
+	attachCycleDates(volumeCalculations.VolumeByPayoutCycle, simResponse.Cycles)
+	reportPayoutCycles(ctx, volumeCalculations.VolumeByPayoutCycle)
 
-	return BusinessSimulationResponse{
+	// Run commissions and bonus pools on their own payout schedules
+	var commissionResults *CommissionSummary
+	if len(req.Commissions) > 0 || len(req.BonusPools) > 0 || len(req.Ranks) > 0 {
+		if err := reportStage("calculating_commissions"); err != nil {
+			return BusinessSimulationResponse{}, err
+		}
+		calendar, err := NewPayoutCalendar(simResponse.PayoutCycleType, simResponse.StartDate)
+		if err != nil {
+			return BusinessSimulationResponse{}, err
+		}
+		commissionResults, err = calculateCommissions(users, req, calendar, simResponse.PayoutCycleType, simResponse.NumberOfCycles)
+		if err != nil {
+			return BusinessSimulationResponse{}, err
+		}
+	}
+
+	// Income disclosure statement and participant ROI over the per-user earnings
+	var incomeDisclosure *IncomeDisclosure
+	var participantROI *ParticipantROISummary
+	if commissionResults != nil {
+		incomeDisclosure = generateIncomeDisclosure(users, req.Products, req.Ranks)
+		participantROI = calculateParticipantROI(users, req.Products, simResponse.NumberOfCycles)
+		applyLateJoinerImpact(simResponse.GrowthAnalysis, users)
+	}
+	reportUsers(ctx, users)
+
+	response := BusinessSimulationResponse{
 		ID:                   simResponse.SimulationID,
 		GenealogyType:        req.GenealogyType,
 		MaxExpectedUsers:     req.MaxExpectedUsers,
@@ -458,18 +612,44 @@ func enhanceSimulationWithBusinessLogic(simResponse SimulationResponse, req Busi
 		GenealogyStructure:   genealogyStructure,
 		SimulationSummary:    summary,
 		VolumeCalculations:   volumeCalculations,
+		CommissionResults:    commissionResults,
+		IncomeDisclosure:     incomeDisclosure,
+		ParticipantROI:       participantROI,
+		GrowthAnalysis:       simResponse.GrowthAnalysis,
+		StartDate:            simResponse.StartDate,
+		Calendar:             simResponse.Calendar,
+		PayoutSchedules:      simResponse.PayoutSchedules,
+		Seed:                 req.Seed,
 		CreatedAt:            simResponse.CreatedAt,
 		UpdatedAt:            time.Now(),
 	}
+	if simResponse.PayoutCycleType != req.PayoutCycle || simResponse.NumberOfCycles != req.NumberOfPayoutCycles {
+		response.SimulationCycleType = simResponse.PayoutCycleType
+		response.SimulationCycles = simResponse.NumberOfCycles
+	}
+
+	return response, nil
 }
 
-// assignProductsToUsers assigns products to users based on sales ratios
-func assignProductsToUsers(users []SimulationUser, products []BusinessProduct) {
+// assignProductsToUsers assigns products to users based on sales ratios, skipping the given node IDs.
+// Imported members with recorded purchases keep those purchases as their personal volume instead.
+func assignProductsToUsers(users []SimulationUser, products []BusinessProduct, nonPurchasers map[int]bool, rng *rand.Rand) {
 	log.Printf("Assigning products to %d users", len(users))
 
-	// Skip root user (no product assignment)
+	// Skip root user (no product assignment) and members who did not purchase
 	usersToAssign := make([]*SimulationUser, 0)
+	imported := 0
 	for i := range users {
+		if users[i].GenealogyNode != nil && nonPurchasers[users[i].GenealogyNode.ID] {
+			continue
+		}
+		if node := users[i].GenealogyNode; node != nil && node.PurchaseVolume != nil {
+			if *node.PurchaseVolume > 0 {
+				setEnrollmentVolume(&users[i], *node.PurchaseVolume, "import")
+			}
+			imported++
+			continue
+		}
 		if users[i].Level > 0 {
 			usersToAssign = append(usersToAssign, &users[i])
 		}
@@ -477,31 +657,36 @@ func assignProductsToUsers(users []SimulationUser, products []BusinessProduct) {
 
 	// Assign products randomly based on sales ratios
 	for _, user := range usersToAssign {
-		product := assignProductBasedOnSalesRatio(products)
+		product := assignProductBasedOnSalesRatio(products, rng)
 
 		user.ProductID = &product.ID
 		user.ProductName = &product.ProductName
-		user.CommissionableVolume = product.BusinessVolume
-		user.PersonalVolume = product.BusinessVolume
+		setEnrollmentVolume(user, product.BusinessVolume, "enrollment")
+	}
 
-		// Set personal volume per cycle (attributed to enrollment cycle)
-		user.PersonalVolumePerCycle[user.PayoutCycle] = product.BusinessVolume
+	log.Printf("Assigned products to %d users, kept imported purchases of %d", len(usersToAssign), imported)
+}
 
-		// Initialize volume generation for this cycle
-		user.VolumeGenerationPerCycle[user.PayoutCycle] = VolumeGeneration{
-			PersonalVolume: product.BusinessVolume,
-			LegVolumes:     make(map[string]float64),
-			TeamVolume:     0.0, // Will be calculated later
-			Source:         "enrollment",
-		}
-	}
+// setEnrollmentVolume sets a user's personal volume, attributed to their enrollment cycle
+func setEnrollmentVolume(user *SimulationUser, volume float64, source string) {
+	user.CommissionableVolume = volume
+	user.PersonalVolume = volume
+
+	// Set personal volume per cycle (attributed to enrollment cycle)
+	user.PersonalVolumePerCycle[user.PayoutCycle] = volume
 
-	log.Printf("Assigned products to %d users", len(usersToAssign))
+	// Initialize volume generation for this cycle
+	user.VolumeGenerationPerCycle[user.PayoutCycle] = VolumeGeneration{
+		PersonalVolume: volume,
+		LegVolumes:     make(map[string]float64),
+		TeamVolume:     0.0, // Will be calculated later
+		Source:         source,
+	}
 }
 
 // assignProductBasedOnSalesRatio assigns a product based on sales ratio (random assignment)
-func assignProductBasedOnSalesRatio(products []BusinessProduct) BusinessProduct {
-	random := rand.Float64() * 100
+func assignProductBasedOnSalesRatio(products []BusinessProduct, rng *rand.Rand) BusinessProduct {
+	random := rng.Float64() * 100
 	cumulativeRatio := 0.0
 
 	for _, product := range products {
@@ -516,7 +701,7 @@ func assignProductBasedOnSalesRatio(products []BusinessProduct) BusinessProduct
 }
 
 // calculateVolumes calculates personal and team volumes for all users with cycle attribution
-func calculateVolumes(users []SimulationUser, genealogyType string) {
+func calculateVolumes(ctx context.Context, users []SimulationUser, genealogyType string) error {
 	log.Printf("Calculating volumes for %d users with cycle attribution", len(users))
 
 	// Personal volumes are already set during product assignment
@@ -547,12 +732,17 @@ func calculateVolumes(users []SimulationUser, genealogyType string) {
 	}
 
 	// Calculate team volumes (unlimited genealogy levels) and leg-specific volumes with cycle attribution
+	// Each user walks their whole downline, so cancellation is checked per user
 	for i := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		users[i].TeamVolume = calculateTeamVolumeWithCycleAttribution(users[i].ID, users)
 		users[i].TeamLegVolumes = calculateTeamLegVolumesWithCycleAttribution(users[i].ID, users, genealogyType)
 	}
 
 	log.Println("Enhanced volume calculations with cycle attribution completed")
+	return nil
 }
 
 // calculateTeamVolumeWithCycleAttribution calculates team volume with cycle attribution
@@ -1038,15 +1228,20 @@ func generateSimulationSummary(users []SimulationUser, products []BusinessProduc
 }
 
 // generateVolumeCalculations generates detailed volume calculation breakdown
-func generateVolumeCalculations(users []SimulationUser, products []BusinessProduct, genealogyType string, payoutCap float64) VolumeCalculations {
+func generateVolumeCalculations(users []SimulationUser, products []BusinessProduct, genealogyType string, payoutCap float64, includeBreakdowns bool) VolumeCalculations {
 	log.Println("Generating volume calculations breakdown")
 
 	personalVolumeBreakdown := make(map[string]PersonalVolumeDetail)
 	teamVolumeBreakdown := make(map[string]TeamVolumeDetail)
 	legVolumeBreakdown := make(map[string]LegVolumeDetail)
+	breakdownUsers := users
+	if !includeBreakdowns {
+		// Per-user breakdowns are skipped; only the payout cycle volumes are calculated
+		breakdownUsers = nil
+	}
 
 	// Generate personal volume breakdown
-	for _, user := range users {
+	for _, user := range breakdownUsers {
 		personalDetail := PersonalVolumeDetail{
 			UserID:               user.ID,
 			UserName:             user.Name,
@@ -1071,7 +1266,7 @@ func generateVolumeCalculations(users []SimulationUser, products []BusinessProdu
 	}
 
 	// Generate team volume breakdown
-	for _, user := range users {
+	for _, user := range breakdownUsers {
 		directDownline := user.Children
 		totalDownline := countTotalDownline(user.ID, users)
 		downlineVolumes := make(map[string]float64)
@@ -1104,7 +1299,7 @@ func generateVolumeCalculations(users []SimulationUser, products []BusinessProdu
 	}
 
 	// Generate leg volume breakdown
-	for _, user := range users {
+	for _, user := range breakdownUsers {
 		legStructure := make(map[string]LegStructure)
 
 		for legKey, legVolume := range user.TeamLegVolumes {
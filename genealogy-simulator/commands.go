@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// commands are the command line subcommands, run instead of the server as
+// genealogy-simulator <command> [flags]
+var commands = map[string]func(args []string) error{
+	"stress-insert":   runStressInsert,
+	"check-integrity": runCheckIntegrity,
+}
+
+// runCommand runs a subcommand against the database
+func runCommand(name string, args []string) error {
+	command, exists := commands[name]
+	if !exists {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return command(args)
+}
+
+// flagSet returns the flag set of a subcommand
+func flagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// runStressInsert adds users to a genealogy from many goroutines at once, as parallel
+// generate-users calls would, and then checks that the nested set is still consistent.
+// Run it against a local database only: it creates real users and nodes.
+func runStressInsert(args []string) error {
+	flags := flagSet("stress-insert")
+	genealogyTypeID := flags.Int("type", 0, "genealogy type to insert into")
+	workers := flags.Int("workers", 8, "concurrent inserters")
+	users := flags.Int("users", 25, "users added by each inserter")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *genealogyTypeID <= 0 || *workers <= 0 || *users <= 0 {
+		return fmt.Errorf("type, workers and users must be positive")
+	}
+
+	started := time.Now()
+	_, failures := stressInsert(*genealogyTypeID, *workers, *users)
+	log.Printf("Inserts finished in %v with %d failures", time.Since(started), len(failures))
+	for _, failure := range failures {
+		log.Printf("  %v", failure)
+	}
+
+	report, err := checkGenealogyIntegrity(*genealogyTypeID, false)
+	if err != nil {
+		return err
+	}
+	for _, violation := range report.Violations {
+		log.Printf("  %s: %s", violation.Kind, violation.Message)
+	}
+	if len(failures) > 0 || !report.Consistent {
+		return fmt.Errorf("stress insert found %d failed inserts and %d integrity violations", len(failures), report.ViolationCount)
+	}
+
+	log.Printf("Genealogy type %d is consistent with %d nodes", *genealogyTypeID, report.TotalNodes)
+	return nil
+}
+
+// stressInsert adds users from the given number of concurrent inserters, each adding the given
+// number of users. It returns the simulation ID the nodes are recorded under, which also prefixes
+// the users' emails, and the inserts that failed.
+func stressInsert(genealogyTypeID, workers, users int) (string, []error) {
+	runID := uuid.New().String()[:8]
+	runStamp := time.Now().UnixNano() % 100000000 // keeps WhatsApp numbers unique across runs
+	simulationID := "stress-" + runID
+	log.Printf("Adding %d users from %d inserters to genealogy type %d (simulation %s)",
+		workers*users, workers, genealogyTypeID, simulationID)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failures []error
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 1; i <= users; i++ {
+				suffix := fmt.Sprintf("%s-%d-%d", runID, worker, i)
+				user, err := createUser(fmt.Sprintf("stress-%s@example.com", suffix),
+					fmt.Sprintf("Stress User %s", suffix), "user",
+					fmt.Sprintf("+9%08d%03d%04d", runStamp, worker, i))
+				if err == nil {
+					_, err = addUserToGenealogy(user.ID, genealogyTypeID, nil, "", simulationID, 1, i)
+				}
+				if err != nil {
+					mu.Lock()
+					failures = append(failures, fmt.Errorf("inserter %d, user %d: %v", worker, i, err))
+					mu.Unlock()
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	return simulationID, failures
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+)
+
+// CommissionDefinition configures one commission type paid by the business plan
+type CommissionDefinition struct {
+	Name             string    `json:"name"`
+	Type             string    `json:"type"`                        // binary, unilevel, referral (paid to the sponsor)
+	Percentage       float64   `json:"percentage"`                  // % of the commissionable volume
+	LevelPercentages []float64 `json:"level_percentages,omitempty"` // unilevel: % per level, overrides percentage
+	MaxLevel         int       `json:"max_level,omitempty"`         // unilevel: levels paid when level_percentages is empty
+	MinVolume        float64   `json:"min_volume,omitempty"`        // personal volume an earner needs to qualify
+	MaxVolume        float64   `json:"max_volume,omitempty"`        // cap on commissionable volume per earner per period
+	PayoutCycle      string    `json:"payout_cycle,omitempty"`      // weekly, biweekly, monthly, quarterly; defaults to the simulation payout cycle
+}
+
+// CommissionPeriodPayout shows one payout period of a commission
+type CommissionPeriodPayout struct {
+	PeriodNumber         int     `json:"period_number"`
+	StartDate            string  `json:"start_date,omitempty"`
+	EndDate              string  `json:"end_date,omitempty"`
+	BaseCycles           []int   `json:"base_cycles"`
+	CommissionableVolume float64 `json:"commissionable_volume"`
+	TotalPayout          float64 `json:"total_payout"`
+	EarnersCount         int     `json:"earners_count"`
+	CapFlush             float64 `json:"cap_flush"`
+}
+
+// CommissionResult shows the payouts of one commission on its own schedule
+type CommissionResult struct {
+	Name        string                   `json:"name"`
+	Type        string                   `json:"type"`
+	PayoutCycle string                   `json:"payout_cycle"`
+	Periods     []CommissionPeriodPayout `json:"periods"`
+	TotalPayout float64                  `json:"total_payout"`
+}
+
+// CommissionSummary aggregates all commission payouts of a business simulation
+type CommissionSummary struct {
+	SimulationCycleType string             `json:"simulation_cycle_type"`
+	Commissions         []CommissionResult `json:"commissions"`
+	Pools               []BonusPoolResult  `json:"pools,omitempty"`
+	PayoutByCycle       map[int]float64    `json:"payout_by_cycle"` // paid at the close of each simulation cycle
+	TotalPayout         float64            `json:"total_payout"`
+	TotalVolume         float64            `json:"total_volume"`
+	PayoutRatio         float64            `json:"payout_ratio"` // total payout as % of total personal volume
+}
+
+// supportedCommissionTypes lists the commission types the engine can calculate
+var supportedCommissionTypes = map[string]bool{
+	"binary":   true,
+	"unilevel": true,
+	"referral": true,
+}
+
+// validateCommissionDefinitions validates the commission settings of a business simulation request
+func validateCommissionDefinitions(req BusinessSimulationRequest) error {
+	for i, commission := range req.Commissions {
+		label := commission.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+
+		if !supportedCommissionTypes[commission.Type] {
+			return fmt.Errorf("commission %s has unsupported type %q (expected binary, unilevel or referral)", label, commission.Type)
+		}
+		if commission.Type == "binary" && req.GenealogyType != "binary" {
+			return fmt.Errorf("commission %s requires a binary genealogy type", label)
+		}
+		if commission.Percentage < 0 || commission.Percentage > 100 {
+			return fmt.Errorf("commission %s percentage must be between 0 and 100", label)
+		}
+		for _, percentage := range commission.LevelPercentages {
+			if percentage < 0 || percentage > 100 {
+				return fmt.Errorf("commission %s level percentages must be between 0 and 100", label)
+			}
+		}
+		if err := validateScheduledPayoutCycle("commission "+label, commission.PayoutCycle, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateScheduledPayoutCycle checks the payout cycle of a commission or bonus pool
+func validateScheduledPayoutCycle(label, payoutCycle string, req BusinessSimulationRequest) error {
+	if payoutCycle == "" {
+		return nil
+	}
+	if _, ok := cycleTypeNominalDays[normalizeCycleType(payoutCycle)]; !ok {
+		return fmt.Errorf("%s has unsupported payout cycle %q", label, payoutCycle)
+	}
+	if normalizeCycleType(payoutCycle) != normalizeCycleType(req.PayoutCycle) && req.StartDate == "" {
+		return fmt.Errorf("start_date is required when %s pays on a different cycle than payout_cycle", label)
+	}
+	return nil
+}
+
+// scheduledPayoutCycles returns the payout cycles declared by the commissions and bonus pools of a request
+func scheduledPayoutCycles(req BusinessSimulationRequest) []string {
+	cycles := make([]string, 0, len(req.Commissions)+len(req.BonusPools))
+	for _, commission := range req.Commissions {
+		cycles = append(cycles, commission.PayoutCycle)
+	}
+	for _, pool := range req.BonusPools {
+		cycles = append(cycles, pool.PayoutCycle)
+	}
+	return cycles
+}
+
+// resolveSimulationCycles picks the cycle type the simulation runs at: the finest frequency among
+// the request payout cycle, its commissions and its bonus pools. When that is finer than the requested payout cycle
+// the number of cycles is expanded to cover the same calendar span.
+func resolveSimulationCycles(req BusinessSimulationRequest) (string, int, error) {
+	cycleType := normalizeCycleType(req.PayoutCycle)
+	requestedDays, known := cycleTypeNominalDays[cycleType]
+	if !known {
+		return req.PayoutCycle, req.NumberOfPayoutCycles, nil
+	}
+
+	finest := cycleType
+	for _, payoutCycle := range scheduledPayoutCycles(req) {
+		payoutCycle = normalizeCycleType(payoutCycle)
+		if days, ok := cycleTypeNominalDays[payoutCycle]; ok && days < cycleTypeNominalDays[finest] {
+			finest = payoutCycle
+		}
+	}
+	if cycleTypeNominalDays[finest] == requestedDays {
+		return req.PayoutCycle, req.NumberOfPayoutCycles, nil
+	}
+
+	requested, err := NewPayoutCalendar(cycleType, req.StartDate)
+	if err != nil {
+		return "", 0, err
+	}
+	if requested == nil {
+		return "", 0, fmt.Errorf("start_date is required when commissions pay more often than payout_cycle")
+	}
+
+	_, spanEnd := requested.Period(req.NumberOfPayoutCycles)
+	fine := &PayoutCalendar{CycleType: finest, StartDate: requested.StartDate}
+	cycles := 0
+	for {
+		cycles++
+		if _, end := fine.Period(cycles); !end.Before(spanEnd) {
+			break
+		}
+	}
+
+	log.Printf("Commissions pay %s, running %d %s cycles to cover %d %s cycles", finest, cycles, finest, req.NumberOfPayoutCycles, cycleType)
+	return finest, cycles, nil
+}
+
+// commissionTree indexes simulation users for the commission calculations
+type commissionTree struct {
+	users    []SimulationUser
+	parent   []int
+	sponsor  []int // the enroller where known, otherwise the placement parent
+	children [][]int
+	order    []int // parents before children
+}
+
+// newCommissionTree builds parent/child indexes over the simulation users
+func newCommissionTree(users []SimulationUser) *commissionTree {
+	index := make(map[string]int, len(users))
+	for i := range users {
+		index[users[i].ID] = i
+	}
+
+	tree := &commissionTree{
+		users:    users,
+		parent:   make([]int, len(users)),
+		sponsor:  make([]int, len(users)),
+		children: make([][]int, len(users)),
+		order:    make([]int, 0, len(users)),
+	}
+
+	for i := range users {
+		tree.parent[i] = -1
+		if users[i].ParentID != nil {
+			if parentIndex, exists := index[*users[i].ParentID]; exists {
+				tree.parent[i] = parentIndex
+			}
+		}
+		tree.sponsor[i] = tree.parent[i]
+		if users[i].SponsorID != nil {
+			if sponsorIndex, exists := index[*users[i].SponsorID]; exists {
+				tree.sponsor[i] = sponsorIndex
+			}
+		}
+		for _, childID := range users[i].Children {
+			if childIndex, exists := index[childID]; exists {
+				tree.children[i] = append(tree.children[i], childIndex)
+			}
+		}
+	}
+
+	// Breadth-first order from the roots so every parent precedes its children
+	for i := range users {
+		if tree.parent[i] == -1 {
+			tree.order = append(tree.order, i)
+		}
+	}
+	for head := 0; head < len(tree.order); head++ {
+		tree.order = append(tree.order, tree.children[tree.order[head]]...)
+	}
+
+	return tree
+}
+
+// periodVolumes sums each user's personal volume over the given simulation cycles
+func (t *commissionTree) periodVolumes(cycles []int) []float64 {
+	volumes := make([]float64, len(t.users))
+	for i := range t.users {
+		for _, cycle := range cycles {
+			volumes[i] += t.users[i].PersonalVolumePerCycle[cycle]
+		}
+	}
+	return volumes
+}
+
+// subtreeVolumes sums the given per-user volumes over each user's subtree (including the user)
+func (t *commissionTree) subtreeVolumes(volumes []float64) []float64 {
+	totals := make([]float64, len(volumes))
+	copy(totals, volumes)
+	for i := len(t.order) - 1; i >= 0; i-- {
+		node := t.order[i]
+		if t.parent[node] >= 0 {
+			totals[t.parent[node]] += totals[node]
+		}
+	}
+	return totals
+}
+
+// binaryLegs returns the left and right child of a user, honouring the stored genealogy position
+func (t *commissionTree) binaryLegs(node int) (int, int) {
+	left, right := -1, -1
+	for i, child := range t.children[node] {
+		switch t.users[child].GenealogyPosition {
+		case "left":
+			left = child
+		case "right":
+			right = child
+		default:
+			if i == 0 && left == -1 {
+				left = child
+			} else if right == -1 {
+				right = child
+			}
+		}
+	}
+	return left, right
+}
+
+// scheduledPayoutPeriods returns the payout periods of a commission or bonus pool in terms of simulation cycles
+func scheduledPayoutPeriods(name, payoutCycle string, calendar *PayoutCalendar, simulationCycleType string, numberOfCycles int) ([]PayoutPeriod, error) {
+	cycleType := normalizeCycleType(payoutCycle)
+	if cycleType == "" || cycleType == normalizeCycleType(simulationCycleType) {
+		periods := make([]PayoutPeriod, 0, numberOfCycles)
+		for cycle := 1; cycle <= numberOfCycles; cycle++ {
+			period := PayoutPeriod{CycleNumber: cycle}
+			if calendar != nil {
+				period = calendar.PayoutPeriod(cycle)
+			}
+			period.BaseCycles = []int{cycle}
+			periods = append(periods, period)
+		}
+		return periods, nil
+	}
+
+	if calendar == nil {
+		return nil, fmt.Errorf("%s pays %s but the simulation has no start_date", name, cycleType)
+	}
+	schedule, err := calendar.Schedule(PayoutScheduleConfig{Name: name, CycleType: cycleType}, numberOfCycles)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Periods, nil
+}
+
+// calculateCommissions runs every configured commission over the simulation cycles and credits
+// the earnings to the users. Volume accumulates per simulation cycle; each commission is paid
+// when one of its own payout periods closes.
+func calculateCommissions(users []SimulationUser, req BusinessSimulationRequest, calendar *PayoutCalendar, simulationCycleType string, numberOfCycles int) (*CommissionSummary, error) {
+	log.Printf("Calculating %d commissions and %d bonus pools over %d %s cycles", len(req.Commissions), len(req.BonusPools), numberOfCycles, simulationCycleType)
+
+	tree := newCommissionTree(users)
+	for i := range users {
+		users[i].EarningsPerCycle = make(map[int]float64)
+		users[i].EarningsByCommission = make(map[string]float64)
+		users[i].TotalEarnings = 0
+	}
+
+	summary := &CommissionSummary{
+		SimulationCycleType: simulationCycleType,
+		Commissions:         make([]CommissionResult, 0, len(req.Commissions)),
+		Pools:               make([]BonusPoolResult, 0, len(req.BonusPools)),
+		PayoutByCycle:       make(map[int]float64),
+	}
+	for cycle := 1; cycle <= numberOfCycles; cycle++ {
+		summary.PayoutByCycle[cycle] = 0
+	}
+
+	for _, commission := range req.Commissions {
+		periods, err := scheduledPayoutPeriods(commission.Name, commission.PayoutCycle, calendar, simulationCycleType, numberOfCycles)
+		if err != nil {
+			return nil, err
+		}
+
+		payoutCycle := normalizeCycleType(commission.PayoutCycle)
+		if payoutCycle == "" {
+			payoutCycle = simulationCycleType
+		}
+		result := CommissionResult{
+			Name:        commission.Name,
+			Type:        commission.Type,
+			PayoutCycle: payoutCycle,
+			Periods:     make([]CommissionPeriodPayout, 0, len(periods)),
+		}
+
+		// Binary carry forward persists across the commission's periods
+		carryLeft := make([]float64, len(users))
+		carryRight := make([]float64, len(users))
+		lifetimeVolume := make([]float64, len(users))
+
+		for _, period := range periods {
+			volumes := tree.periodVolumes(period.BaseCycles)
+			for i := range users {
+				lifetimeVolume[i] += volumes[i]
+			}
+
+			var earnings, commissionable []float64
+			var flush float64
+			switch commission.Type {
+			case "binary":
+				capVolume := commission.MaxVolume
+				if capVolume <= 0 {
+					capVolume = req.PayoutCap
+				}
+				earnings, commissionable, flush = tree.binaryEarnings(commission, volumes, carryLeft, carryRight, capVolume)
+			case "unilevel":
+				earnings, commissionable, flush = tree.unilevelEarnings(commission, volumes, tree.parent)
+			case "referral":
+				referral := commission
+				referral.LevelPercentages = []float64{commission.Percentage}
+				earnings, commissionable, flush = tree.unilevelEarnings(referral, volumes, tree.sponsor)
+			}
+
+			payoutCycle := period.BaseCycles[len(period.BaseCycles)-1]
+			periodPayout := CommissionPeriodPayout{
+				PeriodNumber: period.CycleNumber,
+				StartDate:    period.StartDate,
+				EndDate:      period.EndDate,
+				BaseCycles:   period.BaseCycles,
+				CapFlush:     flush,
+			}
+			for i, amount := range earnings {
+				if lifetimeVolume[i] < commission.MinVolume {
+					// Unqualified earners forfeit their commissionable volume
+					periodPayout.CapFlush += commissionable[i]
+					continue
+				}
+				periodPayout.CommissionableVolume += commissionable[i]
+				if amount <= 0 {
+					continue
+				}
+				users[i].EarningsPerCycle[payoutCycle] += amount
+				users[i].EarningsByCommission[commission.Name] += amount
+				users[i].TotalEarnings += amount
+				periodPayout.TotalPayout += amount
+				periodPayout.EarnersCount++
+			}
+
+			summary.PayoutByCycle[payoutCycle] += periodPayout.TotalPayout
+			result.TotalPayout += periodPayout.TotalPayout
+			result.Periods = append(result.Periods, periodPayout)
+		}
+
+		summary.TotalPayout += result.TotalPayout
+		summary.Commissions = append(summary.Commissions, result)
+	}
+
+	// Leadership and global bonus pools are shared among qualifying ranks
+	for _, pool := range req.BonusPools {
+		result, err := tree.distributeBonusPool(pool, req.Ranks, calendar, simulationCycleType, numberOfCycles)
+		if err != nil {
+			return nil, err
+		}
+		for cycle, amount := range result.paidByCycle {
+			summary.PayoutByCycle[cycle] += amount
+		}
+		summary.TotalPayout += result.TotalPaid
+		summary.Pools = append(summary.Pools, result.BonusPoolResult)
+	}
+
+	// Report the rank each user holds at the end of the simulation
+	if len(req.Ranks) > 0 {
+		finalRanks := tree.evaluateRanks(req.Ranks, numberOfCycles)
+		for i := range users {
+			users[i].Rank = ""
+			if finalRanks[i] >= 0 {
+				users[i].Rank = req.Ranks[finalRanks[i]].Name
+			}
+		}
+	}
+
+	for _, user := range users {
+		summary.TotalVolume += user.PersonalVolume
+	}
+	if summary.TotalVolume > 0 {
+		summary.PayoutRatio = summary.TotalPayout / summary.TotalVolume * 100
+	}
+
+	log.Printf("Commission calculation completed: $%.2f paid on $%.2f volume (%.2f%%)", summary.TotalPayout, summary.TotalVolume, summary.PayoutRatio)
+	return summary, nil
+}
+
+// binaryEarnings matches each user's left and right leg volume for one period, carrying the
+// unmatched volume forward and capping the matched volume per user. It returns the earnings and
+// commissionable volume per user and the volume flushed by the cap.
+func (t *commissionTree) binaryEarnings(commission CommissionDefinition, volumes, carryLeft, carryRight []float64, capVolume float64) ([]float64, []float64, float64) {
+	earnings := make([]float64, len(t.users))
+	commissionable := make([]float64, len(t.users))
+	legTotals := t.subtreeVolumes(volumes)
+	flush := 0.0
+
+	for i := range t.users {
+		left, right := t.binaryLegs(i)
+		totalLeft := carryLeft[i]
+		totalRight := carryRight[i]
+		if left >= 0 {
+			totalLeft += legTotals[left]
+		}
+		if right >= 0 {
+			totalRight += legTotals[right]
+		}
+
+		matched := math.Min(totalLeft, totalRight)
+		carryLeft[i] = totalLeft - matched
+		carryRight[i] = totalRight - matched
+
+		if capVolume > 0 && matched > capVolume {
+			flush += matched - capVolume
+			matched = capVolume
+		}
+		commissionable[i] = matched
+		earnings[i] = matched * commission.Percentage / 100
+	}
+
+	return earnings, commissionable, flush
+}
+
+// unilevelEarnings pays each user a percentage of the period volume generated at each level of
+// their downline, up to the configured depth, capping the commissionable volume per user. The
+// upline maps each user to the one paid on their volume, the placement parent or the sponsor.
+func (t *commissionTree) unilevelEarnings(commission CommissionDefinition, volumes []float64, upline []int) ([]float64, []float64, float64) {
+	levelPercentages := commission.LevelPercentages
+	if len(levelPercentages) == 0 {
+		maxLevel := commission.MaxLevel
+		if maxLevel <= 0 {
+			maxLevel = 1
+		}
+		levelPercentages = make([]float64, maxLevel)
+		for i := range levelPercentages {
+			levelPercentages[i] = commission.Percentage
+		}
+	}
+
+	earnings := make([]float64, len(t.users))
+	commissionableByEarner := make([]float64, len(t.users))
+	for i := range t.users {
+		if volumes[i] == 0 {
+			continue
+		}
+		ancestor := upline[i]
+		for level := 0; level < len(levelPercentages) && ancestor >= 0; level++ {
+			commissionableByEarner[ancestor] += volumes[i]
+			earnings[ancestor] += volumes[i] * levelPercentages[level] / 100
+			ancestor = upline[ancestor]
+		}
+	}
+
+	flush := 0.0
+	for i := range earnings {
+		if commission.MaxVolume > 0 && commissionableByEarner[i] > commission.MaxVolume {
+			scale := commission.MaxVolume / commissionableByEarner[i]
+			flush += commissionableByEarner[i] - commission.MaxVolume
+			earnings[i] *= scale
+			commissionableByEarner[i] = commission.MaxVolume
+		}
+	}
+
+	return earnings, commissionableByEarner, flush
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testMember describes one user of a test genealogy
+type testMember struct {
+	id       string
+	parent   string
+	sponsor  string
+	position string
+	volumes  map[int]float64 // personal volume per simulation cycle
+}
+
+// testUsers builds simulation users with their children from test members, parents first
+func testUsers(members []testMember) []SimulationUser {
+	users := make([]SimulationUser, len(members))
+	index := make(map[string]int, len(members))
+	for i, member := range members {
+		index[member.id] = i
+		users[i] = SimulationUser{
+			ID:                     member.id,
+			Children:               make([]string, 0),
+			GenealogyPosition:      member.position,
+			PersonalVolumePerCycle: member.volumes,
+		}
+		if users[i].PersonalVolumePerCycle == nil {
+			users[i].PersonalVolumePerCycle = make(map[int]float64)
+		}
+		if member.parent != "" {
+			parent := member.parent
+			users[i].ParentID = &parent
+			users[index[parent]].Children = append(users[index[parent]].Children, member.id)
+		}
+		if member.sponsor != "" {
+			sponsor := member.sponsor
+			users[i].SponsorID = &sponsor
+		}
+	}
+	return users
+}
+
+// testBinaryTree is a root with two legs, the left one with two members of its own. The left
+// leg's children were enrolled by the root.
+var testBinaryTree = []testMember{
+	{id: "root", position: "root"},
+	{id: "a", parent: "root", position: "left"},
+	{id: "b", parent: "root", position: "right"},
+	{id: "c", parent: "a", sponsor: "root", position: "left"},
+	{id: "d", parent: "a", sponsor: "root", position: "right"},
+}
+
+// assertAmounts compares per-user amounts, allowing for floating point rounding
+func assertAmounts(t *testing.T, name string, got, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d amounts, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestBinaryEarnings(t *testing.T) {
+	tests := []struct {
+		name                  string
+		volumes               []float64
+		carryLeft, carryRight []float64
+		capVolume             float64
+		wantEarnings          []float64
+		wantCommissionable    []float64
+		wantFlush             float64
+		wantLeft, wantRight   []float64
+	}{
+		{
+			name:               "matches the weaker leg and carries the rest",
+			volumes:            []float64{0, 100, 60, 0, 0},
+			wantEarnings:       []float64{6, 0, 0, 0, 0},
+			wantCommissionable: []float64{60, 0, 0, 0, 0},
+			wantLeft:           []float64{40, 0, 0, 0, 0},
+			wantRight:          []float64{0, 0, 0, 0, 0},
+		},
+		{
+			name:               "leg volume includes the whole subtree",
+			volumes:            []float64{0, 0, 80, 30, 20},
+			wantEarnings:       []float64{5, 2, 0, 0, 0},
+			wantCommissionable: []float64{50, 20, 0, 0, 0},
+			wantLeft:           []float64{0, 10, 0, 0, 0},
+			wantRight:          []float64{30, 0, 0, 0, 0},
+		},
+		{
+			name:               "cap flushes matched volume above it",
+			volumes:            []float64{0, 100, 60, 0, 0},
+			capVolume:          50,
+			wantEarnings:       []float64{5, 0, 0, 0, 0},
+			wantCommissionable: []float64{50, 0, 0, 0, 0},
+			wantFlush:          10,
+			wantLeft:           []float64{40, 0, 0, 0, 0},
+			wantRight:          []float64{0, 0, 0, 0, 0},
+		},
+		{
+			name:               "carried volume is matched in the next period",
+			volumes:            []float64{0, 0, 50, 0, 0},
+			carryLeft:          []float64{40, 0, 0, 0, 0},
+			wantEarnings:       []float64{4, 0, 0, 0, 0},
+			wantCommissionable: []float64{40, 0, 0, 0, 0},
+			wantLeft:           []float64{0, 0, 0, 0, 0},
+			wantRight:          []float64{10, 0, 0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := newCommissionTree(testUsers(testBinaryTree))
+			carryLeft := make([]float64, len(tree.users))
+			carryRight := make([]float64, len(tree.users))
+			copy(carryLeft, test.carryLeft)
+			copy(carryRight, test.carryRight)
+
+			earnings, commissionable, flush := tree.binaryEarnings(CommissionDefinition{Type: "binary", Percentage: 10},
+				test.volumes, carryLeft, carryRight, test.capVolume)
+			assertAmounts(t, "earnings", earnings, test.wantEarnings)
+			assertAmounts(t, "commissionable", commissionable, test.wantCommissionable)
+			assertAmounts(t, "carry left", carryLeft, test.wantLeft)
+			assertAmounts(t, "carry right", carryRight, test.wantRight)
+			if math.Abs(flush-test.wantFlush) > 1e-9 {
+				t.Errorf("flush: got %v, want %v", flush, test.wantFlush)
+			}
+		})
+	}
+}
+
+func TestUnilevelEarnings(t *testing.T) {
+	volumes := []float64{0, 0, 0, 100, 0}
+	tests := []struct {
+		name               string
+		commission         CommissionDefinition
+		sponsor            bool
+		wantEarnings       []float64
+		wantCommissionable []float64
+		wantFlush          float64
+	}{
+		{
+			name:               "pays each level of the placement upline",
+			commission:         CommissionDefinition{LevelPercentages: []float64{10, 5}},
+			wantEarnings:       []float64{5, 10, 0, 0, 0},
+			wantCommissionable: []float64{100, 100, 0, 0, 0},
+		},
+		{
+			name:               "max level repeats the percentage",
+			commission:         CommissionDefinition{Percentage: 4, MaxLevel: 2},
+			wantEarnings:       []float64{4, 4, 0, 0, 0},
+			wantCommissionable: []float64{100, 100, 0, 0, 0},
+		},
+		{
+			name:               "stops at the root",
+			commission:         CommissionDefinition{LevelPercentages: []float64{10, 5, 3}},
+			wantEarnings:       []float64{5, 10, 0, 0, 0},
+			wantCommissionable: []float64{100, 100, 0, 0, 0},
+		},
+		{
+			name:               "caps the commissionable volume per earner",
+			commission:         CommissionDefinition{LevelPercentages: []float64{10}, MaxVolume: 40},
+			wantEarnings:       []float64{0, 4, 0, 0, 0},
+			wantCommissionable: []float64{0, 40, 0, 0, 0},
+			wantFlush:          60,
+		},
+		{
+			name:               "sponsor upline pays the enroller instead of the placement parent",
+			commission:         CommissionDefinition{LevelPercentages: []float64{10}},
+			sponsor:            true,
+			wantEarnings:       []float64{10, 0, 0, 0, 0},
+			wantCommissionable: []float64{100, 0, 0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree := newCommissionTree(testUsers(testBinaryTree))
+			upline := tree.parent
+			if test.sponsor {
+				upline = tree.sponsor
+			}
+
+			earnings, commissionable, flush := tree.unilevelEarnings(test.commission, volumes, upline)
+			assertAmounts(t, "earnings", earnings, test.wantEarnings)
+			assertAmounts(t, "commissionable", commissionable, test.wantCommissionable)
+			if math.Abs(flush-test.wantFlush) > 1e-9 {
+				t.Errorf("flush: got %v, want %v", flush, test.wantFlush)
+			}
+		})
+	}
+}
+
+func TestCommissionTreeSponsorDefaultsToParent(t *testing.T) {
+	tree := newCommissionTree(testUsers(testBinaryTree))
+	if want := []int{-1, 0, 0, 0, 0}; !reflect.DeepEqual(tree.sponsor, want) {
+		t.Errorf("sponsors: got %v, want %v", tree.sponsor, want)
+	}
+	if want := []int{-1, 0, 0, 1, 1}; !reflect.DeepEqual(tree.parent, want) {
+		t.Errorf("parents: got %v, want %v", tree.parent, want)
+	}
+}
+
+func TestResolveSimulationCycles(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        BusinessSimulationRequest
+		wantType   string
+		wantCycles int
+		wantErr    bool
+	}{
+		{
+			name:       "commissions on the payout cycle keep it",
+			req:        BusinessSimulationRequest{PayoutCycle: "monthly", NumberOfPayoutCycles: 3, Commissions: []CommissionDefinition{{PayoutCycle: "monthly"}}},
+			wantType:   "monthly",
+			wantCycles: 3,
+		},
+		{
+			name:       "coarser commissions keep the payout cycle",
+			req:        BusinessSimulationRequest{PayoutCycle: "weekly", NumberOfPayoutCycles: 8, StartDate: "2024-01-01", Commissions: []CommissionDefinition{{PayoutCycle: "monthly"}}},
+			wantType:   "weekly",
+			wantCycles: 8,
+		},
+		{
+			name:       "finer commissions cover the same calendar span",
+			req:        BusinessSimulationRequest{PayoutCycle: "monthly", NumberOfPayoutCycles: 3, StartDate: "2024-01-01", Commissions: []CommissionDefinition{{PayoutCycle: "weekly"}}},
+			wantType:   "weekly",
+			wantCycles: 13,
+		},
+		{
+			name:    "finer commissions need a start date",
+			req:     BusinessSimulationRequest{PayoutCycle: "monthly", NumberOfPayoutCycles: 3, Commissions: []CommissionDefinition{{PayoutCycle: "weekly"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cycleType, cycles, err := resolveSimulationCycles(test.req)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %s x %d, want an error", cycleType, cycles)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cycleType != test.wantType || cycles != test.wantCycles {
+				t.Errorf("got %s x %d, want %s x %d", cycleType, cycles, test.wantType, test.wantCycles)
+			}
+		})
+	}
+}
+
+func TestScheduledPayoutPeriods(t *testing.T) {
+	calendar, err := NewPayoutCalendar("weekly", "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		payoutCycle string
+		calendar    *PayoutCalendar
+		want        [][]int
+		wantErr     bool
+	}{
+		{name: "simulation cycle pays every cycle", payoutCycle: "", calendar: calendar, want: [][]int{{1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}}},
+		{name: "undated simulation cycle pays every cycle", payoutCycle: "weekly", want: [][]int{{1}, {2}, {3}, {4}, {5}, {6}, {7}, {8}, {9}}},
+		{name: "monthly rolls weeks into the month they end in", payoutCycle: "monthly", calendar: calendar, want: [][]int{{1, 2, 3, 4}, {5, 6, 7, 8}, {9}}},
+		{name: "coarser cycle needs a calendar", payoutCycle: "monthly", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			periods, err := scheduledPayoutPeriods("test", test.payoutCycle, test.calendar, "weekly", 9)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([][]int, len(periods))
+			for i, period := range periods {
+				got[i] = period.BaseCycles
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got base cycles %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCalculateCommissionsPaysAtPeriodClose(t *testing.T) {
+	members := []testMember{
+		{id: "root", position: "root"},
+		{id: "a", parent: "root", position: "left", volumes: map[int]float64{1: 100, 5: 50}},
+		{id: "b", parent: "a", sponsor: "root", position: "left", volumes: map[int]float64{2: 200}},
+	}
+	calendar, err := NewPayoutCalendar("weekly", "2024-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		commission CommissionDefinition
+		want       map[string]map[int]float64 // earnings per user per simulation cycle
+	}{
+		{
+			name:       "monthly unilevel pays the month's volume in its last week",
+			commission: CommissionDefinition{Name: "unilevel", Type: "unilevel", PayoutCycle: "monthly", LevelPercentages: []float64{10, 5}},
+			want: map[string]map[int]float64{
+				"root": {4: 20, 8: 5},
+				"a":    {4: 20},
+				"b":    {},
+			},
+		},
+		{
+			name:       "weekly referral pays the sponsor every week",
+			commission: CommissionDefinition{Name: "referral", Type: "referral", PayoutCycle: "weekly", Percentage: 10},
+			want: map[string]map[int]float64{
+				"root": {1: 10, 2: 20, 5: 5},
+				"a":    {},
+				"b":    {},
+			},
+		},
+		{
+			name:       "earners below the minimum volume forfeit their commission",
+			commission: CommissionDefinition{Name: "unilevel", Type: "unilevel", PayoutCycle: "monthly", Percentage: 10, MinVolume: 1},
+			want: map[string]map[int]float64{
+				"root": {},
+				"a":    {4: 20},
+				"b":    {},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users := testUsers(members)
+			req := BusinessSimulationRequest{PayoutCycle: "weekly", StartDate: "2024-01-01", Commissions: []CommissionDefinition{test.commission}}
+			summary, err := calculateCommissions(users, req, calendar, "weekly", 9)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			total := 0.0
+			for _, user := range users {
+				want := test.want[user.ID]
+				for cycle, amount := range user.EarningsPerCycle {
+					if amount == 0 {
+						continue
+					}
+					if math.Abs(amount-want[cycle]) > 1e-9 {
+						t.Errorf("%s cycle %d: got %v, want %v", user.ID, cycle, amount, want[cycle])
+					}
+				}
+				for cycle, amount := range want {
+					if user.EarningsPerCycle[cycle] == 0 {
+						t.Errorf("%s cycle %d: got nothing, want %v", user.ID, cycle, amount)
+					}
+				}
+				total += user.TotalEarnings
+			}
+			if math.Abs(summary.TotalPayout-total) > 1e-9 {
+				t.Errorf("total payout %v does not match the users' earnings %v", summary.TotalPayout, total)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -37,6 +39,13 @@ type GenealogyNodeWithChildren struct {
 	Children []GenealogyNodeWithChildren `json:"children"`
 }
 
+// GenealogyChildNode is a direct child of a node, with what a client needs to expand it lazily
+type GenealogyChildNode struct {
+	GenealogyNodeWithUser
+	ChildCount  int  `json:"child_count"`
+	HasChildren bool `json:"has_children"`
+}
+
 // GenerateUsersRequest represents a request to generate users
 type GenerateUsersRequest struct {
 	Count            int    `json:"count"`
@@ -94,7 +103,7 @@ func handleGenerateUsers(w http.ResponseWriter, r *http.Request) {
 			req.Position, req.SimulationID, req.PayoutCycle, i)
 		if err != nil {
 			log.Printf("Error adding user to genealogy: %v", err)
-			http.Error(w, fmt.Sprintf("Error adding user to genealogy: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error adding user to genealogy: %v", err), placementErrorStatus(err))
 			return
 		}
 		log.Printf("Successfully added user %d to genealogy with node ID: %d", user.ID, node.ID)
@@ -113,7 +122,9 @@ func handleGenerateUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleGetDownlineUsers gets all downline users for a given parent
+// handleGetDownlineUsers gets the downline users of a given parent, ordered by left bound.
+// Supports max_depth (levels below the parent), payout_cycle and simulation_id filters and
+// cursor pagination with limit and cursor.
 func handleGetDownlineUsers(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	parentID, err := strconv.Atoi(vars["parent_id"])
@@ -133,58 +144,37 @@ func handleGetDownlineUsers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
 		return
 	}
+	filter, err := parseGenealogyNodeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkGenealogyCursor(w, filter, gTypeID) {
+		return
+	}
 
 	// Get downline users using nested set model
-	query := `
-		SELECT gn.*, u.id as user_id, u.email, u.name, u.role, u.whatsapp_number, 
-		       u.organization_name, u.country, u.created_at, u.updated_at
-		FROM genealogy_nodes gn
-		JOIN users u ON gn.user_id = u.id
-		WHERE gn.genealogy_type_id = $1 
-		AND gn.left_bound > (SELECT left_bound FROM genealogy_nodes WHERE id = $2 AND genealogy_type_id = $1)
-		AND gn.right_bound < (SELECT right_bound FROM genealogy_nodes WHERE id = $2 AND genealogy_type_id = $1)
-		ORDER BY gn.left_bound
-	`
-
-	rows, err := db.Query(query, gTypeID, parentID)
+	var query genealogyQuery
+	query.where("gn.genealogy_type_id = ?", gTypeID)
+	query.where("p.id = ?", parentID)
+	query.where("gn.left_bound > p.left_bound")
+	query.where("gn.right_bound < p.right_bound")
+	query.applyFilter(filter, "p.depth")
+	joins := `
+		JOIN genealogy_nodes p ON p.genealogy_type_id = gn.genealogy_type_id`
+
+	downlineUsers, nextCursor, err := queryGenealogyNodes(query.sql("", joins, filter), query.args, filter)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error querying downline: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var downlineUsers []GenealogyNodeWithUser
-	for rows.Next() {
-		var genealogyNode GenealogyNode
-		var user User
-		err := rows.Scan(
-			&genealogyNode.ID, &genealogyNode.UserID, &genealogyNode.GenealogyTypeID, &genealogyNode.ParentID,
-			&genealogyNode.LeftBound, &genealogyNode.RightBound, &genealogyNode.Depth, &genealogyNode.Position,
-			&genealogyNode.SimulationID, &genealogyNode.PayoutCycle, &genealogyNode.CyclePosition,
-			&genealogyNode.CreatedAt, &genealogyNode.UpdatedAt,
-			&user.ID, &user.Email, &user.Name, &user.Role, &user.WhatsappNumber,
-			&user.OrganizationName, &user.Country, &user.CreatedAt, &user.UpdatedAt,
-		)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error scanning downline: %v", err), http.StatusInternalServerError)
-			return
-		}
-		nodeWithUser := GenealogyNodeWithUser{
-			GenealogyNode: genealogyNode,
-			User:          &user,
-		}
-		downlineUsers = append(downlineUsers, nodeWithUser)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"data":    downlineUsers,
-		"count":   len(downlineUsers),
-	})
+	json.NewEncoder(w).Encode(genealogyPage(downlineUsers, len(downlineUsers), nextCursor))
 }
 
-// handleGetUplineUsers gets all upline users for a given node
+// handleGetUplineUsers gets all upline users for a given node, nearest the root first.
+// max_depth limits the upline to that many levels above the node.
 func handleGetUplineUsers(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	nodeID, err := strconv.Atoi(vars["node_id"])
@@ -204,48 +194,34 @@ func handleGetUplineUsers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
 		return
 	}
+	var maxDepth *int
+	if raw := r.URL.Query().Get("max_depth"); raw != "" {
+		levels, err := strconv.Atoi(raw)
+		if err != nil || levels < 0 {
+			http.Error(w, "Invalid max_depth", http.StatusBadRequest)
+			return
+		}
+		maxDepth = &levels
+	}
 
 	// Get upline users using nested set model
-	query := `
-		SELECT gn.*, u.id as user_id, u.email, u.name, u.role, u.whatsapp_number, 
-		       u.organization_name, u.country, u.created_at, u.updated_at
-		FROM genealogy_nodes gn
-		JOIN users u ON gn.user_id = u.id
-		WHERE gn.genealogy_type_id = $1 
-		AND gn.left_bound < (SELECT left_bound FROM genealogy_nodes WHERE id = $2)
-		AND gn.right_bound > (SELECT right_bound FROM genealogy_nodes WHERE id = $2)
-		ORDER BY gn.depth ASC
-	`
+	var query genealogyQuery
+	query.where("gn.genealogy_type_id = ?", gTypeID)
+	query.where("n.id = ?", nodeID)
+	query.where("gn.left_bound < n.left_bound")
+	query.where("gn.right_bound > n.right_bound")
+	if maxDepth != nil {
+		query.where("gn.depth >= n.depth - ?", *maxDepth)
+	}
+	joins := `
+		JOIN genealogy_nodes n ON n.genealogy_type_id = gn.genealogy_type_id`
 
-	rows, err := db.Query(query, gTypeID, nodeID)
+	// Ancestors are nested, so left bound order is root first
+	uplineUsers, _, err := queryGenealogyNodes(query.sql("", joins, genealogyNodeFilter{}), query.args, genealogyNodeFilter{})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error querying upline: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var uplineUsers []GenealogyNodeWithUser
-	for rows.Next() {
-		var genealogyNode GenealogyNode
-		var user User
-		err := rows.Scan(
-			&genealogyNode.ID, &genealogyNode.UserID, &genealogyNode.GenealogyTypeID, &genealogyNode.ParentID,
-			&genealogyNode.LeftBound, &genealogyNode.RightBound, &genealogyNode.Depth, &genealogyNode.Position,
-			&genealogyNode.SimulationID, &genealogyNode.PayoutCycle, &genealogyNode.CyclePosition,
-			&genealogyNode.CreatedAt, &genealogyNode.UpdatedAt,
-			&user.ID, &user.Email, &user.Name, &user.Role, &user.WhatsappNumber,
-			&user.OrganizationName, &user.Country, &user.CreatedAt, &user.UpdatedAt,
-		)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error scanning upline: %v", err), http.StatusInternalServerError)
-			return
-		}
-		nodeWithUser := GenealogyNodeWithUser{
-			GenealogyNode: genealogyNode,
-			User:          &user,
-		}
-		uplineUsers = append(uplineUsers, nodeWithUser)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -255,53 +231,109 @@ func handleGetUplineUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleGetGenealogyStructure gets the complete genealogy structure for a type
-func handleGetGenealogyStructure(w http.ResponseWriter, r *http.Request) {
+// handleGetGenealogyChildren gets the direct children of a node with their own child counts,
+// so clients can load a large tree one level at a time. Supports limit and cursor pagination;
+// a node that does not exist is reported as not found.
+func handleGetGenealogyChildren(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	genealogyTypeID, err := strconv.Atoi(vars["genealogy_type_id"])
+	nodeID, err := strconv.Atoi(vars["node_id"])
 	if err != nil {
-		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		http.Error(w, "Invalid node ID", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseGenealogyNodeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Get all nodes for this genealogy type
-	query := `
-		SELECT gn.*, u.id as user_id, u.email, u.name, u.role, u.whatsapp_number, 
-		       u.organization_name, u.country, u.created_at, u.updated_at
-		FROM genealogy_nodes gn
-		JOIN users u ON gn.user_id = u.id
-		WHERE gn.genealogy_type_id = $1
-		ORDER BY gn.left_bound
-	`
+	var genealogyTypeID int
+	err = db.QueryRow("SELECT genealogy_type_id FROM genealogy_nodes WHERE id = $1", nodeID).Scan(&genealogyTypeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying node: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !checkGenealogyCursor(w, filter, genealogyTypeID) {
+		return
+	}
 
-	rows, err := db.Query(query, genealogyTypeID)
+	// Children are one level down, so max_depth does not apply
+	filter.maxDepth = nil
+	var query genealogyQuery
+	query.where("gn.parent_id = ?", nodeID)
+	query.applyFilter(filter, "")
+	extraColumns := `,
+		(SELECT COUNT(*) FROM genealogy_nodes c WHERE c.parent_id = gn.id) AS child_count`
+
+	rows, err := db.Query(query.sql(extraColumns, "", filter), query.args...)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error querying genealogy structure: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error querying children: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	var nodes []GenealogyNodeWithUser
+	children := make([]GenealogyChildNode, 0)
 	for rows.Next() {
-		var genealogyNode GenealogyNode
-		var user User
-		err := rows.Scan(
-			&genealogyNode.ID, &genealogyNode.UserID, &genealogyNode.GenealogyTypeID, &genealogyNode.ParentID,
-			&genealogyNode.LeftBound, &genealogyNode.RightBound, &genealogyNode.Depth, &genealogyNode.Position,
-			&genealogyNode.SimulationID, &genealogyNode.PayoutCycle, &genealogyNode.CyclePosition,
-			&genealogyNode.CreatedAt, &genealogyNode.UpdatedAt,
-			&user.ID, &user.Email, &user.Name, &user.Role, &user.WhatsappNumber,
-			&user.OrganizationName, &user.Country, &user.CreatedAt, &user.UpdatedAt,
-		)
+		var childCount int
+		node, err := scanGenealogyNodeWithUser(rows, &childCount)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error scanning genealogy structure: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error scanning children: %v", err), http.StatusInternalServerError)
 			return
 		}
-		nodeWithUser := GenealogyNodeWithUser{
-			GenealogyNode: genealogyNode,
-			User:          &user,
-		}
-		nodes = append(nodes, nodeWithUser)
+		children = append(children, GenealogyChildNode{
+			GenealogyNodeWithUser: node,
+			ChildCount:            childCount,
+			HasChildren:           childCount > 0,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Error scanning children: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor *int
+	if filter.limit > 0 && len(children) > filter.limit {
+		children = children[:filter.limit]
+		cursor := children[len(children)-1].ID
+		nextCursor = &cursor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(genealogyPage(children, len(children), nextCursor))
+}
+
+// handleGetGenealogyStructure gets the genealogy structure for a type. Supports max_depth (levels
+// below the root), payout_cycle and simulation_id filters and cursor pagination with limit and cursor;
+// the tree structure is built from the nodes returned.
+func handleGetGenealogyStructure(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	genealogyTypeID, err := strconv.Atoi(vars["genealogy_type_id"])
+	if err != nil {
+		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseGenealogyNodeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkGenealogyCursor(w, filter, genealogyTypeID) {
+		return
+	}
+
+	// Get the nodes for this genealogy type
+	var query genealogyQuery
+	query.where("gn.genealogy_type_id = ?", genealogyTypeID)
+	query.applyFilter(filter, "0")
+
+	nodes, nextCursor, err := queryGenealogyNodes(query.sql("", "", filter), query.args, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying genealogy structure: %v", err), http.StatusInternalServerError)
+		return
 	}
 
 	// Build tree structure
@@ -315,6 +347,8 @@ func handleGetGenealogyStructure(w http.ResponseWriter, r *http.Request) {
 			"tree_structure": treeStructure,
 			"total_nodes":    len(nodes),
 		},
+		"has_more":    nextCursor != nil,
+		"next_cursor": nextCursor,
 	})
 }
 
@@ -329,7 +363,7 @@ func handleAddUserToGenealogy(w http.ResponseWriter, r *http.Request) {
 	node, err := addUserToGenealogy(req.UserID, req.GenealogyTypeID, req.ParentID,
 		req.Position, req.SimulationID, req.PayoutCycle, req.CyclePosition)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error adding user to genealogy: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error adding user to genealogy: %v", err), placementErrorStatus(err))
 		return
 	}
 
@@ -395,7 +429,9 @@ func getUserByID(id int) (*User, error) {
 	return &user, nil
 }
 
-// addUserToGenealogy adds a user to the genealogy structure
+// addUserToGenealogy adds a user to the genealogy structure. Inserts into one genealogy type are
+// serialised by an advisory lock, and every read that decides the placement happens in the same
+// transaction as the bounds shift, so concurrent adds always produce a consistent tree.
 func addUserToGenealogy(userID, genealogyTypeID int, parentID *int, position, simulationID string, payoutCycle, cyclePosition int) (*GenealogyNode, error) {
 	// Get genealogy type to determine max children
 	genealogyType, err := getGenealogyTypeByID(genealogyTypeID)
@@ -403,22 +439,36 @@ func addUserToGenealogy(userID, genealogyTypeID int, parentID *int, position, si
 		return nil, err
 	}
 
-	// Determine position and parent if not provided
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockGenealogyType(tx, genealogyTypeID); err != nil {
+		return nil, err
+	}
+
+	rules := placementRulesFor(genealogyType)
+
+	// Without a parent, place under the first node with room, filling the tree level by level
+	// and left to right; a requested position must be free there
 	if parentID == nil {
-		// Find the first available parent
+		requestedSlot := ""
+		if len(rules.positions) > 0 {
+			requestedSlot = strings.ToLower(position)
+		}
 		parentQuery := `
-			SELECT id FROM genealogy_nodes 
-			WHERE genealogy_type_id = $1 
-			AND (
-				SELECT COUNT(*) FROM genealogy_nodes 
-				WHERE parent_id = genealogy_nodes.id AND genealogy_type_id = $1
-			) < $2
-			ORDER BY left_bound
+			SELECT gn.id FROM genealogy_nodes gn
+			WHERE gn.genealogy_type_id = $1
+			AND ($2 = 0 OR (SELECT COUNT(*) FROM genealogy_nodes c WHERE c.parent_id = gn.id) < $2)
+			AND ($3 = '' OR NOT EXISTS (SELECT 1 FROM genealogy_nodes c WHERE c.parent_id = gn.id AND c.position = $3))
+			ORDER BY gn.depth, gn.left_bound
 			LIMIT 1
 		`
 		var foundParentID int
-		err := db.QueryRow(parentQuery, genealogyTypeID, genealogyType.MaxChildrenPerNode).Scan(&foundParentID)
-		if err != nil && err.Error() != "sql: no rows in result set" {
+		err := tx.QueryRow(parentQuery, genealogyTypeID, rules.maxChildren, requestedSlot).Scan(&foundParentID)
+		if err != nil && err != sql.ErrNoRows {
 			return nil, err
 		}
 		if err == nil {
@@ -429,161 +479,111 @@ func addUserToGenealogy(userID, genealogyTypeID int, parentID *int, position, si
 	// Calculate bounds and depth
 	var leftBound, rightBound, depth int
 	if parentID == nil {
-		// Root node
-		leftBound = 1
-		rightBound = 2
-		depth = 0
-		position = "root"
-
-		// Insert the root node
-		insertQuery := `
-			INSERT INTO genealogy_nodes (user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
-			RETURNING id, user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, created_at, updated_at
-		`
-
-		var node GenealogyNode
-		var simulationIDPtr *string
-		if simulationID != "" {
-			simulationIDPtr = &simulationID
-		}
-
-		log.Printf("Inserting root node with userID: %d, genealogyTypeID: %d, leftBound: %d, rightBound: %d, depth: %d, position: %s, simulationID: %v, payoutCycle: %d, cyclePosition: %d",
-			userID, genealogyTypeID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition)
-
-		err = db.QueryRow(insertQuery, userID, genealogyTypeID, parentID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition).Scan(
-			&node.ID, &node.UserID, &node.GenealogyTypeID, &node.ParentID,
-			&node.LeftBound, &node.RightBound, &node.Depth, &node.Position,
-			&node.SimulationID, &node.PayoutCycle, &node.CyclePosition,
-			&node.CreatedAt, &node.UpdatedAt,
-		)
+		// Root node, only when the genealogy is empty
+		var nodeCount int
+		err := tx.QueryRow("SELECT COUNT(*) FROM genealogy_nodes WHERE genealogy_type_id = $1", genealogyTypeID).Scan(&nodeCount)
 		if err != nil {
-			log.Printf("Error scanning root node: %v", err)
 			return nil, err
 		}
+		if nodeCount > 0 {
+			return nil, newPlacementError(http.StatusConflict, "genealogy type %d has no open position", genealogyTypeID)
+		}
 
-		log.Printf("Successfully inserted root node with ID: %d", node.ID)
-		return &node, nil
+		leftBound = 1
+		rightBound = 2
+		depth = 0
+		position = "root"
 	} else {
 		// Get parent bounds
 		var parentLeftBound, parentRightBound, parentDepth int
-		err := db.QueryRow(
-			"SELECT left_bound, right_bound, depth FROM genealogy_nodes WHERE id = $1",
-			*parentID,
+		err := tx.QueryRow(
+			"SELECT left_bound, right_bound, depth FROM genealogy_nodes WHERE id = $1 AND genealogy_type_id = $2",
+			*parentID, genealogyTypeID,
 		).Scan(&parentLeftBound, &parentRightBound, &parentDepth)
+		if err == sql.ErrNoRows {
+			return nil, newPlacementError(http.StatusNotFound, "parent %d is not in genealogy type %d", *parentID, genealogyTypeID)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		// Calculate position if not provided
-		if position == "" {
-			childrenCount, err := getChildrenCount(*parentID)
-			if err != nil {
-				return nil, err
-			}
-
-			switch genealogyType.Name {
-			case "Binary Plan":
-				if childrenCount == 0 {
-					position = "left"
-				} else {
-					position = "right"
-				}
-			default:
-				position = "child"
-			}
+		// Validate the position against the parent's children, in left bound order
+		rows, err := tx.Query("SELECT position, left_bound FROM genealogy_nodes WHERE parent_id = $1 ORDER BY left_bound", *parentID)
+		if err != nil {
+			return nil, err
 		}
-
-		// Calculate new bounds
-		if position == "left" || position == "child" {
-			leftBound = parentLeftBound + 1
-		} else {
-			// Find the rightmost child's right bound
-			var maxRightBound int
-			err := db.QueryRow(
-				"SELECT COALESCE(MAX(right_bound), $1) FROM genealogy_nodes WHERE parent_id = $2",
-				parentLeftBound, *parentID,
-			).Scan(&maxRightBound)
-			if err != nil {
+		var taken []string
+		var childLeftBounds []int
+		for rows.Next() {
+			var childPosition string
+			var childLeftBound int
+			if err := rows.Scan(&childPosition, &childLeftBound); err != nil {
+				rows.Close()
 				return nil, err
 			}
-			leftBound = maxRightBound + 1
+			taken = append(taken, childPosition)
+			childLeftBounds = append(childLeftBounds, childLeftBound)
 		}
-
-		rightBound = leftBound + 1
-		depth = parentDepth + 1
-
-		// Start a transaction for proper bounds updates
-		tx, err := db.Begin()
-		if err != nil {
+		rows.Close()
+		if err := rows.Err(); err != nil {
 			return nil, err
 		}
-		defer tx.Rollback()
 
-		// Update bounds of all nodes that come after this insertion point
-		_, err = tx.Exec(
-			"UPDATE genealogy_nodes SET left_bound = left_bound + 2, right_bound = right_bound + 2 WHERE left_bound >= $1 AND genealogy_type_id = $2",
-			leftBound, genealogyTypeID,
-		)
+		position, err = rules.choose(*parentID, taken, position)
 		if err != nil {
 			return nil, err
 		}
 
-		// Update parent's right bound to accommodate the new child
-		_, err = tx.Exec(
-			"UPDATE genealogy_nodes SET right_bound = right_bound + 2 WHERE id = $1",
-			*parentID,
-		)
-		if err != nil {
-			return nil, err
+		// Insert before the first child in a later slot, otherwise after the last child
+		leftBound = parentRightBound
+		for i, childPosition := range taken {
+			if rules.slot(childPosition) > rules.slot(position) {
+				leftBound = childLeftBounds[i]
+				break
+			}
 		}
+		rightBound = leftBound + 1
+		depth = parentDepth + 1
 
-		// Insert the new node
-		insertQuery := `
-			INSERT INTO genealogy_nodes (user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
-			RETURNING id, user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, created_at, updated_at
-		`
-
-		var node GenealogyNode
-		var simulationIDPtr *string
-		if simulationID != "" {
-			simulationIDPtr = &simulationID
+		if err := shiftBoundsForInsert(tx, genealogyTypeID, leftBound); err != nil {
+			return nil, err
 		}
+	}
 
-		log.Printf("Inserting node with userID: %d, genealogyTypeID: %d, parentID: %v, leftBound: %d, rightBound: %d, depth: %d, position: %s, simulationID: %v, payoutCycle: %d, cyclePosition: %d",
-			userID, genealogyTypeID, parentID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition)
+	// Insert the new node
+	insertQuery := `
+		INSERT INTO genealogy_nodes (user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
+		RETURNING id, user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position, simulation_id, payout_cycle, cycle_position, status, created_at, updated_at
+	`
 
-		err = tx.QueryRow(insertQuery, userID, genealogyTypeID, parentID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition).Scan(
-			&node.ID, &node.UserID, &node.GenealogyTypeID, &node.ParentID,
-			&node.LeftBound, &node.RightBound, &node.Depth, &node.Position,
-			&node.SimulationID, &node.PayoutCycle, &node.CyclePosition,
-			&node.CreatedAt, &node.UpdatedAt,
-		)
-		if err != nil {
-			log.Printf("Error scanning node: %v", err)
-			return nil, err
-		}
+	var node GenealogyNode
+	var simulationIDPtr *string
+	if simulationID != "" {
+		simulationIDPtr = &simulationID
+	}
 
-		// Commit the transaction
-		if err = tx.Commit(); err != nil {
-			return nil, err
-		}
+	log.Printf("Inserting node with userID: %d, genealogyTypeID: %d, parentID: %v, leftBound: %d, rightBound: %d, depth: %d, position: %s, simulationID: %v, payoutCycle: %d, cyclePosition: %d",
+		userID, genealogyTypeID, parentID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition)
 
-		log.Printf("Successfully inserted node with ID: %d", node.ID)
-		return &node, nil
+	err = tx.QueryRow(insertQuery, userID, genealogyTypeID, parentID, leftBound, rightBound, depth, position, simulationIDPtr, payoutCycle, cyclePosition).Scan(
+		&node.ID, &node.UserID, &node.GenealogyTypeID, &node.ParentID,
+		&node.LeftBound, &node.RightBound, &node.Depth, &node.Position,
+		&node.SimulationID, &node.PayoutCycle, &node.CyclePosition, &node.Status,
+		&node.CreatedAt, &node.UpdatedAt,
+	)
+	if err != nil {
+		log.Printf("Error scanning node: %v", err)
+		return nil, err
 	}
 
-}
+	// Commit the transaction
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
 
-// getChildrenCount gets the number of children for a node
-func getChildrenCount(nodeID int) (int, error) {
-	var count int
-	err := db.QueryRow(
-		"SELECT COUNT(*) FROM genealogy_nodes WHERE parent_id = $1",
-		nodeID,
-	).Scan(&count)
-	return count, err
+	log.Printf("Successfully inserted node with ID: %d", node.ID)
+	return &node, nil
 }
 
 // buildTreeStructureFromNodes builds a tree structure from nodes with user details
@@ -592,36 +592,42 @@ func buildTreeStructureFromNodes(nodes []GenealogyNodeWithUser) map[string]inter
 		return map[string]interface{}{}
 	}
 
-	// Find root node
-	var rootNode *GenealogyNodeWithUser
-	for i := range nodes {
-		if nodes[i].ParentID == nil {
-			rootNode = &nodes[i]
-			break
+	// Every node whose parent is not among the nodes roots a tree; with a filtered or paginated
+	// listing there may be several, and none of them need be the genealogy root
+	present := make(map[int]bool, len(nodes))
+	childrenOf := make(map[int][]GenealogyNodeWithUser)
+	for _, node := range nodes {
+		present[node.ID] = true
+		if node.ParentID != nil {
+			childrenOf[*node.ParentID] = append(childrenOf[*node.ParentID], node)
+		}
+	}
+	roots := make([]GenealogyNodeWithChildren, 0, 1)
+	for _, node := range nodes {
+		if node.ParentID == nil || !present[*node.ParentID] {
+			roots = append(roots, buildTreeNodeWithUser(node, childrenOf))
 		}
 	}
 
-	if rootNode == nil {
+	if len(roots) == 0 {
 		return map[string]interface{}{}
 	}
 
-	// Build tree recursively
-	tree := buildTreeNodeWithUser(*rootNode, nodes)
+	// root is kept for clients that show a single tree
 	return map[string]interface{}{
-		"root":        tree,
+		"root":        roots[0],
+		"roots":       roots,
 		"total_nodes": len(nodes),
 	}
 }
 
 // buildTreeNodeWithUser recursively builds the tree structure
-func buildTreeNodeWithUser(node GenealogyNodeWithUser, allNodes []GenealogyNodeWithUser) GenealogyNodeWithChildren {
-	children := make([]GenealogyNodeWithChildren, 0)
+func buildTreeNodeWithUser(node GenealogyNodeWithUser, childrenOf map[int][]GenealogyNodeWithUser) GenealogyNodeWithChildren {
+	children := make([]GenealogyNodeWithChildren, 0, len(childrenOf[node.ID]))
 
-	for _, n := range allNodes {
-		if n.ParentID != nil && *n.ParentID == node.ID {
-			child := buildTreeNodeWithUser(n, allNodes)
-			children = append(children, child)
-		}
+	for _, n := range childrenOf[node.ID] {
+		child := buildTreeNodeWithUser(n, childrenOf)
+		children = append(children, child)
 	}
 
 	return GenealogyNodeWithChildren{
@@ -637,6 +643,7 @@ func buildTreeNodeWithUser(node GenealogyNodeWithUser, allNodes []GenealogyNodeW
 			SimulationID:    node.SimulationID,
 			PayoutCycle:     node.PayoutCycle,
 			CyclePosition:   node.CyclePosition,
+			Status:          node.Status,
 			CreatedAt:       node.CreatedAt,
 			UpdatedAt:       node.UpdatedAt,
 		},
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Limits of a genealogy import; the field lengths are those of the users and genealogy_nodes columns
+const (
+	maxImportRows           = 100000
+	maxImportBodyBytes      = 32 << 20
+	maxImportMemberIDLength = 100
+	maxImportNameLength     = 255
+	maxImportEmailLength    = 255
+	maxImportPhoneLength    = 20
+)
+
+// importColumnAliases maps the accepted header names of an import file to its columns
+var importColumnAliases = map[string]string{
+	"member_id":        "member_id",
+	"member":           "member_id",
+	"id":               "member_id",
+	"sponsor_id":       "sponsor_id",
+	"sponsor":          "sponsor_id",
+	"enroller_id":      "sponsor_id",
+	"parent_id":        "parent_id",
+	"placement_parent": "parent_id",
+	"placement_id":     "parent_id",
+	"upline_id":        "parent_id",
+	"parent":           "parent_id",
+	"position":         "position",
+	"leg":              "position",
+	"side":             "position",
+	"join_date":        "join_date",
+	"joined":           "join_date",
+	"joined_at":        "join_date",
+	"enrollment_date":  "join_date",
+	"purchases":        "purchases",
+	"purchase_volume":  "purchases",
+	"pv":               "purchases",
+	"name":             "name",
+	"email":            "email",
+	"phone":            "phone",
+	"whatsapp_number":  "phone",
+}
+
+// importDateLayouts are the accepted join date formats
+var importDateLayouts = []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "01/02/2006", "2006/01/02"}
+
+// importPositionAliases are the short spellings accepted for binary positions
+var importPositionAliases = map[string]string{"l": "left", "r": "right"}
+
+// ImportRowError is a problem with one row of an import file; row 1 is the header
+type ImportRowError struct {
+	Row      int    `json:"row"`
+	MemberID string `json:"member_id,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+}
+
+// GenealogyImportResult reports an import
+type GenealogyImportResult struct {
+	ImportID        string           `json:"import_id"` // stored as the simulation ID of the imported nodes
+	GenealogyTypeID int              `json:"genealogy_type_id"`
+	DryRun          bool             `json:"dry_run"`
+	Members         int              `json:"members"`
+	RootNodeID      int              `json:"root_node_id,omitempty"`
+	MaxDepth        int              `json:"max_depth"`
+	PayoutCycles    int              `json:"payout_cycles"`
+	PayoutCycleType string           `json:"payout_cycle_type"`
+	Errors          []ImportRowError `json:"errors,omitempty"`
+}
+
+// importMember is one validated row of an import file
+type importMember struct {
+	row         int
+	memberID    string
+	sponsorID   string
+	parentID    string
+	position    string
+	joinedAt    *time.Time
+	purchases   float64
+	name        string
+	email       string
+	phone       string
+	payoutCycle int
+
+	node *treeNode
+}
+
+// handleImportGenealogy imports a member tree from a CSV file, sent as the request body or as the
+// "file" field of a multipart form, into an empty genealogy type. Nothing is written if any row is
+// invalid; ?dry_run=true only validates.
+func handleImportGenealogy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	query := r.URL.Query()
+	genealogyTypeID, err := strconv.Atoi(query.Get("genealogy_type_id"))
+	if err != nil {
+		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		return
+	}
+	dryRun := query.Get("dry_run") == "true"
+	cycleType := query.Get("payout_cycle")
+	if cycleType == "" {
+		cycleType = "monthly"
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+	var file io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		upload, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing file field", http.StatusBadRequest)
+			return
+		}
+		defer upload.Close()
+		file = upload
+	}
+
+	result, err := importGenealogy(genealogyTypeID, file, cycleType, dryRun)
+	if err != nil {
+		log.Printf("Genealogy import error: %v", err)
+		http.Error(w, fmt.Sprintf("Error importing genealogy: %v", err), placementErrorStatus(err))
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Errors) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": len(result.Errors) == 0,
+		"data":    result,
+	})
+}
+
+// importGenealogy validates an import file and, unless it has errors or this is a dry run, creates
+// its users and nodes in one transaction. Bounds are computed in memory in one pass.
+func importGenealogy(genealogyTypeID int, file io.Reader, cycleType string, dryRun bool) (*GenealogyImportResult, error) {
+	genealogyType, err := getGenealogyTypeByID(genealogyTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := cycleTypeNominalDays[normalizeCycleType(cycleType)]; !exists {
+		return nil, newPlacementError(http.StatusBadRequest, "payout_cycle must be weekly, biweekly, monthly or quarterly")
+	}
+
+	result := &GenealogyImportResult{
+		ImportID:        "import-" + uuid.New().String(),
+		GenealogyTypeID: genealogyTypeID,
+		DryRun:          dryRun,
+		PayoutCycleType: normalizeCycleType(cycleType),
+	}
+
+	members, rowErrors, err := parseImportFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(rowErrors) == 0 {
+		rowErrors = buildImportTree(members, placementRulesFor(genealogyType), result)
+	}
+	if len(rowErrors) == 0 {
+		rowErrors, err = checkImportConflicts(members)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rowErrors) > 0 {
+		sort.SliceStable(rowErrors, func(i, j int) bool { return rowErrors[i].Row < rowErrors[j].Row })
+		result.Errors = rowErrors
+		return result, nil
+	}
+
+	result.Members = len(members)
+	if dryRun {
+		return result, nil
+	}
+
+	if err := writeImport(genealogyTypeID, members, result); err != nil {
+		return nil, err
+	}
+	log.Printf("Imported %d members into genealogy type %d (%s)", len(members), genealogyTypeID, result.ImportID)
+	return result, nil
+}
+
+// parseImportFile reads the rows of an import file, checking each row on its own
+func parseImportFile(file io.Reader) ([]*importMember, []ImportRowError, error) {
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, newPlacementError(http.StatusBadRequest, "the file is empty")
+	}
+	if err != nil {
+		return nil, nil, newPlacementError(http.StatusBadRequest, "invalid CSV: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		name = strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+		if column, exists := importColumnAliases[name]; exists {
+			columns[column] = i
+		}
+	}
+	if _, exists := columns["member_id"]; !exists {
+		return nil, nil, newPlacementError(http.StatusBadRequest, "the header must include a member_id column")
+	}
+	if _, exists := columns["parent_id"]; !exists {
+		return nil, nil, newPlacementError(http.StatusBadRequest, "the header must include a parent_id (placement parent) column")
+	}
+
+	var members []*importMember
+	var rowErrors []ImportRowError
+	seen := make(map[string]int)
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, newPlacementError(http.StatusBadRequest, "invalid CSV at row %d: %v", row, err)
+		}
+		if len(members) >= maxImportRows {
+			return nil, nil, newPlacementError(http.StatusRequestEntityTooLarge, "the file has more than %d members", maxImportRows)
+		}
+
+		field := func(column string) string {
+			if i, exists := columns[column]; exists && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		member := &importMember{
+			row:       row,
+			memberID:  field("member_id"),
+			sponsorID: field("sponsor_id"),
+			parentID:  field("parent_id"),
+			position:  strings.ToLower(field("position")),
+			name:      field("name"),
+			email:     field("email"),
+			phone:     field("phone"),
+		}
+		rowError := func(column, format string, args ...interface{}) {
+			rowErrors = append(rowErrors, ImportRowError{Row: row, MemberID: member.memberID, Field: column, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if member.memberID == "" {
+			rowError("member_id", "member ID is required")
+			continue
+		}
+		if first, exists := seen[member.memberID]; exists {
+			rowError("member_id", "member ID is already used on row %d", first)
+			continue
+		}
+		seen[member.memberID] = row
+		for _, limit := range []struct {
+			column, value string
+			length        int
+		}{
+			{"member_id", member.memberID, maxImportMemberIDLength},
+			{"name", member.name, maxImportNameLength},
+			{"email", member.email, maxImportEmailLength},
+			{"phone", member.phone, maxImportPhoneLength},
+		} {
+			if len([]rune(limit.value)) > limit.length {
+				rowError(limit.column, "%s is longer than %d characters", limit.column, limit.length)
+			}
+		}
+		if alias, exists := importPositionAliases[member.position]; exists {
+			member.position = alias
+		}
+
+		if raw := field("join_date"); raw != "" {
+			for _, layout := range importDateLayouts {
+				if joined, err := time.Parse(layout, raw); err == nil {
+					member.joinedAt = &joined
+					break
+				}
+			}
+			if member.joinedAt == nil {
+				rowError("join_date", "join date %q is not a date such as 2024-01-31", raw)
+			}
+		}
+		if raw := field("purchases"); raw != "" {
+			purchases, err := strconv.ParseFloat(strings.ReplaceAll(raw, ",", ""), 64)
+			if err != nil || purchases < 0 {
+				rowError("purchases", "purchases %q is not a non-negative number", raw)
+			}
+			member.purchases = purchases
+		}
+
+		members = append(members, member)
+	}
+	if len(members) == 0 && len(rowErrors) == 0 {
+		return nil, nil, newPlacementError(http.StatusBadRequest, "the file has no members")
+	}
+	return members, rowErrors, nil
+}
+
+// buildImportTree links the members by placement parent, checks the placement rules and computes
+// each node's bounds, depth and payout cycle
+func buildImportTree(members []*importMember, rules placementRules, result *GenealogyImportResult) []ImportRowError {
+	var rowErrors []ImportRowError
+	rowError := func(member *importMember, column, format string, args ...interface{}) {
+		rowErrors = append(rowErrors, ImportRowError{Row: member.row, MemberID: member.memberID, Field: column, Message: fmt.Sprintf(format, args...)})
+	}
+
+	byID := make(map[string]*importMember, len(members))
+	tree := &genealogyTree{nodes: make(map[int]*treeNode, len(members))}
+	for i, member := range members {
+		byID[member.memberID] = member
+		member.node = &treeNode{id: i + 1, position: member.position}
+		tree.nodes[member.node.id] = member.node
+	}
+
+	var roots, placed []*importMember
+	for _, member := range members {
+		if member.sponsorID != "" && byID[member.sponsorID] == nil {
+			rowError(member, "sponsor_id", "sponsor %q is not in the file", member.sponsorID)
+		}
+		if member.parentID == "" {
+			roots = append(roots, member)
+			continue
+		}
+		parent := byID[member.parentID]
+		switch {
+		case parent == nil:
+			rowError(member, "parent_id", "placement parent %q is not in the file", member.parentID)
+		case parent == member:
+			rowError(member, "parent_id", "member is its own placement parent")
+		default:
+			placed = append(placed, member)
+		}
+	}
+
+	// Members asking for a position are placed first, so a member without one placed earlier in
+	// the file cannot take the slot a later member asks for
+	for _, explicit := range []bool{true, false} {
+		for _, member := range placed {
+			if (member.position != "" && len(rules.positions) > 0) != explicit {
+				continue
+			}
+			parent := byID[member.parentID]
+			var taken []string
+			for _, child := range parent.node.children {
+				taken = append(taken, child.position)
+			}
+			position, err := rules.choose(strconv.Quote(parent.memberID), taken, member.position)
+			if err != nil {
+				rowError(member, "position", "%v", err)
+				continue
+			}
+			tree.attach(member.node, parent.node, position, rules)
+		}
+	}
+
+	switch {
+	case len(roots) == 0:
+		rowErrors = append(rowErrors, ImportRowError{Row: 1, Field: "parent_id", Message: "no member without a placement parent: the tree needs one root"})
+	case len(roots) > 1:
+		for _, root := range roots[1:] {
+			rowError(root, "parent_id", "member has no placement parent, but %q on row %d is already the root", roots[0].memberID, roots[0].row)
+		}
+	}
+	if len(rowErrors) > 0 {
+		return rowErrors
+	}
+
+	roots[0].node.position = "root"
+	tree.roots = []*treeNode{roots[0].node}
+	tree.renumber()
+
+	// Members never reached from the root have placement parents that loop
+	for _, member := range members {
+		if member.node.right == 0 {
+			rowError(member, "parent_id", "placement parents loop back to this member and never reach the root")
+		}
+	}
+	if len(rowErrors) > 0 {
+		return rowErrors
+	}
+
+	// Payout cycles follow the join dates, counted from the earliest one
+	var earliest *time.Time
+	for _, member := range members {
+		if member.joinedAt != nil && (earliest == nil || member.joinedAt.Before(*earliest)) {
+			earliest = member.joinedAt
+		}
+	}
+	var calendar *PayoutCalendar
+	if earliest != nil {
+		calendar, _ = NewPayoutCalendar(result.PayoutCycleType, earliest.Format(calendarDateLayout))
+	}
+	result.PayoutCycles = 1
+	for _, member := range members {
+		member.payoutCycle = 1
+		if calendar != nil && member.joinedAt != nil {
+			member.payoutCycle = calendar.CycleOf(*member.joinedAt)
+		}
+		if member.payoutCycle > result.PayoutCycles {
+			result.PayoutCycles = member.payoutCycle
+		}
+		if member.node.depth > result.MaxDepth {
+			result.MaxDepth = member.node.depth
+		}
+	}
+	return nil
+}
+
+// checkImportConflicts finds emails and phone numbers of the file that already belong to users
+func checkImportConflicts(members []*importMember) ([]ImportRowError, error) {
+	var rowErrors []ImportRowError
+	for _, column := range []string{"email", "whatsapp_number"} {
+		values := make(map[string]*importMember)
+		var list []string
+		for _, member := range members {
+			value := member.email
+			if column == "whatsapp_number" {
+				value = member.phone
+			}
+			if value == "" {
+				continue
+			}
+			if other, exists := values[value]; exists {
+				rowErrors = append(rowErrors, ImportRowError{Row: member.row, MemberID: member.memberID, Field: column,
+					Message: fmt.Sprintf("%s %q is also used on row %d", column, value, other.row)})
+				continue
+			}
+			values[value] = member
+			list = append(list, value)
+		}
+		if len(list) == 0 {
+			continue
+		}
+
+		rows, err := db.Query("SELECT "+column+" FROM users WHERE "+column+" = ANY($1)", pq.Array(list))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			member := values[value]
+			rowErrors = append(rowErrors, ImportRowError{Row: member.row, MemberID: member.memberID, Field: column,
+				Message: fmt.Sprintf("%s %q already belongs to a user", column, value)})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return rowErrors, nil
+}
+
+// writeImport creates the users and nodes of a validated import in one transaction
+func writeImport(genealogyTypeID int, members []*importMember, result *GenealogyImportResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockGenealogyType(tx, genealogyTypeID); err != nil {
+		return err
+	}
+	var nodeCount int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM genealogy_nodes WHERE genealogy_type_id = $1", genealogyTypeID).Scan(&nodeCount); err != nil {
+		return err
+	}
+	if nodeCount > 0 {
+		return newPlacementError(http.StatusConflict, "genealogy type %d already has %d nodes; import into an empty genealogy type", genealogyTypeID, nodeCount)
+	}
+
+	// Users, matched back to members by email. Members without an email or phone get placeholders
+	// unique to the import: emails by file row, and WhatsApp numbers of 16 digits, longer than any
+	// real number, as the stress-insert command uses
+	importStamp := time.Now().UnixNano() % 100000000
+	emails := make([]string, len(members))
+	names := make([]string, len(members))
+	phones := make([]string, len(members))
+	for i, member := range members {
+		emails[i] = member.email
+		if emails[i] == "" {
+			emails[i] = fmt.Sprintf("%s-row-%d@import.example.com", result.ImportID, member.row)
+		}
+		names[i] = member.name
+		if names[i] == "" {
+			names[i] = "Member " + member.memberID
+		}
+		phones[i] = member.phone
+		if phones[i] == "" {
+			phones[i] = fmt.Sprintf("+8%08d%07d", importStamp, i+1)
+		}
+	}
+	rows, err := tx.Query(`
+		INSERT INTO users (email, name, password_hash, role, whatsapp_number, created_at, updated_at)
+		SELECT email, name, 'hashed_password', 'user', phone, NOW(), NOW()
+		FROM unnest($1::text[], $2::text[], $3::text[]) AS m(email, name, phone)
+		RETURNING id, email
+	`, pq.Array(emails), pq.Array(names), pq.Array(phones))
+	if err != nil {
+		return err
+	}
+	userIDs := make(map[string]int64, len(members))
+	for rows.Next() {
+		var id int64
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs[email] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Node IDs are reserved first so parents and sponsors can be referenced in a single insert
+	rows, err = tx.Query("SELECT nextval(pg_get_serial_sequence('genealogy_nodes', 'id')) FROM generate_series(1, $1)", len(members))
+	if err != nil {
+		return err
+	}
+	var nodeIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		nodeIDs = append(nodeIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	nodeIDOf := make(map[string]int64, len(members))
+	for i, member := range members {
+		nodeIDOf[member.memberID] = nodeIDs[i]
+	}
+	nullableNode := func(memberID string) sql.NullInt64 {
+		if memberID == "" {
+			return sql.NullInt64{}
+		}
+		return sql.NullInt64{Int64: nodeIDOf[memberID], Valid: true}
+	}
+
+	count := len(members)
+	users := make([]int64, count)
+	parents := make([]sql.NullInt64, count)
+	sponsors := make([]sql.NullInt64, count)
+	lefts := make([]int64, count)
+	rights := make([]int64, count)
+	depths := make([]int64, count)
+	positions := make([]string, count)
+	cycles := make([]int64, count)
+	cyclePositions := make([]int64, count)
+	memberIDs := make([]string, count)
+	joined := make([]sql.NullString, count)
+	purchases := make([]float64, count)
+	for i, member := range members {
+		users[i] = userIDs[emails[i]]
+		parents[i] = nullableNode(member.parentID)
+		sponsors[i] = nullableNode(member.sponsorID)
+		lefts[i] = int64(member.node.left)
+		rights[i] = int64(member.node.right)
+		depths[i] = int64(member.node.depth)
+		positions[i] = member.node.position
+		cycles[i] = int64(member.payoutCycle)
+		cyclePositions[i] = int64(i + 1)
+		memberIDs[i] = member.memberID
+		if member.joinedAt != nil {
+			joined[i] = sql.NullString{String: member.joinedAt.Format(time.RFC3339), Valid: true}
+		}
+		purchases[i] = member.purchases
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO genealogy_nodes (id, user_id, genealogy_type_id, parent_id, sponsor_node_id, left_bound, right_bound, depth,
+			position, simulation_id, payout_cycle, cycle_position, member_id, joined_at, purchase_volume, created_at, updated_at)
+		SELECT id, user_id, $1, parent_id, sponsor_node_id, left_bound, right_bound, depth,
+			position, $2, payout_cycle, cycle_position, member_id, joined_at, purchase_volume, NOW(), NOW()
+		FROM unnest($3::int[], $4::int[], $5::int[], $6::int[], $7::int[], $8::int[], $9::int[],
+			$10::text[], $11::int[], $12::int[], $13::text[], $14::timestamptz[], $15::numeric[])
+			AS m(id, user_id, parent_id, sponsor_node_id, left_bound, right_bound, depth,
+			position, payout_cycle, cycle_position, member_id, joined_at, purchase_volume)
+	`, genealogyTypeID, result.ImportID, pq.Array(nodeIDs), pq.Array(users), pq.Array(parents), pq.Array(sponsors),
+		pq.Array(lefts), pq.Array(rights), pq.Array(depths), pq.Array(positions), pq.Array(cycles),
+		pq.Array(cyclePositions), pq.Array(memberIDs), pq.Array(joined), pq.Array(purchases))
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i, member := range members {
+		if member.node.parentID == nil {
+			result.RootNodeID = int(nodeIDs[i])
+		}
+	}
+	return nil
+}
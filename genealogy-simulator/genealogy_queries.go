@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxGenealogyPageSize limits the nodes returned by one page of a genealogy listing
+const maxGenealogyPageSize = 1000
+
+// genealogyNodeWithUserColumns selects a genealogy node and its user in the order scanGenealogyNodeWithUser reads them
+const genealogyNodeWithUserColumns = `
+	gn.id, gn.user_id, gn.genealogy_type_id, gn.parent_id, gn.left_bound, gn.right_bound, gn.depth,
+	gn.position, gn.simulation_id, gn.payout_cycle, gn.cycle_position, gn.status, gn.created_at, gn.updated_at,
+	u.id, u.email, u.name, u.role, u.whatsapp_number, u.organization_name, u.country, u.created_at, u.updated_at`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanGenealogyNodeWithUser scans the genealogyNodeWithUserColumns, followed by any extra columns
+func scanGenealogyNodeWithUser(row rowScanner, extra ...interface{}) (GenealogyNodeWithUser, error) {
+	var node GenealogyNode
+	var user User
+	dest := []interface{}{
+		&node.ID, &node.UserID, &node.GenealogyTypeID, &node.ParentID,
+		&node.LeftBound, &node.RightBound, &node.Depth, &node.Position,
+		&node.SimulationID, &node.PayoutCycle, &node.CyclePosition, &node.Status,
+		&node.CreatedAt, &node.UpdatedAt,
+		&user.ID, &user.Email, &user.Name, &user.Role, &user.WhatsappNumber,
+		&user.OrganizationName, &user.Country, &user.CreatedAt, &user.UpdatedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return GenealogyNodeWithUser{}, err
+	}
+	return GenealogyNodeWithUser{GenealogyNode: node, User: &user}, nil
+}
+
+// genealogyNodeFilter holds the optional filters and cursor pagination of a genealogy listing.
+// Pages are ordered by left bound; the cursor is the ID of the last node of the previous page, and
+// the next page starts after that node's current left bound. Inserts and removals elsewhere in the
+// tree shift the bounds of the cursor node along with the rest, so they neither skip nor repeat
+// nodes; a node moved across the cursor node by a restructure may be.
+type genealogyNodeFilter struct {
+	maxDepth     *int
+	payoutCycle  *int
+	simulationID string
+	limit        int // 0 returns every matching node
+	cursor       *int
+}
+
+// parseGenealogyNodeFilter reads the max_depth, payout_cycle, simulation_id, limit and cursor query parameters
+func parseGenealogyNodeFilter(r *http.Request) (genealogyNodeFilter, error) {
+	query := r.URL.Query()
+	var filter genealogyNodeFilter
+
+	optionalInt := func(name string, min int) (*int, error) {
+		raw := query.Get(name)
+		if raw == "" {
+			return nil, nil
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < min {
+			return nil, fmt.Errorf("Invalid %s", name)
+		}
+		return &value, nil
+	}
+
+	var err error
+	if filter.maxDepth, err = optionalInt("max_depth", 0); err != nil {
+		return filter, err
+	}
+	if filter.payoutCycle, err = optionalInt("payout_cycle", 0); err != nil {
+		return filter, err
+	}
+	if filter.cursor, err = optionalInt("cursor", 1); err != nil {
+		return filter, err
+	}
+	limit, err := optionalInt("limit", 1)
+	if err != nil {
+		return filter, err
+	}
+	if limit != nil {
+		filter.limit = *limit
+		if filter.limit > maxGenealogyPageSize {
+			filter.limit = maxGenealogyPageSize
+		}
+	}
+	filter.simulationID = query.Get("simulation_id")
+
+	return filter, nil
+}
+
+// checkGenealogyCursor checks that the filter's cursor, if any, is a node of the given genealogy
+// type, or writes why it is not
+func checkGenealogyCursor(w http.ResponseWriter, filter genealogyNodeFilter, genealogyTypeID int) bool {
+	if filter.cursor == nil {
+		return true
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM genealogy_nodes WHERE id = $1 AND genealogy_type_id = $2)",
+		*filter.cursor, genealogyTypeID).Scan(&exists)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking cursor: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("cursor node %d is not in this genealogy; start again from the first page", *filter.cursor), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// genealogyQuery builds a genealogy node query from conditions and their positional arguments
+type genealogyQuery struct {
+	conditions []string
+	args       []interface{}
+}
+
+// where adds a condition; each ? in it is replaced by the placeholder of the next argument
+func (q *genealogyQuery) where(condition string, args ...interface{}) {
+	for _, arg := range args {
+		q.args = append(q.args, arg)
+		condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(q.args)), 1)
+	}
+	q.conditions = append(q.conditions, condition)
+}
+
+// applyFilter adds the filter's conditions. depthBase is the SQL expression max_depth counts levels from.
+func (q *genealogyQuery) applyFilter(filter genealogyNodeFilter, depthBase string) {
+	if filter.maxDepth != nil {
+		q.where("gn.depth <= "+depthBase+" + ?", *filter.maxDepth)
+	}
+	if filter.payoutCycle != nil {
+		q.where("gn.payout_cycle = ?", *filter.payoutCycle)
+	}
+	if filter.simulationID != "" {
+		q.where("gn.simulation_id = ?", filter.simulationID)
+	}
+	if filter.cursor != nil {
+		q.where("gn.left_bound > (SELECT c.left_bound FROM genealogy_nodes c WHERE c.id = ?)", *filter.cursor)
+	}
+}
+
+// sql returns the query selecting the node columns (plus extra columns) from the given joins, paged by the filter.
+// One row more than the page size is fetched to tell whether another page follows.
+func (q *genealogyQuery) sql(extraColumns, joins string, filter genealogyNodeFilter) string {
+	query := "SELECT " + genealogyNodeWithUserColumns + extraColumns + `
+		FROM genealogy_nodes gn
+		JOIN users u ON gn.user_id = u.id` + joins
+	if len(q.conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(q.conditions, "\n\t\tAND ")
+	}
+	query += "\n\t\tORDER BY gn.left_bound"
+	if filter.limit > 0 {
+		query += fmt.Sprintf("\n\t\tLIMIT %d", filter.limit+1)
+	}
+	return query
+}
+
+// queryGenealogyNodes runs a genealogy listing and returns its page of nodes and the cursor of the
+// next page, if there is one
+func queryGenealogyNodes(query string, args []interface{}, filter genealogyNodeFilter) ([]GenealogyNodeWithUser, *int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]GenealogyNodeWithUser, 0)
+	for rows.Next() {
+		node, err := scanGenealogyNodeWithUser(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return pageGenealogyNodes(nodes, filter)
+}
+
+// pageGenealogyNodes trims the extra row fetched past the page and returns the next cursor
+func pageGenealogyNodes(nodes []GenealogyNodeWithUser, filter genealogyNodeFilter) ([]GenealogyNodeWithUser, *int, error) {
+	if filter.limit == 0 || len(nodes) <= filter.limit {
+		return nodes, nil, nil
+	}
+	nodes = nodes[:filter.limit]
+	nextCursor := nodes[len(nodes)-1].ID
+	return nodes, &nextCursor, nil
+}
+
+// genealogyPage is the response data of a paginated genealogy listing
+func genealogyPage(nodes interface{}, count int, nextCursor *int) map[string]interface{} {
+	return map[string]interface{}{
+		"success":     true,
+		"data":        nodes,
+		"count":       count,
+		"has_more":    nextCursor != nil,
+		"next_cursor": nextCursor,
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// MoveGenealogyNodeRequest moves a node, with its whole downline, under another parent
+type MoveGenealogyNodeRequest struct {
+	NodeID      int    `json:"node_id"`
+	NewParentID int    `json:"new_parent_id"`
+	Position    string `json:"position,omitempty"` // left or right for binary genealogies; chosen when empty
+}
+
+// Removal policies
+const (
+	removeCompress    = "compress"    // the children roll up to the removed member's parent
+	removePromote     = "promote"     // one child takes the vacated position and the other children are placed under it
+	removePlaceholder = "placeholder" // the node stays as a placeholder holding its position and downline
+)
+
+// RemoveGenealogyNodeRequest removes a member from a genealogy
+type RemoveGenealogyNodeRequest struct {
+	NodeID        int    `json:"node_id"`
+	Policy        string `json:"policy"`                    // compress (default), promote or placeholder
+	PromoteNodeID *int   `json:"promote_node_id,omitempty"` // child promoted by the promote policy, defaults to the first child
+}
+
+// AffectedNode is the new placement of a node changed by a structural change
+type AffectedNode struct {
+	ID         int    `json:"id"`
+	ParentID   *int   `json:"parent_id"`
+	Position   string `json:"position"`
+	LeftBound  int    `json:"left_bound"`
+	RightBound int    `json:"right_bound"`
+	Depth      int    `json:"depth"`
+}
+
+// GenealogyChangeResult reports a structural change and every node whose placement it changed
+type GenealogyChangeResult struct {
+	NodeID         int            `json:"node_id"`
+	SubtreeSize    int            `json:"subtree_size"`
+	Policy         string         `json:"policy,omitempty"`
+	PromotedNodeID *int           `json:"promoted_node_id,omitempty"`
+	AffectedNodes  []AffectedNode `json:"affected_nodes"`
+}
+
+// handleMoveGenealogyNode moves a node and its downline to a new parent
+func handleMoveGenealogyNode(w http.ResponseWriter, r *http.Request) {
+	var req MoveGenealogyNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := moveGenealogyNode(req.NodeID, req.NewParentID, req.Position)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error moving node: %v", err), placementErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Moved node %d and %d downline members", req.NodeID, result.SubtreeSize-1),
+		"data":    result,
+	})
+}
+
+// moveGenealogyNode re-parents a node in one transaction, recomputing the bounds and depths of the
+// whole genealogy type
+func moveGenealogyNode(nodeID, newParentID int, position string) (*GenealogyChangeResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tree, genealogyType, err := loadGenealogyTreeForNode(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	node := tree.nodes[nodeID]
+	parent, exists := tree.nodes[newParentID]
+	if !exists {
+		return nil, newPlacementError(http.StatusNotFound, "parent %d is not in this genealogy", newParentID)
+	}
+	if tree.isDescendant(parent, node) {
+		return nil, newPlacementError(http.StatusBadRequest, "node %d cannot be moved under itself or its own downline", nodeID)
+	}
+
+	position, err = resolveChildPosition(genealogyType, parent, node, position)
+	if err != nil {
+		return nil, err
+	}
+
+	tree.detach(node)
+	tree.attach(node, parent, position, placementRulesFor(genealogyType))
+	tree.renumber()
+
+	changed, err := tree.save(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Moved node %d under parent %d (%s), %d nodes affected", nodeID, newParentID, position, len(changed))
+	return &GenealogyChangeResult{
+		NodeID:        nodeID,
+		SubtreeSize:   subtreeSize(node),
+		AffectedNodes: affectedNodes(changed),
+	}, nil
+}
+
+// handleRemoveGenealogyNode removes a member using the requested policy
+func handleRemoveGenealogyNode(w http.ResponseWriter, r *http.Request) {
+	var req RemoveGenealogyNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Policy == "" {
+		req.Policy = removeCompress
+	}
+	if req.Policy != removeCompress && req.Policy != removePromote && req.Policy != removePlaceholder {
+		http.Error(w, "Policy must be compress, promote or placeholder", http.StatusBadRequest)
+		return
+	}
+
+	result, err := removeGenealogyNode(req.NodeID, req.Policy, req.PromoteNodeID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error removing node: %v", err), placementErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Removed node %d (%s), %d nodes affected", req.NodeID, req.Policy, len(result.AffectedNodes)),
+		"data":    result,
+	})
+}
+
+// removeGenealogyNode removes a node in one transaction, re-placing its children according to the
+// policy and recomputing the bounds and depths of the whole genealogy type
+func removeGenealogyNode(nodeID int, policy string, promoteNodeID *int) (*GenealogyChangeResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tree, genealogyType, err := loadGenealogyTreeForNode(tx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	node := tree.nodes[nodeID]
+	result := &GenealogyChangeResult{NodeID: nodeID, SubtreeSize: subtreeSize(node), Policy: policy}
+
+	switch policy {
+	case removePlaceholder:
+		res, err := tx.Exec(
+			"UPDATE genealogy_nodes SET status = 'placeholder', updated_at = NOW() WHERE id = $1 AND status <> 'placeholder'",
+			nodeID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if updated, _ := res.RowsAffected(); updated == 0 {
+			return nil, newPlacementError(http.StatusConflict, "node %d is already a placeholder", nodeID)
+		}
+		result.AffectedNodes = affectedNodes([]*treeNode{node})
+
+	case removeCompress:
+		if err := compressNode(tree, genealogyType, node); err != nil {
+			return nil, err
+		}
+
+	case removePromote:
+		promoted, err := promoteChild(tree, genealogyType, node, promoteNodeID)
+		if err != nil {
+			return nil, err
+		}
+		if promoted != nil {
+			result.PromotedNodeID = &promoted.id
+		}
+	}
+
+	if policy != removePlaceholder {
+		tree.remove(node)
+		tree.renumber()
+		changed, err := tree.save(tx)
+		if err != nil {
+			return nil, err
+		}
+		result.AffectedNodes = affectedNodes(changed)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Removed node %d with the %s policy, %d nodes affected", nodeID, policy, len(result.AffectedNodes))
+	return result, nil
+}
+
+// compressNode detaches a node and rolls its children up to its parent, the first child taking
+// the vacated position. A root can only be compressed into a single child, which becomes the root.
+func compressNode(tree *genealogyTree, genealogyType *GenealogyType, node *treeNode) error {
+	children := append([]*treeNode(nil), node.children...)
+	parent := tree.parent(node)
+
+	if parent == nil {
+		if len(children) > 1 {
+			return newPlacementError(http.StatusConflict, "root node %d has %d children and can only be compressed with one; use promote", node.id, len(children))
+		}
+		index := rootIndex(tree, node)
+		tree.detach(node)
+		if len(children) == 1 {
+			child := children[0]
+			child.parentID = nil
+			child.position = "root"
+			tree.roots = append(tree.roots[:index], append([]*treeNode{child}, tree.roots[index:]...)...)
+		}
+		return nil
+	}
+
+	maxChildren := placementRulesFor(genealogyType).maxChildren
+	if total := len(parent.children) - 1 + len(children); maxChildren > 0 && total > maxChildren {
+		return newPlacementError(http.StatusConflict, "compressing node %d would give parent %d %d children, more than the maximum of %d; use promote or placeholder",
+			node.id, parent.id, total, maxChildren)
+	}
+
+	vacated := node.position
+	tree.detach(node)
+	for i, child := range children {
+		position := vacated
+		if i > 0 {
+			var err error
+			if position, err = resolveChildPosition(genealogyType, parent, child, ""); err != nil {
+				return err
+			}
+		}
+		tree.attach(child, parent, position, placementRulesFor(genealogyType))
+	}
+	return nil
+}
+
+// promoteChild detaches a node and moves one of its children into the vacated position. The
+// other children keep their downlines and are placed in the first open slot of the promoted
+// child's downline, breadth first. Returns nil when the node has no children.
+func promoteChild(tree *genealogyTree, genealogyType *GenealogyType, node *treeNode, promoteNodeID *int) (*treeNode, error) {
+	if len(node.children) == 0 {
+		if promoteNodeID != nil {
+			return nil, newPlacementError(http.StatusBadRequest, "node %d has no children to promote", node.id)
+		}
+		tree.detach(node)
+		return nil, nil
+	}
+
+	promoted := node.children[0]
+	if promoteNodeID != nil {
+		promoted = nil
+		for _, child := range node.children {
+			if child.id == *promoteNodeID {
+				promoted = child
+			}
+		}
+		if promoted == nil {
+			return nil, newPlacementError(http.StatusBadRequest, "node %d is not a child of node %d", *promoteNodeID, node.id)
+		}
+	}
+
+	var siblings []*treeNode
+	for _, child := range node.children {
+		if child != promoted {
+			siblings = append(siblings, child)
+		}
+	}
+
+	// The promoted child takes the node's place among its siblings
+	promoted.parentID = node.parentID
+	promoted.position = node.position
+	if parent := tree.parent(node); parent != nil {
+		for i, sibling := range parent.children {
+			if sibling == node {
+				parent.children[i] = promoted
+			}
+		}
+	} else {
+		tree.roots[rootIndex(tree, node)] = promoted
+	}
+	node.children = nil
+
+	for _, sibling := range siblings {
+		target, position, err := firstOpenSlot(genealogyType, promoted, sibling)
+		if err != nil {
+			return nil, err
+		}
+		tree.attach(sibling, target, position, placementRulesFor(genealogyType))
+	}
+	return promoted, nil
+}
+
+// firstOpenSlot returns the first node of a subtree, breadth first, that can take another child
+func firstOpenSlot(genealogyType *GenealogyType, subtree, child *treeNode) (*treeNode, string, error) {
+	queue := []*treeNode{subtree}
+	for len(queue) > 0 {
+		candidate := queue[0]
+		queue = queue[1:]
+		if position, err := resolveChildPosition(genealogyType, candidate, child, ""); err == nil {
+			return candidate, position, nil
+		}
+		queue = append(queue, candidate.children...)
+	}
+	return nil, "", newPlacementError(http.StatusConflict, "no open position under node %d", subtree.id)
+}
+
+// rootIndex returns the index of a root node among the roots
+func rootIndex(tree *genealogyTree, node *treeNode) int {
+	for i, root := range tree.roots {
+		if root == node {
+			return i
+		}
+	}
+	return len(tree.roots)
+}
+
+// loadGenealogyTreeForNode locks the genealogy type of a node and loads its tree and type
+func loadGenealogyTreeForNode(tx *sql.Tx, nodeID int) (*genealogyTree, *GenealogyType, error) {
+	var genealogyTypeID int
+	err := tx.QueryRow("SELECT genealogy_type_id FROM genealogy_nodes WHERE id = $1", nodeID).Scan(&genealogyTypeID)
+	if err == sql.ErrNoRows {
+		return nil, nil, newPlacementError(http.StatusNotFound, "node %d not found", nodeID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := lockGenealogyType(tx, genealogyTypeID); err != nil {
+		return nil, nil, err
+	}
+	genealogyType, err := getGenealogyTypeByID(genealogyTypeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := loadGenealogyTree(tx, genealogyTypeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, exists := tree.nodes[nodeID]; !exists {
+		// The node was removed before the lock was taken
+		return nil, nil, newPlacementError(http.StatusNotFound, "node %d not found", nodeID)
+	}
+	return tree, genealogyType, nil
+}
+
+// resolveChildPosition checks that parent can take node as a child in the requested position under
+// the genealogy type's placement rules and returns the position to use
+func resolveChildPosition(genealogyType *GenealogyType, parent, node *treeNode, position string) (string, error) {
+	var taken []string
+	for _, child := range parent.children {
+		if child != node {
+			taken = append(taken, child.position)
+		}
+	}
+	return placementRulesFor(genealogyType).choose(parent.id, taken, position)
+}
+
+// affectedNodes lists the new placement of changed nodes
+func affectedNodes(changed []*treeNode) []AffectedNode {
+	affected := make([]AffectedNode, len(changed))
+	for i, node := range changed {
+		affected[i] = AffectedNode{
+			ID:         node.id,
+			ParentID:   node.parentID,
+			Position:   node.position,
+			LeftBound:  node.left,
+			RightBound: node.right,
+			Depth:      node.depth,
+		}
+	}
+	return affected
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Defaults of the goal-seek solver
+const (
+	defaultGoalSeekTolerance  = 0.1
+	defaultGoalSeekIterations = 25
+	maxGoalSeekIterations     = 60
+)
+
+// goalSeekMetrics are the outcomes a goal seek can target
+var goalSeekMetrics = map[string]func(SweepPoint) float64{
+	"payout_ratio":   func(point SweepPoint) float64 { return point.PayoutRatio },
+	"company_margin": func(point SweepPoint) float64 { return point.companyMargin() },
+	"total_payout":   func(point SweepPoint) float64 { return point.TotalPayout },
+	"total_volume":   func(point SweepPoint) float64 { return point.TotalVolume },
+	"revenue":        func(point SweepPoint) float64 { return point.Revenue },
+}
+
+// GoalSeekRequest searches a request field for the value at which a metric reaches its target,
+// e.g. the "commissions.0.percentage" that keeps the payout ratio at 45% through cycle 12
+type GoalSeekRequest struct {
+	Base          BusinessSimulationRequest `json:"base"`
+	Parameter     string                    `json:"parameter"` // JSON path of the field searched
+	Min           float64                   `json:"min"`
+	Max           float64                   `json:"max"`
+	Metric        string                    `json:"metric"` // payout_ratio, company_margin, total_payout, total_volume or revenue
+	Target        float64                   `json:"target"`
+	Tolerance     float64                   `json:"tolerance,omitempty"`     // accepted distance from the target, defaults to 0.1
+	ThroughCycle  int                       `json:"through_cycle,omitempty"` // simulation cycle the metric is measured to, defaults to the last
+	MaxIterations int                       `json:"max_iterations,omitempty"`
+}
+
+// GoalSeekIteration records one evaluation of the search
+type GoalSeekIteration struct {
+	Value  float64 `json:"value"`
+	Metric float64 `json:"metric"`
+}
+
+// GoalSeekResponse is the parameter value found and the simulation at that value
+type GoalSeekResponse struct {
+	Parameter  string                     `json:"parameter"`
+	Metric     string                     `json:"metric"`
+	Target     float64                    `json:"target"`
+	Value      float64                    `json:"value"`
+	Achieved   float64                    `json:"achieved"`
+	Converged  bool                       `json:"converged"` // false when the closest value found is outside the tolerance
+	Seed       int64                      `json:"seed"`
+	Iterations []GoalSeekIteration        `json:"iterations"`
+	Outcome    SweepPoint                 `json:"outcome"`
+	Simulation BusinessSimulationResponse `json:"simulation"`
+	CreatedAt  time.Time                  `json:"created_at"`
+}
+
+// handleGoalSeek searches a plan parameter for the value that reaches a target metric
+func handleGoalSeek(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	log.Println("Received goal seek request")
+
+	var req GoalSeekRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := runGoalSeek(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Goal seek cancelled: %v", err)
+			return
+		}
+		log.Printf("Goal seek error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Goal seek completed after %d evaluations: %s = %.4f", len(response.Iterations), req.Parameter, response.Value)
+}
+
+// runGoalSeek bisects the parameter range for the target. Every evaluation uses the same seed so
+// the metric only changes with the parameter; the metric must cross the target within the range.
+func runGoalSeek(ctx context.Context, req GoalSeekRequest) (*GoalSeekResponse, error) {
+	metricOf, exists := goalSeekMetrics[req.Metric]
+	if !exists {
+		return nil, fmt.Errorf("metric must be one of payout_ratio, company_margin, total_payout, total_volume or revenue")
+	}
+	if req.Metric == "company_margin" && len(req.Base.Commissions) == 0 && len(req.Base.BonusPools) == 0 && len(req.Base.Ranks) == 0 {
+		return nil, fmt.Errorf("metric company_margin requires commissions, bonus_pools or ranks in the base request")
+	}
+	if req.Parameter == "" {
+		return nil, fmt.Errorf("parameter is required")
+	}
+	if req.Min >= req.Max {
+		return nil, fmt.Errorf("min must be less than max")
+	}
+	if req.ThroughCycle < 0 {
+		return nil, fmt.Errorf("through_cycle must not be negative")
+	}
+	if req.Tolerance < 0 {
+		return nil, fmt.Errorf("tolerance must not be negative")
+	}
+	tolerance := req.Tolerance
+	if tolerance == 0 {
+		tolerance = defaultGoalSeekTolerance
+	}
+	maxIterations := req.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = defaultGoalSeekIterations
+	}
+	if maxIterations > maxGoalSeekIterations {
+		maxIterations = maxGoalSeekIterations
+	}
+
+	base := req.Base
+	if base.Seed == 0 {
+		base.Seed = time.Now().UnixNano()
+	}
+
+	response := &GoalSeekResponse{
+		Parameter:  req.Parameter,
+		Metric:     req.Metric,
+		Target:     req.Target,
+		Seed:       base.Seed,
+		Iterations: make([]GoalSeekIteration, 0, maxIterations+2),
+	}
+
+	// Track the evaluation closest to the target
+	var best *BusinessSimulationResponse
+	bestDistance := math.Inf(1)
+	evaluate := func(value float64) (float64, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		simReq, err := applyParameterValues(base, []string{req.Parameter}, []float64{value})
+		if err != nil {
+			return 0, err
+		}
+		simulation, err := runBusinessSimulation(ctx, simReq)
+		if err != nil {
+			return 0, fmt.Errorf("%s = %g: %v", req.Parameter, value, err)
+		}
+		simulatedCycles := simulation.NumberOfPayoutCycles
+		if simulation.SimulationCycles > 0 {
+			simulatedCycles = simulation.SimulationCycles
+		}
+		if req.ThroughCycle > simulatedCycles {
+			return 0, fmt.Errorf("through_cycle %d is beyond the simulated cycles", req.ThroughCycle)
+		}
+
+		outcome := simulationOutcome(simulation, req.ThroughCycle)
+		metric := metricOf(outcome)
+		response.Iterations = append(response.Iterations, GoalSeekIteration{Value: value, Metric: metric})
+
+		if distance := math.Abs(metric - req.Target); distance < bestDistance {
+			bestDistance = distance
+			best = &simulation
+			response.Value = value
+			response.Achieved = metric
+			response.Outcome = outcome
+		}
+		return metric, nil
+	}
+
+	low, high := req.Min, req.Max
+	lowMetric, err := evaluate(low)
+	if err != nil {
+		return nil, err
+	}
+	highMetric, err := evaluate(high)
+	if err != nil {
+		return nil, err
+	}
+	if bestDistance > tolerance && (lowMetric-req.Target)*(highMetric-req.Target) > 0 {
+		return nil, fmt.Errorf("target %g is not reached between %g (%s %.4f) and %g (%s %.4f)",
+			req.Target, low, req.Metric, lowMetric, high, req.Metric, highMetric)
+	}
+
+	for i := 0; i < maxIterations && bestDistance > tolerance; i++ {
+		middle := (low + high) / 2
+		middleMetric, err := evaluate(middle)
+		if err != nil {
+			return nil, err
+		}
+		// Keep the half whose ends still lie on opposite sides of the target
+		if (lowMetric-req.Target)*(middleMetric-req.Target) <= 0 {
+			high = middle
+		} else {
+			low, lowMetric = middle, middleMetric
+		}
+	}
+
+	response.Converged = bestDistance <= tolerance
+	response.Simulation = *best
+	response.CreatedAt = time.Now()
+	return response, nil
+}
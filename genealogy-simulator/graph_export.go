@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// graphFormats maps each graph export format to its content type and file extension
+var graphFormats = map[string][2]string{
+	"graphml": {"application/graphml+xml", "graphml"},
+	"dot":     {"text/vnd.graphviz", "dot"},
+	"json":    {"application/json", "json"}, // JSON Graph Format
+}
+
+// graphAttribute is a node attribute of an exported genealogy graph
+type graphAttribute struct {
+	name string
+	kind string // int, double or string, as GraphML names them
+}
+
+// genealogyGraph is a genealogy laid out as nodes and parent to child edges for export
+type genealogyGraph struct {
+	id         string
+	attributes []graphAttribute
+	nodes      []graphNode
+	edges      []graphEdge
+}
+
+// graphNode is a node of an exported genealogy graph; attributes without a value are left out
+type graphNode struct {
+	id     string
+	label  string
+	values map[string]interface{}
+}
+
+// graphEdge links a parent to a child in the given position
+type graphEdge struct {
+	source   string
+	target   string
+	position string
+}
+
+// Node attributes of business simulation users and of genealogy nodes, stored or simulated
+var (
+	simulatedGraphAttributes = []graphAttribute{
+		{"payout_cycle", "int"}, {"depth", "int"}, {"position", "string"}, {"product", "string"},
+		{"personal_volume", "double"}, {"team_volume", "double"}, {"rank", "string"}, {"total_earnings", "double"},
+	}
+	nodeGraphAttributes = []graphAttribute{
+		{"user_id", "int"}, {"payout_cycle", "int"}, {"depth", "int"}, {"position", "string"},
+		{"status", "string"}, {"simulation_id", "string"}, {"member_id", "string"}, {"purchase_volume", "double"},
+	}
+)
+
+// handleBusinessSimulationGraph runs a business simulation and returns its genealogy as a graph,
+// in the format given by ?format=graphml (default), dot or json
+func handleBusinessSimulationGraph(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	format, err := parseGraphFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.SkipVolumeBreakdowns = true
+
+	businessResponse, err := runBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Business simulation graph export cancelled: %v", err)
+			return
+		}
+		log.Printf("Business simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeGenealogyGraph(w, simulatedGenealogyGraph(businessResponse), format)
+}
+
+// handleSimulationJobGraph returns the genealogy of a completed simulation job as a graph
+func handleSimulationJobGraph(w http.ResponseWriter, r *http.Request) {
+	format, err := parseGraphFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, ok := completedJobResult(w, r)
+	if !ok {
+		return
+	}
+
+	writeGenealogyGraph(w, jobGenealogyGraph(result), format)
+}
+
+// jobGenealogyGraph lays out the genealogy of a simulation or business simulation job result
+func jobGenealogyGraph(result interface{}) *genealogyGraph {
+	if businessResponse, ok := result.(BusinessSimulationResponse); ok {
+		return simulatedGenealogyGraph(businessResponse)
+	}
+	simResponse := result.(SimulationResponse)
+	return nodesGenealogyGraph(simResponse.SimulationID, simResponse.Nodes)
+}
+
+// handleStoredGenealogyGraph returns a stored genealogy as a graph, optionally only the nodes saved
+// or imported under ?simulation_id=
+func handleStoredGenealogyGraph(w http.ResponseWriter, r *http.Request) {
+	genealogyTypeID, err := strconv.Atoi(mux.Vars(r)["genealogy_type_id"])
+	if err != nil {
+		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		return
+	}
+	format, err := parseGraphFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stored, err := loadStoredGenealogy(genealogyTypeID, r.URL.Query().Get("simulation_id"))
+	if err != nil {
+		log.Printf("Error loading genealogy type %d: %v", genealogyTypeID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(stored.nodes) == 0 {
+		http.Error(w, "Genealogy has no nodes", http.StatusNotFound)
+		return
+	}
+
+	writeGenealogyGraph(w, nodesGenealogyGraph(fmt.Sprintf("genealogy_%d", genealogyTypeID), stored.nodes), format)
+}
+
+// parseGraphFormat reads the format query parameter
+func parseGraphFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		return "graphml", nil
+	}
+	if _, exists := graphFormats[format]; !exists {
+		return "", fmt.Errorf("format must be graphml, dot or json")
+	}
+	return format, nil
+}
+
+// simulatedGenealogyGraph lays out the users of a business simulation as a graph
+func simulatedGenealogyGraph(response BusinessSimulationResponse) *genealogyGraph {
+	graph := &genealogyGraph{id: response.ID, attributes: simulatedGraphAttributes}
+	for _, user := range response.Users {
+		values := map[string]interface{}{
+			"payout_cycle":    user.PayoutCycle,
+			"depth":           user.Level,
+			"position":        user.GenealogyPosition,
+			"personal_volume": user.PersonalVolume,
+			"team_volume":     user.TeamVolume,
+		}
+		if user.ProductName != nil {
+			values["product"] = *user.ProductName
+		}
+		if user.Rank != "" {
+			values["rank"] = user.Rank
+		}
+		if user.EarningsPerCycle != nil {
+			values["total_earnings"] = user.TotalEarnings
+		}
+		graph.nodes = append(graph.nodes, graphNode{id: user.ID, label: user.Name, values: values})
+		if user.ParentID != nil {
+			graph.edges = append(graph.edges, graphEdge{source: *user.ParentID, target: user.ID, position: user.GenealogyPosition})
+		}
+	}
+	return graph
+}
+
+// nodesGenealogyGraph lays out genealogy nodes as a graph; edges to parents outside the nodes are
+// left out
+func nodesGenealogyGraph(id string, nodes []GenealogyNode) *genealogyGraph {
+	graph := &genealogyGraph{id: id, attributes: nodeGraphAttributes}
+	present := make(map[int]bool, len(nodes))
+	for _, node := range nodes {
+		present[node.ID] = true
+	}
+
+	for _, node := range nodes {
+		id := strconv.Itoa(node.ID)
+		values := map[string]interface{}{
+			"user_id":      node.UserID,
+			"payout_cycle": node.PayoutCycle,
+			"depth":        node.Depth,
+			"position":     node.Position,
+			"status":       node.Status,
+		}
+		if node.SimulationID != nil {
+			values["simulation_id"] = *node.SimulationID
+		}
+		// Imported members carry their client member ID and purchases; products are not imported
+		if node.MemberID != nil {
+			values["member_id"] = *node.MemberID
+		}
+		if node.PurchaseVolume != nil {
+			values["purchase_volume"] = *node.PurchaseVolume
+		}
+		graph.nodes = append(graph.nodes, graphNode{id: id, label: "Node " + id, values: values})
+		if node.ParentID != nil && present[*node.ParentID] {
+			graph.edges = append(graph.edges, graphEdge{source: strconv.Itoa(*node.ParentID), target: id, position: node.Position})
+		}
+	}
+	return graph
+}
+
+// writeGenealogyGraph writes a graph as a download in the given format
+func writeGenealogyGraph(w http.ResponseWriter, graph *genealogyGraph, format string) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "dot":
+		graph.writeDOT(&buf)
+	case "json":
+		err = graph.writeJSONGraph(&buf)
+	default:
+		graph.writeGraphML(&buf)
+	}
+	if err != nil {
+		log.Printf("Error exporting graph %s: %v", graph.id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", graphFormats[format][0])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("genealogy-%s.%s", graph.id, graphFormats[format][1])))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Error writing graph: %v", err)
+		return
+	}
+	log.Printf("Exported genealogy graph %s as %s (%d nodes)", graph.id, format, len(graph.nodes))
+}
+
+// writeGraphML writes the graph as GraphML, declaring a typed key for every node attribute
+func (g *genealogyGraph) writeGraphML(buf *bytes.Buffer) {
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ` +
+		`xsi:schemaLocation="http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.0/graphml.xsd">` + "\n")
+	buf.WriteString(`  <key id="label" for="node" attr.name="label" attr.type="string"/>` + "\n")
+	for _, attribute := range g.attributes {
+		fmt.Fprintf(buf, `  <key id="%s" for="node" attr.name="%s" attr.type="%s"/>`+"\n", attribute.name, attribute.name, attribute.kind)
+	}
+	buf.WriteString(`  <key id="edge_position" for="edge" attr.name="position" attr.type="string"/>` + "\n")
+
+	fmt.Fprintf(buf, `  <graph id="%s" edgedefault="directed">`+"\n", xmlEscape(g.id))
+	for _, node := range g.nodes {
+		fmt.Fprintf(buf, `    <node id="%s">`+"\n", xmlEscape(node.id))
+		fmt.Fprintf(buf, `      <data key="label">%s</data>`+"\n", xmlEscape(node.label))
+		for _, attribute := range g.attributes {
+			if value, exists := node.values[attribute.name]; exists {
+				fmt.Fprintf(buf, `      <data key="%s">%s</data>`+"\n", attribute.name, xmlEscape(formatExportCell(value)))
+			}
+		}
+		buf.WriteString("    </node>\n")
+	}
+	for _, edge := range g.edges {
+		fmt.Fprintf(buf, `    <edge source="%s" target="%s"><data key="edge_position">%s</data></edge>`+"\n",
+			xmlEscape(edge.source), xmlEscape(edge.target), xmlEscape(edge.position))
+	}
+	buf.WriteString("  </graph>\n</graphml>\n")
+}
+
+// writeDOT writes the graph as a Graphviz digraph laid out top down, node attributes kept as
+// custom attributes and edges labelled with the child's position
+func (g *genealogyGraph) writeDOT(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "digraph %s {\n", dotQuote(g.id))
+	buf.WriteString("  rankdir=TB;\n  node [shape=box, style=rounded, fontname=\"Helvetica\"];\n  edge [fontname=\"Helvetica\", fontsize=9];\n")
+	for _, node := range g.nodes {
+		fmt.Fprintf(buf, "  %s [label=%s", dotQuote(node.id), dotQuote(node.label))
+		for _, attribute := range g.attributes {
+			if value, exists := node.values[attribute.name]; exists {
+				text := formatExportCell(value)
+				if attribute.kind == "string" {
+					text = dotQuote(text)
+				}
+				fmt.Fprintf(buf, ", %s=%s", attribute.name, text)
+			}
+		}
+		buf.WriteString("];\n")
+	}
+	for _, edge := range g.edges {
+		fmt.Fprintf(buf, "  %s -> %s [label=%s];\n", dotQuote(edge.source), dotQuote(edge.target), dotQuote(edge.position))
+	}
+	buf.WriteString("}\n")
+}
+
+// dotQuote quotes a Graphviz ID
+func dotQuote(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(text) + `"`
+}
+
+// writeJSONGraph writes the graph in JSON Graph Format version 2, node attributes as metadata
+func (g *genealogyGraph) writeJSONGraph(buf *bytes.Buffer) error {
+	type jsonGraphNode struct {
+		Label    string                 `json:"label"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	type jsonGraphEdge struct {
+		Source   string            `json:"source"`
+		Target   string            `json:"target"`
+		Relation string            `json:"relation"`
+		Metadata map[string]string `json:"metadata"`
+	}
+
+	nodes := make(map[string]jsonGraphNode, len(g.nodes))
+	for _, node := range g.nodes {
+		nodes[node.id] = jsonGraphNode{Label: node.label, Metadata: node.values}
+	}
+	edges := make([]jsonGraphEdge, 0, len(g.edges))
+	for _, edge := range g.edges {
+		edges = append(edges, jsonGraphEdge{
+			Source:   edge.source,
+			Target:   edge.target,
+			Relation: "parent_of",
+			Metadata: map[string]string{"position": edge.position},
+		})
+	}
+
+	return json.NewEncoder(buf).Encode(map[string]interface{}{
+		"graph": map[string]interface{}{
+			"id":       g.id,
+			"type":     "genealogy",
+			"directed": true,
+			"nodes":    nodes,
+			"edges":    edges,
+		},
+	})
+}
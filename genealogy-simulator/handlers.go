@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -80,7 +81,7 @@ func handleGenealogyTypes(w http.ResponseWriter, r *http.Request) {
 
 // handleGetGenealogyTypes returns all available genealogy types
 func handleGetGenealogyTypes(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, description, is_active, created_at, updated_at FROM genealogy_types WHERE is_active = true")
+	rows, err := db.Query("SELECT " + genealogyTypeColumns + " FROM genealogy_types WHERE is_active = true")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -89,21 +90,13 @@ func handleGetGenealogyTypes(w http.ResponseWriter, r *http.Request) {
 
 	var types []GenealogyType
 	for rows.Next() {
-		var gt GenealogyType
-		err := rows.Scan(&gt.ID, &gt.Name, &gt.Description, &gt.IsActive, &gt.CreatedAt, &gt.UpdatedAt)
+		gt, err := scanGenealogyType(rows)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Set default values for missing fields
-		gt.MaxChildrenPerNode = 2 // Default for Binary Plan
-		if gt.Name == "Matrix" || gt.Name == "Unilevel" {
-			gt.MaxChildrenPerNode = 5 // Default for Matrix/Unilevel
-		}
-		gt.Rules = make(map[string]interface{}) // Empty rules for now
-
-		types = append(types, gt)
+		types = append(types, *gt)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -187,19 +180,65 @@ func handleSimulation(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Simulation request: %+v", req)
 
-	// Validate request
+	response, err := runSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Simulation cancelled: %v", err)
+			return
+		}
+		log.Printf("Simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Simulation completed. Generated %d nodes", len(response.Nodes))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Response sent successfully")
+}
+
+// validateSimulationRequest validates the simulation request
+func validateSimulationRequest(req SimulationRequest) error {
 	if req.MaxExpectedUsers <= 0 || req.NumberOfCycles <= 0 {
 		log.Printf("Invalid parameters: max_users=%d, cycles=%d", req.MaxExpectedUsers, req.NumberOfCycles)
-		http.Error(w, "Invalid parameters", http.StatusBadRequest)
-		return
+		return fmt.Errorf("Invalid parameters")
+	}
+
+	// Validate calendar and growth settings before running the simulation
+	calendar, err := NewPayoutCalendar(req.PayoutCycleType, req.StartDate)
+	if err == nil {
+		err = validatePayoutSchedules(calendar, req.PayoutSchedules)
+	}
+	if err == nil {
+		err = validateGrowthModel(req.AddressableMarket, req.RecruitmentRate)
+	}
+	if err == nil {
+		err = validateSimulationMode(req.SimulationMode, req.AgentModel)
+	}
+	if err != nil {
+		log.Printf("Invalid simulation settings: %v", err)
+	}
+	return err
+}
+
+// runSimulation validates a simulation request and runs the simulator of its genealogy type.
+// It stops with the context's error when the context is cancelled.
+func runSimulation(ctx context.Context, req SimulationRequest) (SimulationResponse, error) {
+	if err := validateSimulationRequest(req); err != nil {
+		return SimulationResponse{}, err
 	}
 
 	// Get genealogy type to determine simulation logic
 	genealogyType, err := getGenealogyTypeByID(req.GenealogyTypeID)
 	if err != nil {
 		log.Printf("Error getting genealogy type: %v", err)
-		http.Error(w, "Invalid genealogy type", http.StatusBadRequest)
-		return
+		return SimulationResponse{}, fmt.Errorf("Invalid genealogy type")
 	}
 
 	// Generate simulation ID
@@ -207,60 +246,68 @@ func handleSimulation(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Generated simulation ID: %s", simulationID)
 	log.Printf("Genealogy type name from DB: %s", genealogyType.Name)
 
-	// Create simulator based on genealogy type (case-insensitive, partial match)
-	var response SimulationResponse
-	genealogyTypeLower := strings.ToLower(genealogyType.Name)
+	// Create simulator based on genealogy type
+	response, err := runPlanSimulation(ctx, genealogyType, simulationID, req)
+	if err != nil {
+		return SimulationResponse{}, err
+	}
+
+	calendar, _ := NewPayoutCalendar(req.PayoutCycleType, req.StartDate)
+	if err := applyPayoutCalendar(&response, calendar, req.PayoutSchedules); err != nil {
+		log.Printf("Error applying payout calendar: %v", err)
+		return SimulationResponse{}, err
+	}
+	return response, nil
+}
 
+// resolvePlanKind determines the placement logic for a genealogy type (case-insensitive, partial match).
+// Custom types fall back to max children: 2 children = binary-like, >2 = matrix-like.
+func resolvePlanKind(genealogyType *GenealogyType, maxChildrenCount int) (string, int) {
+	if maxChildrenCount <= 0 {
+		maxChildrenCount = genealogyType.MaxChildrenPerNode // fallback to database default
+	}
+
+	genealogyTypeLower := strings.ToLower(genealogyType.Name)
 	switch {
 	case strings.Contains(genealogyTypeLower, "binary"):
-		log.Println("Creating binary plan simulator")
-		simulator := NewBinaryPlanSimulator(simulationID)
-		response = simulator.Simulate(req)
+		return "binary", 2
 	case strings.Contains(genealogyTypeLower, "unilevel"):
-		log.Println("Creating unilevel plan simulator")
-		maxChildrenCount := req.MaxChildrenCount
-		if maxChildrenCount <= 0 {
-			maxChildrenCount = genealogyType.MaxChildrenPerNode // fallback to database default
-		}
-		simulator := NewUnilevelPlanSimulator(simulationID, maxChildrenCount)
-		response = simulator.Simulate(req)
+		return "unilevel", maxChildrenCount
 	case strings.Contains(genealogyTypeLower, "matrix"):
-		log.Println("Creating matrix plan simulator")
-		maxChildrenCount := req.MaxChildrenCount
-		if maxChildrenCount <= 0 {
-			maxChildrenCount = genealogyType.MaxChildrenPerNode // fallback to database default
-		}
-		simulator := NewMatrixPlanSimulator(simulationID, maxChildrenCount)
-		response = simulator.Simulate(req)
+		return "matrix", maxChildrenCount
 	default:
-		// Fallback: Use max_children_per_node to determine plan type
-		// 2 children = binary-like, >2 = matrix-like
-		log.Printf("Custom genealogy type '%s', using max_children_count=%d to determine plan type", genealogyType.Name, req.MaxChildrenCount)
-		maxChildrenCount := req.MaxChildrenCount
-		if maxChildrenCount <= 0 {
-			maxChildrenCount = genealogyType.MaxChildrenPerNode
-		}
+		log.Printf("Custom genealogy type '%s', using max_children_count=%d to determine plan type", genealogyType.Name, maxChildrenCount)
 		if maxChildrenCount <= 2 {
-			log.Println("Using binary plan simulator for custom type")
-			simulator := NewBinaryPlanSimulator(simulationID)
-			response = simulator.Simulate(req)
-		} else {
-			log.Println("Using matrix plan simulator for custom type")
-			simulator := NewMatrixPlanSimulator(simulationID, maxChildrenCount)
-			response = simulator.Simulate(req)
+			return "binary", 2
 		}
+		return "matrix", maxChildrenCount
 	}
+}
 
-	log.Printf("Simulation completed. Generated %d nodes", len(response.Nodes))
+// runPlanSimulation creates the simulator for a genealogy type and simulation mode and runs it
+func runPlanSimulation(ctx context.Context, genealogyType *GenealogyType, simulationID string, req SimulationRequest) (SimulationResponse, error) {
+	planKind, maxChildrenCount := resolvePlanKind(genealogyType, req.MaxChildrenCount)
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	if req.SimulationMode == "agent" {
+		log.Printf("Creating agent-based %s simulator", planKind)
+		simulator := NewAgentBasedSimulator(simulationID, planKind, maxChildrenCount)
+		return simulator.Simulate(ctx, req)
 	}
 
-	log.Println("Response sent successfully")
+	switch planKind {
+	case "binary":
+		log.Println("Creating binary plan simulator")
+		simulator := NewBinaryPlanSimulator(simulationID)
+		return simulator.Simulate(ctx, req)
+	case "unilevel":
+		log.Println("Creating unilevel plan simulator")
+		simulator := NewUnilevelPlanSimulator(simulationID, maxChildrenCount)
+		return simulator.Simulate(ctx, req)
+	default:
+		log.Println("Creating matrix plan simulator")
+		simulator := NewMatrixPlanSimulator(simulationID, maxChildrenCount)
+		return simulator.Simulate(ctx, req)
+	}
 }
 
 // handleSaveSimulation saves the simulation results to database
@@ -290,25 +337,30 @@ func handleSaveSimulation(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// getGenealogyTypeByID retrieves a genealogy type by ID
-func getGenealogyTypeByID(id int) (*GenealogyType, error) {
-	var gt GenealogyType
+// genealogyTypeColumns selects a genealogy type in the order scanGenealogyType reads it
+const genealogyTypeColumns = "id, name, description, max_children_per_node, rules, is_active, created_at, updated_at"
 
-	err := db.QueryRow(
-		"SELECT id, name, description, is_active, created_at, updated_at FROM genealogy_types WHERE id = $1",
-		id,
-	).Scan(&gt.ID, &gt.Name, &gt.Description, &gt.IsActive, &gt.CreatedAt, &gt.UpdatedAt)
+// scanGenealogyType scans the genealogyTypeColumns
+func scanGenealogyType(row rowScanner) (*GenealogyType, error) {
+	var gt GenealogyType
+	var rules []byte
 
+	err := row.Scan(&gt.ID, &gt.Name, &gt.Description, &gt.MaxChildrenPerNode, &rules, &gt.IsActive, &gt.CreatedAt, &gt.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set default values for missing fields
-	gt.MaxChildrenPerNode = 2 // Default for Binary Plan
-	if gt.Name == "Matrix" || gt.Name == "Unilevel" {
-		gt.MaxChildrenPerNode = 5 // Default for Matrix/Unilevel
+	gt.Rules = make(map[string]interface{})
+	if len(rules) > 0 {
+		if err := json.Unmarshal(rules, &gt.Rules); err != nil {
+			return nil, fmt.Errorf("invalid rules for genealogy type %d: %v", gt.ID, err)
+		}
 	}
-	gt.Rules = make(map[string]interface{}) // Empty rules for now
 
 	return &gt, nil
 }
+
+// getGenealogyTypeByID retrieves a genealogy type by ID
+func getGenealogyTypeByID(id int) (*GenealogyType, error) {
+	return scanGenealogyType(db.QueryRow("SELECT "+genealogyTypeColumns+" FROM genealogy_types WHERE id = $1", id))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// noRankLabel groups participants that hold no rank in the income disclosure
+const noRankLabel = "No Rank"
+
+// IncomeDisclosure is an income disclosure statement for one business simulation.
+// Participants are all members below the root account.
+type IncomeDisclosure struct {
+	ParticipantCount      int                  `json:"participant_count"`
+	EarningParticipants   int                  `json:"earning_participants"`
+	ZeroEarnersCount      int                  `json:"zero_earners_count"`
+	ZeroEarnersPercentage float64              `json:"zero_earners_percentage"`
+	TotalEarnings         float64              `json:"total_earnings"`
+	MeanEarnings          float64              `json:"mean_earnings"`
+	MedianEarnings        float64              `json:"median_earnings"`
+	Percentiles           []EarningsPercentile `json:"percentiles"`
+	TopOnePercentShare    float64              `json:"top_one_percent_share"` // % of all earnings
+	TopTenPercentShare    float64              `json:"top_ten_percent_share"` // % of all earnings
+	ByRank                []RankEarnings       `json:"by_rank"`
+	RedFlags              []IncomeRedFlag      `json:"red_flags"`
+	Statement             string               `json:"statement"`
+}
+
+// EarningsPercentile shows the earnings at a given percentile of participants
+type EarningsPercentile struct {
+	Percentile int     `json:"percentile"`
+	Earnings   float64 `json:"earnings"`
+}
+
+// RankEarnings shows the earnings distribution of the participants holding one rank
+type RankEarnings struct {
+	Rank                  string  `json:"rank"`
+	ParticipantCount      int     `json:"participant_count"`
+	ParticipantPercentage float64 `json:"participant_percentage"`
+	TotalEarnings         float64 `json:"total_earnings"`
+	ShareOfEarnings       float64 `json:"share_of_earnings"`
+	MeanEarnings          float64 `json:"mean_earnings"`
+	MedianEarnings        float64 `json:"median_earnings"`
+	MinEarnings           float64 `json:"min_earnings"`
+	MaxEarnings           float64 `json:"max_earnings"`
+}
+
+// IncomeRedFlag describes a known warning pattern in the earnings distribution
+type IncomeRedFlag struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"` // warning or critical
+	Message  string `json:"message"`
+}
+
+// disclosurePercentiles are the percentiles reported in the income disclosure
+var disclosurePercentiles = []int{10, 25, 50, 75, 90, 95, 99}
+
+// generateIncomeDisclosure builds the income disclosure statement from the users' commission earnings
+func generateIncomeDisclosure(users []SimulationUser, products []BusinessProduct, ranks []RankDefinition) *IncomeDisclosure {
+	earnings := make([]float64, 0, len(users))
+	purchases := make([]float64, 0, len(users))
+	earningsByRank := make(map[string][]float64)
+
+	productPrices := make(map[int]float64)
+	for _, product := range products {
+		productPrices[product.ID] = product.ProductPrice
+	}
+
+	for _, user := range users {
+		if !isParticipant(user) {
+			continue
+		}
+		earnings = append(earnings, user.TotalEarnings)
+		if purchase, bought := userPurchases(user, productPrices); bought {
+			purchases = append(purchases, purchase)
+		}
+
+		rank := user.Rank
+		if rank == "" {
+			rank = noRankLabel
+		}
+		earningsByRank[rank] = append(earningsByRank[rank], user.TotalEarnings)
+	}
+
+	disclosure := &IncomeDisclosure{
+		ParticipantCount: len(earnings),
+		Percentiles:      make([]EarningsPercentile, 0, len(disclosurePercentiles)),
+		ByRank:           make([]RankEarnings, 0, len(earningsByRank)),
+		RedFlags:         make([]IncomeRedFlag, 0),
+	}
+	if len(earnings) == 0 {
+		disclosure.Statement = "No participants below the root account; no income disclosure available."
+		return disclosure
+	}
+
+	sort.Float64s(earnings)
+	for _, amount := range earnings {
+		disclosure.TotalEarnings += amount
+		if amount > 0 {
+			disclosure.EarningParticipants++
+		} else {
+			disclosure.ZeroEarnersCount++
+		}
+	}
+	disclosure.ZeroEarnersPercentage = float64(disclosure.ZeroEarnersCount) / float64(len(earnings)) * 100
+	disclosure.MeanEarnings = disclosure.TotalEarnings / float64(len(earnings))
+	disclosure.MedianEarnings = percentileOf(earnings, 50)
+
+	for _, percentile := range disclosurePercentiles {
+		disclosure.Percentiles = append(disclosure.Percentiles, EarningsPercentile{
+			Percentile: percentile,
+			Earnings:   percentileOf(earnings, float64(percentile)),
+		})
+	}
+
+	disclosure.TopOnePercentShare = topShareOf(earnings, 1, disclosure.TotalEarnings)
+	disclosure.TopTenPercentShare = topShareOf(earnings, 10, disclosure.TotalEarnings)
+
+	// Report ranks from highest to lowest, followed by participants without a rank
+	rankOrder := make([]string, 0, len(ranks)+1)
+	for i := len(ranks) - 1; i >= 0; i-- {
+		rankOrder = append(rankOrder, ranks[i].Name)
+	}
+	rankOrder = append(rankOrder, noRankLabel)
+
+	for _, rank := range rankOrder {
+		rankEarnings := earningsByRank[rank]
+		if len(rankEarnings) == 0 {
+			continue
+		}
+		sort.Float64s(rankEarnings)
+
+		data := RankEarnings{
+			Rank:                  rank,
+			ParticipantCount:      len(rankEarnings),
+			ParticipantPercentage: float64(len(rankEarnings)) / float64(len(earnings)) * 100,
+			MedianEarnings:        percentileOf(rankEarnings, 50),
+			MinEarnings:           rankEarnings[0],
+			MaxEarnings:           rankEarnings[len(rankEarnings)-1],
+		}
+		for _, amount := range rankEarnings {
+			data.TotalEarnings += amount
+		}
+		data.MeanEarnings = data.TotalEarnings / float64(len(rankEarnings))
+		if disclosure.TotalEarnings > 0 {
+			data.ShareOfEarnings = data.TotalEarnings / disclosure.TotalEarnings * 100
+		}
+
+		disclosure.ByRank = append(disclosure.ByRank, data)
+	}
+
+	sort.Float64s(purchases)
+	disclosure.RedFlags = detectIncomeRedFlags(disclosure, purchases)
+	disclosure.Statement = formatIncomeDisclosureStatement(disclosure)
+
+	return disclosure
+}
+
+// detectIncomeRedFlags flags earnings distributions that regulators commonly treat as warning signs
+func detectIncomeRedFlags(disclosure *IncomeDisclosure, purchases []float64) []IncomeRedFlag {
+	flags := make([]IncomeRedFlag, 0)
+
+	if disclosure.TopOnePercentShare > 50 {
+		flags = append(flags, IncomeRedFlag{
+			Code:     "top_one_percent_concentration",
+			Severity: "critical",
+			Message:  fmt.Sprintf("The top 1%% of participants receive %.1f%% of all earnings", disclosure.TopOnePercentShare),
+		})
+	}
+
+	if disclosure.TopTenPercentShare > 80 {
+		flags = append(flags, IncomeRedFlag{
+			Code:     "top_ten_percent_concentration",
+			Severity: "warning",
+			Message:  fmt.Sprintf("The top 10%% of participants receive %.1f%% of all earnings", disclosure.TopTenPercentShare),
+		})
+	}
+
+	if disclosure.ZeroEarnersPercentage > 50 {
+		flags = append(flags, IncomeRedFlag{
+			Code:     "majority_earn_nothing",
+			Severity: "critical",
+			Message:  fmt.Sprintf("%.1f%% of participants earn nothing", disclosure.ZeroEarnersPercentage),
+		})
+	}
+
+	if len(purchases) > 0 {
+		medianPurchase := percentileOf(purchases, 50)
+		if disclosure.MedianEarnings < medianPurchase {
+			flags = append(flags, IncomeRedFlag{
+				Code:     "median_earnings_below_purchase",
+				Severity: "warning",
+				Message:  fmt.Sprintf("Median earnings ($%.2f) are below the median product purchase ($%.2f)", disclosure.MedianEarnings, medianPurchase),
+			})
+		}
+	}
+
+	return flags
+}
+
+// formatIncomeDisclosureStatement summarises the disclosure in plain language
+func formatIncomeDisclosureStatement(disclosure *IncomeDisclosure) string {
+	lines := []string{
+		fmt.Sprintf("Of %d participants, %d (%.1f%%) earned nothing during the simulated period.",
+			disclosure.ParticipantCount, disclosure.ZeroEarnersCount, disclosure.ZeroEarnersPercentage),
+		fmt.Sprintf("Mean earnings were $%.2f and median earnings were $%.2f.",
+			disclosure.MeanEarnings, disclosure.MedianEarnings),
+		fmt.Sprintf("The top 1%% of participants received %.1f%% and the top 10%% received %.1f%% of all earnings.",
+			disclosure.TopOnePercentShare, disclosure.TopTenPercentShare),
+	}
+	for _, rank := range disclosure.ByRank {
+		lines = append(lines, fmt.Sprintf("%s: %d participants (%.1f%%), mean $%.2f, median $%.2f.",
+			rank.Rank, rank.ParticipantCount, rank.ParticipantPercentage, rank.MeanEarnings, rank.MedianEarnings))
+	}
+	return strings.Join(lines, " ")
+}
+
+// percentileOf returns the linearly interpolated percentile of sorted values
+func percentileOf(sorted []float64, percentile float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	position := percentile / 100 * float64(len(sorted)-1)
+	lower := int(position)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	fraction := position - float64(lower)
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*fraction
+}
+
+// topShareOf returns the percentage of the total held by the top given percent of sorted values
+func topShareOf(sorted []float64, percent float64, total float64) float64 {
+	if len(sorted) == 0 || total <= 0 {
+		return 0
+	}
+	count := int(float64(len(sorted))*percent/100 + 0.5)
+	if count < 1 {
+		count = 1
+	}
+	share := 0.0
+	for _, amount := range sorted[len(sorted)-count:] {
+		share += amount
+	}
+	return share / total * 100
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxReportedViolations limits the violations listed in one integrity report; the count covers all of them
+const maxReportedViolations = 500
+
+// IntegrityViolation is one inconsistency found in a genealogy
+type IntegrityViolation struct {
+	Kind    string `json:"kind"` // bounds, duplicate_bound, nesting, depth, orphan, cycle, max_children, duplicate_position or root
+	NodeID  int    `json:"node_id,omitempty"`
+	Message string `json:"message"`
+}
+
+// IntegrityReport is the result of checking, and optionally rebuilding, a genealogy
+type IntegrityReport struct {
+	GenealogyTypeID int                  `json:"genealogy_type_id"`
+	TotalNodes      int                  `json:"total_nodes"`
+	Roots           int                  `json:"roots"`
+	Consistent      bool                 `json:"consistent"`
+	ViolationCount  int                  `json:"violation_count"`
+	Violations      []IntegrityViolation `json:"violations"`
+	Rebuilt         bool                 `json:"rebuilt"`
+	AffectedNodes   []AffectedNode       `json:"affected_nodes,omitempty"` // nodes whose bounds or depth the rebuild changed
+}
+
+// handleCheckGenealogyIntegrity reports the integrity violations of a genealogy type
+func handleCheckGenealogyIntegrity(w http.ResponseWriter, r *http.Request) {
+	handleGenealogyIntegrity(w, r, false)
+}
+
+// handleRebuildGenealogy recomputes the bounds and depths of a genealogy type from its parent links
+func handleRebuildGenealogy(w http.ResponseWriter, r *http.Request) {
+	handleGenealogyIntegrity(w, r, true)
+}
+
+// handleGenealogyIntegrity checks or rebuilds the genealogy type in the path
+func handleGenealogyIntegrity(w http.ResponseWriter, r *http.Request, rebuild bool) {
+	genealogyTypeID, err := strconv.Atoi(mux.Vars(r)["genealogy_type_id"])
+	if err != nil {
+		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		return
+	}
+
+	report, err := checkGenealogyIntegrity(genealogyTypeID, rebuild)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking genealogy integrity: %v", err), placementErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"data":    report,
+	})
+}
+
+// checkGenealogyIntegrity checks a genealogy type in one transaction. With rebuild, bounds and
+// depths are then recomputed from the parent links, children keeping their slot order, and the
+// report describes the rebuilt genealogy. Parent links that form a cycle cannot be rebuilt from.
+func checkGenealogyIntegrity(genealogyTypeID int, rebuild bool) (*IntegrityReport, error) {
+	genealogyType, err := getGenealogyTypeByID(genealogyTypeID)
+	if err != nil {
+		return nil, err
+	}
+	rules := placementRulesFor(genealogyType)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if rebuild {
+		if err := lockGenealogyType(tx, genealogyTypeID); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := loadGenealogyTree(tx, genealogyTypeID)
+	if err != nil {
+		return nil, err
+	}
+	violations := checkGenealogyTree(tree, rules)
+
+	report := &IntegrityReport{GenealogyTypeID: genealogyTypeID}
+	if rebuild {
+		for _, violation := range violations {
+			if violation.Kind == "cycle" {
+				return nil, newPlacementError(http.StatusConflict, "cannot rebuild: %s", violation.Message)
+			}
+		}
+
+		for _, node := range tree.nodes {
+			sort.SliceStable(node.children, func(i, j int) bool {
+				return rules.slot(node.children[i].position) < rules.slot(node.children[j].position)
+			})
+		}
+		tree.renumber()
+		changed, err := tree.save(tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		report.Rebuilt = true
+		report.AffectedNodes = affectedNodes(changed)
+		violations = checkGenealogyTree(tree, rules)
+		log.Printf("Rebuilt genealogy type %d: %d nodes changed, %d violations remain", genealogyTypeID, len(changed), len(violations))
+	}
+
+	report.TotalNodes = len(tree.nodes)
+	report.Roots = len(tree.roots)
+	report.Consistent = len(violations) == 0
+	report.ViolationCount = len(violations)
+	if len(violations) > maxReportedViolations {
+		violations = violations[:maxReportedViolations]
+	}
+	report.Violations = violations
+	return report, nil
+}
+
+// checkGenealogyTree finds the violations of a loaded genealogy
+func checkGenealogyTree(tree *genealogyTree, rules placementRules) []IntegrityViolation {
+	violations := make([]IntegrityViolation, 0)
+	add := func(kind string, nodeID int, format string, args ...interface{}) {
+		violations = append(violations, IntegrityViolation{Kind: kind, NodeID: nodeID, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Every bound value is used exactly once
+	boundOwners := make(map[int][]int, 2*len(tree.nodes))
+	for _, node := range tree.nodes {
+		boundOwners[node.left] = append(boundOwners[node.left], node.id)
+		boundOwners[node.right] = append(boundOwners[node.right], node.id)
+	}
+	for bound, owners := range boundOwners {
+		if len(owners) > 1 {
+			sort.Ints(owners)
+			add("duplicate_bound", owners[0], "bound %d is used by nodes %v", bound, owners)
+		}
+	}
+
+	visited := make(map[int]bool, len(tree.nodes))
+	var visit func(node *treeNode, depth int)
+	visit = func(node *treeNode, depth int) {
+		visited[node.id] = true
+		if node.left >= node.right {
+			add("bounds", node.id, "node %d: left bound %d is not below right bound %d", node.id, node.left, node.right)
+		}
+		if node.depth != depth {
+			add("depth", node.id, "node %d: depth %d, expected %d", node.id, node.depth, depth)
+		}
+		if rules.maxChildren > 0 && len(node.children) > rules.maxChildren {
+			add("max_children", node.id, "node %d has %d children, more than the maximum of %d", node.id, len(node.children), rules.maxChildren)
+		}
+
+		// Children are in left bound order, so each must start after the previous one ends
+		previous := node.left
+		positions := make(map[string]bool, len(node.children))
+		for _, child := range node.children {
+			if child.left <= previous || child.right >= node.right {
+				add("nesting", child.id, "node %d: bounds [%d, %d] are not nested inside parent %d [%d, %d] after its previous sibling",
+					child.id, child.left, child.right, node.id, node.left, node.right)
+			}
+			if len(rules.positions) > 0 {
+				if positions[child.position] {
+					add("duplicate_position", child.id, "node %d: parent %d already has a %s child", child.id, node.id, child.position)
+				}
+				positions[child.position] = true
+			}
+			previous = child.right
+			visit(child, depth+1)
+		}
+	}
+
+	for _, root := range tree.roots {
+		if root.parentID != nil {
+			add("orphan", root.id, "node %d: parent %d is not in this genealogy", root.id, *root.parentID)
+		}
+		visit(root, 0)
+	}
+	if len(tree.roots) != 1 && len(tree.nodes) > 0 {
+		add("root", 0, "genealogy has %d roots, expected 1", len(tree.roots))
+	}
+
+	// Nodes never reached from a root have parent links that loop
+	var unreachable []int
+	for id := range tree.nodes {
+		if !visited[id] {
+			unreachable = append(unreachable, id)
+		}
+	}
+	sort.Ints(unreachable)
+	for _, id := range unreachable {
+		add("cycle", id, "node %d: its parent links form a cycle and never reach a root", id)
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].NodeID < violations[j].NodeID })
+	return violations
+}
+
+// runCheckIntegrity checks, and with -rebuild repairs, a genealogy type from the command line
+func runCheckIntegrity(args []string) error {
+	flags := flagSet("check-integrity")
+	genealogyTypeID := flags.Int("type", 0, "genealogy type to check")
+	rebuild := flags.Bool("rebuild", false, "recompute bounds and depths from the parent links")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *genealogyTypeID <= 0 {
+		return fmt.Errorf("type must be positive")
+	}
+
+	report, err := checkGenealogyIntegrity(*genealogyTypeID, *rebuild)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("genealogy type %d not found", *genealogyTypeID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.Rebuilt {
+		log.Printf("Rebuilt genealogy type %d: %d nodes changed", report.GenealogyTypeID, len(report.AffectedNodes))
+	}
+	for _, violation := range report.Violations {
+		log.Printf("  %s: %s", violation.Kind, violation.Message)
+	}
+	if !report.Consistent {
+		return fmt.Errorf("genealogy type %d has %d violations in %d nodes", report.GenealogyTypeID, report.ViolationCount, report.TotalNodes)
+	}
+	log.Printf("Genealogy type %d is consistent with %d nodes", report.GenealogyTypeID, report.TotalNodes)
+	return nil
+}
@@ -20,6 +20,14 @@ func main() {
 	InitDB()
 	defer db.Close()
 
+	// Run a command line subcommand instead of the server, e.g. stress-insert or check-integrity
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Initialize services
 	// Settings service removed
 
@@ -31,15 +39,43 @@ func main() {
 	// API routes
 	r.HandleFunc("/api/genealogy/simulate", handleSimulation).Methods("POST")
 	r.HandleFunc("/api/genealogy/business-simulate", handleBusinessSimulation).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/compare", handleCompareScenarios).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/sweep", handleParameterSweep).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/goal-seek", handleGoalSeek).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/stream", handleBusinessSimulationStream).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/stored", handleStoredBusinessSimulation).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/export", handleExportBusinessSimulation).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/graph", handleBusinessSimulationGraph).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/svg", handleBusinessSimulationSVG).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/business-simulate/report", handleBusinessSimulationReport).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/genealogy/types", handleGenealogyTypes).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/genealogy/save-simulation", handleSaveSimulation).Methods("POST")
 
+	// Background simulation jobs
+	r.HandleFunc("/api/genealogy/jobs/simulate", handleSubmitSimulationJob).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/jobs/business-simulate", handleSubmitBusinessSimulationJob).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}", handleGetSimulationJob).Methods("GET")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}", handleCancelSimulationJob).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}/result", handleGetSimulationJobResult).Methods("GET")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}/export", handleExportSimulationJob).Methods("GET")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}/graph", handleSimulationJobGraph).Methods("GET")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}/svg", handleSimulationJobSVG).Methods("GET")
+	r.HandleFunc("/api/genealogy/jobs/{job_id}/report", handleSimulationJobReport).Methods("GET")
+
 	// Genealogy Management API routes
 	r.HandleFunc("/api/genealogy/generate-users", handleGenerateUsers).Methods("POST")
 	r.HandleFunc("/api/genealogy/downline/{parent_id}", handleGetDownlineUsers).Methods("GET")
 	r.HandleFunc("/api/genealogy/upline/{node_id}", handleGetUplineUsers).Methods("GET")
+	r.HandleFunc("/api/genealogy/children/{node_id}", handleGetGenealogyChildren).Methods("GET")
 	r.HandleFunc("/api/genealogy/structure/{genealogy_type_id}", handleGetGenealogyStructure).Methods("GET")
+	r.HandleFunc("/api/genealogy/graph/{genealogy_type_id}", handleStoredGenealogyGraph).Methods("GET")
+	r.HandleFunc("/api/genealogy/svg/{genealogy_type_id}", handleStoredGenealogySVG).Methods("GET")
 	r.HandleFunc("/api/genealogy/add-user", handleAddUserToGenealogy).Methods("POST")
+	r.HandleFunc("/api/genealogy/import", handleImportGenealogy).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/genealogy/move-node", handleMoveGenealogyNode).Methods("POST")
+	r.HandleFunc("/api/genealogy/remove-node", handleRemoveGenealogyNode).Methods("POST")
+	r.HandleFunc("/api/genealogy/integrity/{genealogy_type_id}", handleCheckGenealogyIntegrity).Methods("GET")
+	r.HandleFunc("/api/genealogy/integrity/{genealogy_type_id}/rebuild", handleRebuildGenealogy).Methods("POST")
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 )
 
@@ -25,25 +26,27 @@ func NewMatrixPlanSimulator(simulationID string, maxChildrenCount int) *MatrixPl
 	}
 }
 
-func (m *MatrixPlanSimulator) Simulate(req SimulationRequest) SimulationResponse {
+func (m *MatrixPlanSimulator) Simulate(ctx context.Context, req SimulationRequest) (SimulationResponse, error) {
 	usersPerCycle := req.MaxExpectedUsers / req.NumberOfCycles
 	if req.MaxExpectedUsers%req.NumberOfCycles != 0 {
 		usersPerCycle++
 	}
 
+	userCounts, growthAnalysis := cycleUserCounts(req)
 	cycles := make([]CycleData, 0)
 	totalNodes := 0
 
 	for cycle := 1; cycle <= req.NumberOfCycles; cycle++ {
-		cycleStartUser := totalNodes + 1
-		cycleEndUser := cycleStartUser + usersPerCycle - 1
-		if cycleEndUser > req.MaxExpectedUsers {
-			cycleEndUser = req.MaxExpectedUsers
+		if err := ctx.Err(); err != nil {
+			return SimulationResponse{}, err
 		}
+		cycleStartUser := totalNodes + 1
+		cycleEndUser := cycleStartUser + userCounts[cycle-1] - 1
 		usersInCycle := cycleEndUser - cycleStartUser + 1
 
 		cycleNodes := m.generateCycleNodes(cycle, cycleStartUser, cycleEndUser, req.GenealogyTypeID)
 		totalNodes += len(cycleNodes)
+		reportProgress(ctx, SimulationProgress{Stage: "placing_users", Cycle: cycle, TotalCycles: req.NumberOfCycles, UsersPlaced: totalNodes})
 
 		cycles = append(cycles, CycleData{
 			CycleNumber:  cycle,
@@ -52,6 +55,7 @@ func (m *MatrixPlanSimulator) Simulate(req SimulationRequest) SimulationResponse
 			UsersInCycle: usersInCycle,
 			NodesInCycle: cycleNodes,
 		})
+		reportCycle(ctx, cycles[len(cycles)-1])
 	}
 
 	treeStructure := m.buildTreeStructure()
@@ -67,8 +71,9 @@ func (m *MatrixPlanSimulator) Simulate(req SimulationRequest) SimulationResponse
 		Nodes:               m.nodes,
 		Cycles:              cycles,
 		TreeStructure:       treeStructure,
+		GrowthAnalysis:      growthAnalysis,
 		CreatedAt:           time.Now(),
-	}
+	}, nil
 }
 
 // generateCycleNodes generates nodes for a specific cycle
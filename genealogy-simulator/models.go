@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 )
 
@@ -29,17 +30,32 @@ type GenealogyNode struct {
 	SimulationID    *string   `json:"simulation_id"`
 	PayoutCycle     int       `json:"payout_cycle"`
 	CyclePosition   int       `json:"cycle_position"`
+	Status          string    `json:"status,omitempty"` // active, or placeholder for a removed member's position
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
+	// Set on members of an imported client genealogy
+	MemberID       *string  `json:"member_id,omitempty"`
+	SponsorNodeID  *int     `json:"sponsor_node_id,omitempty"`
+	PurchaseVolume *float64 `json:"purchase_volume,omitempty"` // nil when the import recorded no purchases
 }
 
 // SimulationRequest represents the request for genealogy simulation
 type SimulationRequest struct {
 	GenealogyTypeID  int    `json:"genealogy_type_id"`
 	MaxExpectedUsers int    `json:"max_expected_users"`
-	PayoutCycleType  string `json:"payout_cycle_type"` // weekly, biweekly, monthly
+	PayoutCycleType  string `json:"payout_cycle_type"` // weekly, biweekly, monthly, quarterly
 	NumberOfCycles   int    `json:"number_of_cycles"`
 	MaxChildrenCount int    `json:"max_children_count"`
+	// Optional calendar settings: first day of cycle 1 (YYYY-MM-DD) and extra payout frequencies
+	StartDate       string                 `json:"start_date,omitempty"`
+	PayoutSchedules []PayoutScheduleConfig `json:"payout_schedules,omitempty"`
+	// Optional market saturation: recruitment slows as the tree approaches the addressable market
+	AddressableMarket int     `json:"addressable_market,omitempty"`
+	RecruitmentRate   float64 `json:"recruitment_rate,omitempty"` // recruits per member per cycle before saturation
+	// Optional agent-based mode: the tree grows from member behaviour instead of fill order
+	SimulationMode string            `json:"simulation_mode,omitempty"` // fill (default) or agent
+	AgentModel     *AgentModelConfig `json:"agent_model,omitempty"`
+	Seed           int64             `json:"seed,omitempty"`
 }
 
 // SimulationResponse represents the response from genealogy simulation
@@ -54,7 +70,15 @@ type SimulationResponse struct {
 	Nodes               []GenealogyNode        `json:"nodes"`
 	Cycles              []CycleData            `json:"cycles"`
 	TreeStructure       map[string]interface{} `json:"tree_structure"`
+	GrowthAnalysis      *GrowthAnalysis        `json:"growth_analysis,omitempty"`
+	SimulationMode      string                 `json:"simulation_mode,omitempty"`
+	Seed                int64                  `json:"seed,omitempty"`
+	AgentTraits         []AgentTraits          `json:"agent_traits,omitempty"`
 	CreatedAt           time.Time              `json:"created_at"`
+	// Calendar dates, present when the request has a start date
+	StartDate       string           `json:"start_date,omitempty"`
+	Calendar        []PayoutPeriod   `json:"calendar,omitempty"`
+	PayoutSchedules []PayoutSchedule `json:"payout_schedules,omitempty"`
 }
 
 // CycleData represents data for each payout cycle
@@ -64,6 +88,8 @@ type CycleData struct {
 	EndUser      int             `json:"end_user"`
 	UsersInCycle int             `json:"users_in_cycle"`
 	NodesInCycle []GenealogyNode `json:"nodes_in_cycle"`
+	StartDate    string          `json:"start_date,omitempty"`
+	EndDate      string          `json:"end_date,omitempty"`
 }
 
 // TreeNode represents a node in the tree structure for visualization
@@ -92,25 +118,27 @@ func NewBinaryPlanSimulator(simulationID string) *BinaryPlanSimulator {
 }
 
 // Simulate runs the binary plan simulation
-func (b *BinaryPlanSimulator) Simulate(req SimulationRequest) SimulationResponse {
+func (b *BinaryPlanSimulator) Simulate(ctx context.Context, req SimulationRequest) (SimulationResponse, error) {
 	usersPerCycle := req.MaxExpectedUsers / req.NumberOfCycles
 	if req.MaxExpectedUsers%req.NumberOfCycles != 0 {
 		usersPerCycle++
 	}
 
+	userCounts, growthAnalysis := cycleUserCounts(req)
 	cycles := make([]CycleData, 0)
 	totalNodes := 0
 
 	for cycle := 1; cycle <= req.NumberOfCycles; cycle++ {
-		cycleStartUser := totalNodes + 1
-		cycleEndUser := cycleStartUser + usersPerCycle - 1
-		if cycleEndUser > req.MaxExpectedUsers {
-			cycleEndUser = req.MaxExpectedUsers
+		if err := ctx.Err(); err != nil {
+			return SimulationResponse{}, err
 		}
+		cycleStartUser := totalNodes + 1
+		cycleEndUser := cycleStartUser + userCounts[cycle-1] - 1
 		usersInCycle := cycleEndUser - cycleStartUser + 1
 
 		cycleNodes := b.generateCycleNodes(cycle, cycleStartUser, cycleEndUser, req.GenealogyTypeID)
 		totalNodes += len(cycleNodes)
+		reportProgress(ctx, SimulationProgress{Stage: "placing_users", Cycle: cycle, TotalCycles: req.NumberOfCycles, UsersPlaced: totalNodes})
 
 		cycles = append(cycles, CycleData{
 			CycleNumber:  cycle,
@@ -119,6 +147,7 @@ func (b *BinaryPlanSimulator) Simulate(req SimulationRequest) SimulationResponse
 			UsersInCycle: usersInCycle,
 			NodesInCycle: cycleNodes,
 		})
+		reportCycle(ctx, cycles[len(cycles)-1])
 	}
 
 	treeStructure := b.buildTreeStructure()
@@ -134,8 +163,9 @@ func (b *BinaryPlanSimulator) Simulate(req SimulationRequest) SimulationResponse
 		Nodes:               b.nodes,
 		Cycles:              cycles,
 		TreeStructure:       treeStructure,
+		GrowthAnalysis:      growthAnalysis,
 		CreatedAt:           time.Now(),
-	}
+	}, nil
 }
 
 // generateCycleNodes generates nodes for a specific cycle
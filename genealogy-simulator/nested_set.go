@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// genealogyLockNamespace is the first key of the advisory locks that serialise changes to a genealogy type
+const genealogyLockNamespace = 7301
+
+// lockGenealogyType serialises structural changes to a genealogy type until the transaction ends
+func lockGenealogyType(tx *sql.Tx, genealogyTypeID int) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", genealogyLockNamespace, genealogyTypeID)
+	return err
+}
+
+// placementError is a placement the genealogy rules do not allow
+type placementError struct {
+	status  int
+	message string
+}
+
+func (e *placementError) Error() string {
+	return e.message
+}
+
+// newPlacementError returns a placement error reported with the given HTTP status
+func newPlacementError(status int, format string, args ...interface{}) *placementError {
+	return &placementError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// placementErrorStatus returns the HTTP status of an error from a structural change
+func placementErrorStatus(err error) int {
+	if placement, ok := err.(*placementError); ok {
+		return placement.status
+	}
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// treeNode is a genealogy node held in memory while its tree is restructured
+type treeNode struct {
+	id       int
+	parentID *int
+	left     int
+	right    int
+	depth    int
+	position string
+	children []*treeNode
+
+	// values as loaded, to tell which rows changed
+	original [4]int // left, right, depth, parent (0 for none)
+	origPos  string
+}
+
+// genealogyTree is the whole nested set of one genealogy type
+type genealogyTree struct {
+	genealogyTypeID int
+	nodes           map[int]*treeNode
+	roots           []*treeNode
+	removed         []int
+}
+
+// loadGenealogyTree reads every node of a genealogy type within the transaction. Children keep
+// their left bound order; nodes whose parent is missing are treated as roots.
+func loadGenealogyTree(tx *sql.Tx, genealogyTypeID int) (*genealogyTree, error) {
+	rows, err := tx.Query(`
+		SELECT id, parent_id, left_bound, right_bound, depth, position
+		FROM genealogy_nodes
+		WHERE genealogy_type_id = $1
+		ORDER BY left_bound
+	`, genealogyTypeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ordered []*treeNode
+	for rows.Next() {
+		node := &treeNode{}
+		if err := rows.Scan(&node.id, &node.parentID, &node.left, &node.right, &node.depth, &node.position); err != nil {
+			return nil, err
+		}
+		ordered = append(ordered, node)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newGenealogyTree(genealogyTypeID, ordered), nil
+}
+
+// newGenealogyTree links nodes, in left bound order, into a tree; nodes whose parent is not among
+// them become roots
+func newGenealogyTree(genealogyTypeID int, ordered []*treeNode) *genealogyTree {
+	tree := &genealogyTree{genealogyTypeID: genealogyTypeID, nodes: make(map[int]*treeNode, len(ordered))}
+	for _, node := range ordered {
+		node.original = [4]int{node.left, node.right, node.depth, parentKey(node.parentID)}
+		node.origPos = node.position
+		tree.nodes[node.id] = node
+	}
+
+	for _, node := range ordered {
+		if parent := tree.parent(node); parent != nil {
+			parent.children = append(parent.children, node)
+		} else {
+			tree.roots = append(tree.roots, node)
+		}
+	}
+	return tree
+}
+
+// parentKey returns the parent ID, or 0 for a root
+func parentKey(parentID *int) int {
+	if parentID == nil {
+		return 0
+	}
+	return *parentID
+}
+
+// parent returns the node's parent, or nil for a root or an orphan
+func (t *genealogyTree) parent(node *treeNode) *treeNode {
+	if node.parentID == nil {
+		return nil
+	}
+	return t.nodes[*node.parentID]
+}
+
+// isDescendant reports whether node lies in the subtree of ancestor, ancestor included. The walk
+// up is bounded by the tree size so corrupt parent links cannot loop forever.
+func (t *genealogyTree) isDescendant(node, ancestor *treeNode) bool {
+	steps := 0
+	for current := node; current != nil && steps <= len(t.nodes); current = t.parent(current) {
+		if current == ancestor {
+			return true
+		}
+		steps++
+	}
+	return false
+}
+
+// detach removes a node, with its subtree, from its parent's children or the roots
+func (t *genealogyTree) detach(node *treeNode) {
+	siblings := &t.roots
+	if parent := t.parent(node); parent != nil {
+		siblings = &parent.children
+	}
+	for i, sibling := range *siblings {
+		if sibling == node {
+			*siblings = append((*siblings)[:i], (*siblings)[i+1:]...)
+			break
+		}
+	}
+}
+
+// remove deletes a detached node from the tree; its row is deleted by save
+func (t *genealogyTree) remove(node *treeNode) {
+	delete(t.nodes, node.id)
+	t.removed = append(t.removed, node.id)
+}
+
+// attach adds a detached node as a child of parent in the given position, keeping the children
+// in the slot order of the placement rules
+func (t *genealogyTree) attach(node, parent *treeNode, position string, rules placementRules) {
+	parentID := parent.id
+	node.parentID = &parentID
+	node.position = position
+	parent.children = append(parent.children, node)
+	sort.SliceStable(parent.children, func(i, j int) bool {
+		return rules.slot(parent.children[i].position) < rules.slot(parent.children[j].position)
+	})
+}
+
+// renumber recomputes every bound and depth from the parent links by a depth-first walk
+func (t *genealogyTree) renumber() {
+	counter := 1
+	var visit func(node *treeNode, depth int)
+	visit = func(node *treeNode, depth int) {
+		node.depth = depth
+		node.left = counter
+		counter++
+		for _, child := range node.children {
+			visit(child, depth+1)
+		}
+		node.right = counter
+		counter++
+	}
+	for _, root := range t.roots {
+		visit(root, 0)
+	}
+}
+
+// changedNodes returns the nodes whose bounds, depth, parent or position differ from the stored row
+func (t *genealogyTree) changedNodes() []*treeNode {
+	var changed []*treeNode
+	for _, node := range t.nodes {
+		current := [4]int{node.left, node.right, node.depth, parentKey(node.parentID)}
+		if current != node.original || node.position != node.origPos {
+			changed = append(changed, node)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].left < changed[j].left })
+	return changed
+}
+
+// save writes the changed nodes and deletes the removed ones. Bounds are first written negated and
+// then flipped, so the unique bounds constraint never sees two rows holding the same pair mid-update.
+func (t *genealogyTree) save(tx *sql.Tx) ([]*treeNode, error) {
+	changed := t.changedNodes()
+	if len(changed) == 0 && len(t.removed) == 0 {
+		return changed, nil
+	}
+
+	ids := make([]int64, len(changed))
+	lefts := make([]int64, len(changed))
+	rights := make([]int64, len(changed))
+	depths := make([]int64, len(changed))
+	parents := make([]sql.NullInt64, len(changed))
+	positions := make([]string, len(changed))
+	for i, node := range changed {
+		ids[i] = int64(node.id)
+		lefts[i] = int64(-node.left)
+		rights[i] = int64(-node.right)
+		depths[i] = int64(node.depth)
+		if node.parentID != nil {
+			parents[i] = sql.NullInt64{Int64: int64(*node.parentID), Valid: true}
+		}
+		positions[i] = node.position
+	}
+
+	_, err := tx.Exec(`
+		UPDATE genealogy_nodes gn
+		SET left_bound = c.left_bound, right_bound = c.right_bound, depth = c.depth,
+		    parent_id = c.parent_id, position = c.position, updated_at = NOW()
+		FROM unnest($1::int[], $2::int[], $3::int[], $4::int[], $5::int[], $6::text[])
+		     AS c(id, left_bound, right_bound, depth, parent_id, position)
+		WHERE gn.id = c.id
+	`, pq.Array(ids), pq.Array(lefts), pq.Array(rights), pq.Array(depths), pq.Array(parents), pq.Array(positions))
+	if err != nil {
+		return nil, err
+	}
+
+	// Removed rows go once their children point elsewhere, as deleting a parent cascades
+	if len(t.removed) > 0 {
+		if _, err := tx.Exec("DELETE FROM genealogy_nodes WHERE id = ANY($1)", pq.Array(t.removed)); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(
+		"UPDATE genealogy_nodes SET left_bound = -left_bound, right_bound = -right_bound WHERE genealogy_type_id = $1 AND left_bound < 0",
+		t.genealogyTypeID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// subtreeSize returns the number of nodes in a node's subtree, the node included
+func subtreeSize(node *treeNode) int {
+	size := 1
+	for _, child := range node.children {
+		size += subtreeSize(child)
+	}
+	return size
+}
+
+// shiftBoundsForInsert opens a gap of two at leftBound for a new leaf: nodes starting at or after
+// it move right, and their ancestors widen. Like save, bounds pass through negative values so the
+// unique bounds constraint holds row by row.
+func shiftBoundsForInsert(tx *sql.Tx, genealogyTypeID, leftBound int) error {
+	_, err := tx.Exec(`
+		UPDATE genealogy_nodes
+		SET left_bound = -(CASE WHEN left_bound >= $1 THEN left_bound + 2 ELSE left_bound END),
+		    right_bound = -(right_bound + 2)
+		WHERE genealogy_type_id = $2 AND right_bound >= $1
+	`, leftBound, genealogyTypeID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE genealogy_nodes SET left_bound = -left_bound, right_bound = -right_bound WHERE genealogy_type_id = $1 AND left_bound < 0",
+		genealogyTypeID,
+	)
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestConcurrentGenealogyInserts adds users to a fresh genealogy type from many goroutines at once
+// and checks that the nested set stays consistent with a single root. It needs a disposable
+// database with the schema applied, named by GENEALOGY_TEST_DATABASE_URL, and is skipped without one.
+func TestConcurrentGenealogyInserts(t *testing.T) {
+	connStr := os.Getenv("GENEALOGY_TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("GENEALOGY_TEST_DATABASE_URL is not set")
+	}
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatalf("database connection failed: %v", err)
+	}
+
+	var genealogyTypeID int
+	err = db.QueryRow(
+		`INSERT INTO genealogy_types (name, description, max_children_per_node, is_active, rules)
+		 VALUES ($1, 'Concurrent insert test', 2, true, '{"type": "binary", "max_children": 2, "child_positions": ["left", "right"]}')
+		 RETURNING id`,
+		"Binary stress test "+uuid.New().String()[:8],
+	).Scan(&genealogyTypeID)
+	if err != nil {
+		t.Fatalf("creating genealogy type: %v", err)
+	}
+
+	const workers, users = 8, 25
+	simulationID, failures := stressInsert(genealogyTypeID, workers, users)
+	defer func() {
+		if _, err := db.Exec("DELETE FROM genealogy_types WHERE id = $1", genealogyTypeID); err != nil {
+			t.Errorf("removing genealogy type %d: %v", genealogyTypeID, err)
+		}
+		if _, err := db.Exec("DELETE FROM users WHERE email LIKE $1", simulationID+"-%@example.com"); err != nil {
+			t.Errorf("removing users of %s: %v", simulationID, err)
+		}
+	}()
+	for _, failure := range failures {
+		t.Error(failure)
+	}
+
+	report, err := checkGenealogyIntegrity(genealogyTypeID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, violation := range report.Violations {
+		t.Errorf("%s: %s", violation.Kind, violation.Message)
+	}
+	if report.Roots != 1 {
+		t.Errorf("got %d roots, want 1", report.Roots)
+	}
+	if report.TotalNodes != workers*users {
+		t.Errorf("got %d nodes, want %d", report.TotalNodes, workers*users)
+	}
+}
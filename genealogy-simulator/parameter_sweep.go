@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of a parameter sweep
+const (
+	maxSweepParameters = 2
+	maxSweepPoints     = 400
+	maxSweepWorkers    = 16
+)
+
+// salesRatioPath matches the sales ratio of a product, e.g. "products.1.product_sales_ratio"
+var salesRatioPath = regexp.MustCompile(`^products\.(\d+)\.product_sales_ratio$`)
+
+// SweepParameter is a request field swept by its JSON path over a list or range of values.
+// Sweeping a product sales ratio (0 to 100) rescales the products that are not swept so the ratios
+// still total 100%.
+type SweepParameter struct {
+	Path   string    `json:"path"`
+	Values []float64 `json:"values,omitempty"`
+	// Range alternative to values: steps evenly spaced values from start to end inclusive
+	Start float64 `json:"start,omitempty"`
+	End   float64 `json:"end,omitempty"`
+	Steps int     `json:"steps,omitempty"`
+}
+
+// ParameterSweepRequest sweeps one or two parameters of a base business simulation
+type ParameterSweepRequest struct {
+	Base       BusinessSimulationRequest `json:"base"`
+	Parameters []SweepParameter          `json:"parameters"`
+	Workers    int                       `json:"workers,omitempty"` // defaults to the number of CPUs
+}
+
+// SweepAxis lists the values of one swept parameter
+type SweepAxis struct {
+	Path   string    `json:"path"`
+	Values []float64 `json:"values"`
+}
+
+// SweepPoint is the outcome of one combination of parameter values. The company margin is only set
+// when the plan pays commissions: without them the payout is business volume rather than money.
+type SweepPoint struct {
+	Values        []float64 `json:"values"` // in the order of the parameters
+	TotalUsers    int       `json:"total_users"`
+	Revenue       float64   `json:"revenue"`
+	TotalVolume   float64   `json:"total_volume"`
+	TotalPayout   float64   `json:"total_payout"`
+	PayoutRatio   float64   `json:"payout_ratio"`             // payout as % of volume
+	CompanyMargin *float64  `json:"company_margin,omitempty"` // revenue left after payout, as % of revenue
+	Error         string    `json:"error,omitempty"`
+}
+
+// ParameterSweepResponse is the grid of outcomes of a parameter sweep. The grids are indexed
+// [second parameter value][first parameter value] and hold a single row for one parameter. The
+// company margin grid is left out when no point reports a margin.
+type ParameterSweepResponse struct {
+	Seed              int64        `json:"seed"`
+	Axes              []SweepAxis  `json:"axes"`
+	Points            []SweepPoint `json:"points"`
+	PayoutRatioGrid   [][]float64  `json:"payout_ratio_grid"`
+	CompanyMarginGrid [][]float64  `json:"company_margin_grid,omitempty"`
+	DurationMs        int64        `json:"duration_ms"`
+	CreatedAt         time.Time    `json:"created_at"`
+}
+
+// handleParameterSweep runs a business simulation for every combination of the swept parameter values.
+// The sweep stops when the client disconnects.
+func handleParameterSweep(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	log.Println("Received parameter sweep request")
+
+	var req ParameterSweepRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := runParameterSweep(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Parameter sweep cancelled: %v", err)
+			return
+		}
+		log.Printf("Parameter sweep error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Parameter sweep completed with %d points", len(response.Points))
+}
+
+// runParameterSweep runs the sweep on a pool of workers with a shared seed. A point whose request is
+// invalid records its error instead of failing the sweep; cancelling the context stops the sweep.
+func runParameterSweep(ctx context.Context, req ParameterSweepRequest) (*ParameterSweepResponse, error) {
+	started := time.Now()
+
+	axes, err := resolveSweepAxes(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	base := req.Base
+	if base.Seed == 0 {
+		base.Seed = time.Now().UnixNano()
+	}
+
+	// Lay out the grid with the first parameter varying fastest
+	columns := len(axes[0].Values)
+	rows := 1
+	if len(axes) > 1 {
+		rows = len(axes[1].Values)
+	}
+	points := make([]SweepPoint, rows*columns)
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns; column++ {
+			values := []float64{axes[0].Values[column]}
+			if len(axes) > 1 {
+				values = append(values, axes[1].Values[row])
+			}
+			points[row*columns+column] = SweepPoint{Values: values}
+		}
+	}
+
+	workers := req.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > maxSweepWorkers {
+		workers = maxSweepWorkers
+	}
+	if workers > len(points) {
+		workers = len(points)
+	}
+	log.Printf("Running parameter sweep of %d points on %d workers", len(points), workers)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				points[index] = runSweepPoint(ctx, base, axes, points[index].Values)
+			}
+		}()
+	}
+
+dispatch:
+	for index := range points {
+		select {
+		case jobs <- index:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	response := &ParameterSweepResponse{
+		Seed:            base.Seed,
+		Axes:            axes,
+		Points:          points,
+		PayoutRatioGrid: make([][]float64, rows),
+		CreatedAt:       time.Now(),
+	}
+	for _, point := range points {
+		if point.CompanyMargin != nil {
+			response.CompanyMarginGrid = make([][]float64, rows)
+			break
+		}
+	}
+	for row := 0; row < rows; row++ {
+		response.PayoutRatioGrid[row] = make([]float64, columns)
+		if response.CompanyMarginGrid != nil {
+			response.CompanyMarginGrid[row] = make([]float64, columns)
+		}
+		for column := 0; column < columns; column++ {
+			point := points[row*columns+column]
+			// Failed points show as zero; their error is on the point
+			response.PayoutRatioGrid[row][column] = point.PayoutRatio
+			if point.CompanyMargin != nil {
+				response.CompanyMarginGrid[row][column] = *point.CompanyMargin
+			}
+		}
+	}
+	response.DurationMs = time.Since(started).Milliseconds()
+
+	return response, nil
+}
+
+// resolveSweepAxes validates the swept parameters and expands ranges into their values
+func resolveSweepAxes(parameters []SweepParameter) ([]SweepAxis, error) {
+	if len(parameters) == 0 || len(parameters) > maxSweepParameters {
+		return nil, fmt.Errorf("between 1 and %d parameters can be swept", maxSweepParameters)
+	}
+
+	axes := make([]SweepAxis, 0, len(parameters))
+	pointCount := 1
+	for i, parameter := range parameters {
+		if parameter.Path == "" {
+			return nil, fmt.Errorf("parameter %d requires a path", i+1)
+		}
+		if i > 0 && parameter.Path == parameters[0].Path {
+			return nil, fmt.Errorf("parameter %s is swept more than once", parameter.Path)
+		}
+
+		values := parameter.Values
+		if len(values) == 0 {
+			if parameter.Steps < 2 {
+				return nil, fmt.Errorf("parameter %s requires values or a range with at least 2 steps", parameter.Path)
+			}
+			values = make([]float64, parameter.Steps)
+			increment := (parameter.End - parameter.Start) / float64(parameter.Steps-1)
+			for step := range values {
+				// Round away floating point noise such as 8.799999999
+				values[step] = math.Round((parameter.Start+increment*float64(step))*1e9) / 1e9
+			}
+		}
+
+		if salesRatioPath.MatchString(parameter.Path) {
+			for _, value := range values {
+				if value < 0 || value > 100 {
+					return nil, fmt.Errorf("parameter %s must be between 0 and 100, got %g", parameter.Path, value)
+				}
+			}
+		}
+
+		pointCount *= len(values)
+		axes = append(axes, SweepAxis{Path: parameter.Path, Values: values})
+	}
+	if pointCount > maxSweepPoints {
+		return nil, fmt.Errorf("the sweep has %d points, at most %d are allowed", pointCount, maxSweepPoints)
+	}
+
+	return axes, nil
+}
+
+// runSweepPoint runs the business simulation for one combination of parameter values
+func runSweepPoint(ctx context.Context, base BusinessSimulationRequest, axes []SweepAxis, values []float64) SweepPoint {
+	paths := make([]string, len(axes))
+	for i, axis := range axes {
+		paths[i] = axis.Path
+	}
+
+	req, err := applyParameterValues(base, paths, values)
+	if err != nil {
+		return SweepPoint{Values: values, Error: err.Error()}
+	}
+	response, err := runBusinessSimulation(ctx, req)
+	if err != nil {
+		return SweepPoint{Values: values, Error: err.Error()}
+	}
+
+	point := simulationOutcome(response, 0)
+	point.Values = values
+	return point
+}
+
+// applyParameterValues sets request fields by JSON path, keeping product sales ratios at 100% in total
+func applyParameterValues(base BusinessSimulationRequest, paths []string, values []float64) (BusinessSimulationRequest, error) {
+	overrides := make(map[string]interface{}, len(paths))
+	for i, path := range paths {
+		overrides[path] = values[i]
+	}
+	req, err := applyScenarioOverrides(base, overrides)
+	if err != nil {
+		return BusinessSimulationRequest{}, err
+	}
+	swept := make(map[int]bool)
+	for _, path := range paths {
+		if match := salesRatioPath.FindStringSubmatch(path); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			swept[index] = true
+		}
+	}
+	if len(swept) > 0 {
+		if err := rebalanceSalesRatios(req.Products, swept); err != nil {
+			return BusinessSimulationRequest{}, err
+		}
+	}
+	return req, nil
+}
+
+// companyMargin returns the company margin of the point, or 0 when it has none
+func (point SweepPoint) companyMargin() float64 {
+	if point.CompanyMargin == nil {
+		return 0
+	}
+	return *point.CompanyMargin
+}
+
+// simulationOutcome sums the revenue, volume and payout of a business simulation through the given
+// simulation cycle, or through the last cycle when it is 0. The company margin is only reported when
+// commissions were calculated, as the payout is then money rather than business volume.
+func simulationOutcome(response BusinessSimulationResponse, throughCycle int) SweepPoint {
+	var point SweepPoint
+
+	productPrices := make(map[int]float64)
+	for _, product := range response.Products {
+		productPrices[product.ID] = product.ProductPrice
+	}
+	for _, user := range response.Users {
+		if throughCycle > 0 && user.PayoutCycle > throughCycle {
+			continue
+		}
+		point.TotalUsers++
+		if user.ProductID != nil {
+			point.Revenue += productPrices[*user.ProductID]
+		}
+	}
+	for cycleNumber, cycle := range scenarioCycleMetrics(response) {
+		if throughCycle > 0 && cycleNumber > throughCycle {
+			continue
+		}
+		point.TotalVolume += cycle.Volume
+		point.TotalPayout += cycle.Payout
+	}
+
+	point.PayoutRatio = payoutPercentage(point.TotalPayout, point.TotalVolume)
+	if response.CommissionResults != nil && point.Revenue > 0 {
+		margin := (point.Revenue - point.TotalPayout) / point.Revenue * 100
+		point.CompanyMargin = &margin
+	}
+	return point
+}
+
+// rebalanceSalesRatios rescales the sales ratios of the products that are not fixed so all ratios
+// total 100%, leaving the fixed ratios as they are
+func rebalanceSalesRatios(products []BusinessProduct, fixed map[int]bool) error {
+	remaining := 100.0
+	others, otherCount := 0.0, 0
+	for i, product := range products {
+		if fixed[i] {
+			remaining -= product.ProductSalesRatio
+		} else {
+			others += product.ProductSalesRatio
+			otherCount++
+		}
+	}
+	if remaining < 0 {
+		return fmt.Errorf("the swept sales ratios total %g%%, more than 100%%", 100-remaining)
+	}
+
+	for i := range products {
+		if fixed[i] {
+			continue
+		}
+		if others > 0 {
+			products[i].ProductSalesRatio = products[i].ProductSalesRatio / others * remaining
+		} else {
+			products[i].ProductSalesRatio = remaining / float64(otherCount)
+		}
+	}
+	return nil
+}
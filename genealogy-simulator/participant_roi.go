@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sort"
+)
+
+// ParticipantROISummary aggregates the net position (earnings minus purchases) of all participants.
+// Participants are all members below the root account, except placeholders of removed members.
+type ParticipantROISummary struct {
+	ParticipantCount         int            `json:"participant_count"`
+	AtLossCount              int            `json:"at_loss_count"`
+	AtLossPercentage         float64        `json:"at_loss_percentage"`
+	BrokeEvenCount           int            `json:"broke_even_count"`
+	BrokeEvenPercentage      float64        `json:"broke_even_percentage"`
+	TotalPurchases           float64        `json:"total_purchases"`
+	TotalEarnings            float64        `json:"total_earnings"`
+	AverageNetPosition       float64        `json:"average_net_position"`
+	MedianNetPosition        float64        `json:"median_net_position"`
+	AverageCyclesToBreakEven float64        `json:"average_cycles_to_break_even"`
+	ByLevel                  []LevelROI     `json:"by_level"`
+	ByCycle                  []CycleROI     `json:"by_cycle"`
+	ByJoinCycle              []JoinCycleROI `json:"by_join_cycle"`
+}
+
+// LevelROI shows the net position of the participants at one depth of the genealogy
+type LevelROI struct {
+	Level              int     `json:"level"`
+	ParticipantCount   int     `json:"participant_count"`
+	AtLossCount        int     `json:"at_loss_count"`
+	AtLossPercentage   float64 `json:"at_loss_percentage"`
+	AveragePurchases   float64 `json:"average_purchases"`
+	AverageEarnings    float64 `json:"average_earnings"`
+	AverageNetPosition float64 `json:"average_net_position"`
+}
+
+// CycleROI shows the net position of the participants who have joined by the close of one cycle
+type CycleROI struct {
+	CycleNumber      int     `json:"cycle_number"`
+	ParticipantCount int     `json:"participant_count"`
+	AtLossCount      int     `json:"at_loss_count"`
+	AtLossPercentage float64 `json:"at_loss_percentage"`
+	NetPosition      float64 `json:"net_position"`
+}
+
+// JoinCycleROI shows the final net position of the participants who joined in one cycle
+type JoinCycleROI struct {
+	CycleNumber        int     `json:"cycle_number"`
+	ParticipantCount   int     `json:"participant_count"`
+	AtLossCount        int     `json:"at_loss_count"`
+	AtLossPercentage   float64 `json:"at_loss_percentage"`
+	AverageEarnings    float64 `json:"average_earnings"`
+	AverageNetPosition float64 `json:"average_net_position"`
+}
+
+// isParticipant reports whether a user counts as a participant: a member below the root account who
+// is not the placeholder of a removed member
+func isParticipant(user SimulationUser) bool {
+	if user.Level == 0 {
+		return false
+	}
+	return user.GenealogyNode == nil || user.GenealogyNode.Status != "placeholder"
+}
+
+// userPurchases returns what a user paid for their purchases: the recorded purchases of an imported
+// member, otherwise the price of their product. It reports false for users who bought nothing.
+func userPurchases(user SimulationUser, productPrices map[int]float64) (float64, bool) {
+	if user.GenealogyNode != nil && user.GenealogyNode.PurchaseVolume != nil {
+		return *user.GenealogyNode.PurchaseVolume, *user.GenealogyNode.PurchaseVolume > 0
+	}
+	if user.ProductID != nil {
+		return productPrices[*user.ProductID], true
+	}
+	return 0, false
+}
+
+// calculateParticipantROI tracks each participant's cumulative net position per cycle and the cycle
+// in which they break even, and aggregates the share of participants at a loss
+func calculateParticipantROI(users []SimulationUser, products []BusinessProduct, numberOfCycles int) *ParticipantROISummary {
+	productPrices := make(map[int]float64)
+	for _, product := range products {
+		productPrices[product.ID] = product.ProductPrice
+	}
+
+	summary := &ParticipantROISummary{
+		ByLevel:     make([]LevelROI, 0),
+		ByCycle:     make([]CycleROI, 0, numberOfCycles),
+		ByJoinCycle: make([]JoinCycleROI, 0, numberOfCycles),
+	}
+	levels := make(map[int]*LevelROI)
+	cycleStats := make([]CycleROI, numberOfCycles+1)
+	joinStats := make([]JoinCycleROI, numberOfCycles+1)
+	netPositions := make([]float64, 0, len(users))
+	cyclesToBreakEven := 0
+
+	for i := range users {
+		user := &users[i]
+		if !isParticipant(*user) {
+			continue
+		}
+
+		// Purchases are paid in the enrollment cycle
+		user.TotalPurchases, _ = userPurchases(*user, productPrices)
+
+		user.NetPositionPerCycle = make(map[int]float64)
+		user.BreakEvenCycle = nil
+		net := -user.TotalPurchases
+		for cycle := user.PayoutCycle; cycle <= numberOfCycles; cycle++ {
+			if cycle < 1 {
+				continue
+			}
+			net += user.EarningsPerCycle[cycle]
+			user.NetPositionPerCycle[cycle] = net
+			if net >= 0 && user.BreakEvenCycle == nil {
+				breakEvenCycle := cycle
+				user.BreakEvenCycle = &breakEvenCycle
+			}
+
+			cycleStats[cycle].ParticipantCount++
+			cycleStats[cycle].NetPosition += net
+			if net < 0 {
+				cycleStats[cycle].AtLossCount++
+			}
+		}
+		finalNet := user.TotalEarnings - user.TotalPurchases
+
+		summary.ParticipantCount++
+		summary.TotalPurchases += user.TotalPurchases
+		summary.TotalEarnings += user.TotalEarnings
+		netPositions = append(netPositions, finalNet)
+		if finalNet < 0 {
+			summary.AtLossCount++
+		}
+		if user.BreakEvenCycle != nil {
+			summary.BrokeEvenCount++
+			cyclesToBreakEven += *user.BreakEvenCycle - user.PayoutCycle
+		}
+
+		if user.PayoutCycle >= 1 && user.PayoutCycle <= numberOfCycles {
+			joined := &joinStats[user.PayoutCycle]
+			joined.ParticipantCount++
+			joined.AverageEarnings += user.TotalEarnings
+			joined.AverageNetPosition += finalNet
+			if finalNet < 0 {
+				joined.AtLossCount++
+			}
+		}
+
+		level, exists := levels[user.Level]
+		if !exists {
+			level = &LevelROI{Level: user.Level}
+			levels[user.Level] = level
+		}
+		level.ParticipantCount++
+		level.AveragePurchases += user.TotalPurchases
+		level.AverageEarnings += user.TotalEarnings
+		level.AverageNetPosition += finalNet
+		if finalNet < 0 {
+			level.AtLossCount++
+		}
+	}
+
+	if summary.ParticipantCount == 0 {
+		return summary
+	}
+
+	count := float64(summary.ParticipantCount)
+	summary.AtLossPercentage = float64(summary.AtLossCount) / count * 100
+	summary.BrokeEvenPercentage = float64(summary.BrokeEvenCount) / count * 100
+	summary.AverageNetPosition = (summary.TotalEarnings - summary.TotalPurchases) / count
+	sort.Float64s(netPositions)
+	summary.MedianNetPosition = percentileOf(netPositions, 50)
+	if summary.BrokeEvenCount > 0 {
+		summary.AverageCyclesToBreakEven = float64(cyclesToBreakEven) / float64(summary.BrokeEvenCount)
+	}
+
+	levelNumbers := make([]int, 0, len(levels))
+	for levelNumber := range levels {
+		levelNumbers = append(levelNumbers, levelNumber)
+	}
+	sort.Ints(levelNumbers)
+	for _, levelNumber := range levelNumbers {
+		level := levels[levelNumber]
+		levelCount := float64(level.ParticipantCount)
+		level.AtLossPercentage = float64(level.AtLossCount) / levelCount * 100
+		level.AveragePurchases /= levelCount
+		level.AverageEarnings /= levelCount
+		level.AverageNetPosition /= levelCount
+		summary.ByLevel = append(summary.ByLevel, *level)
+	}
+
+	for cycle := 1; cycle <= numberOfCycles; cycle++ {
+		stats := cycleStats[cycle]
+		stats.CycleNumber = cycle
+		if stats.ParticipantCount > 0 {
+			stats.AtLossPercentage = float64(stats.AtLossCount) / float64(stats.ParticipantCount) * 100
+		}
+		summary.ByCycle = append(summary.ByCycle, stats)
+
+		joined := joinStats[cycle]
+		joined.CycleNumber = cycle
+		if joined.ParticipantCount > 0 {
+			joinedCount := float64(joined.ParticipantCount)
+			joined.AtLossPercentage = float64(joined.AtLossCount) / joinedCount * 100
+			joined.AverageEarnings /= joinedCount
+			joined.AverageNetPosition /= joinedCount
+		}
+		summary.ByJoinCycle = append(summary.ByJoinCycle, joined)
+	}
+
+	return summary
+}
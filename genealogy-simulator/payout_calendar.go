@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// calendarDateLayout is the date format used for payout period boundaries
+const calendarDateLayout = "2006-01-02"
+
+// PayoutPeriod represents the calendar date range covered by one payout cycle
+type PayoutPeriod struct {
+	CycleNumber int    `json:"cycle_number"`
+	StartDate   string `json:"start_date"`
+	EndDate     string `json:"end_date"`
+	Days        int    `json:"days"`
+	BaseCycles  []int  `json:"base_cycles,omitempty"`
+}
+
+// PayoutScheduleConfig requests an additional payout frequency laid over the simulation cycles
+type PayoutScheduleConfig struct {
+	Name      string `json:"name"`       // e.g. "binary", "unilevel"
+	CycleType string `json:"cycle_type"` // weekly, biweekly, monthly, quarterly
+}
+
+// PayoutSchedule lists the calendar periods of one payout frequency and the simulation cycles rolled into each
+type PayoutSchedule struct {
+	Name      string         `json:"name"`
+	CycleType string         `json:"cycle_type"`
+	Periods   []PayoutPeriod `json:"periods"`
+}
+
+// PayoutCalendar maps integer payout cycles onto calendar dates
+type PayoutCalendar struct {
+	CycleType string
+	StartDate time.Time
+}
+
+// NewPayoutCalendar creates a calendar for the given cycle type and start date (YYYY-MM-DD).
+// It returns nil without error when no start date is given, in which case cycles stay undated.
+func NewPayoutCalendar(cycleType, startDate string) (*PayoutCalendar, error) {
+	if startDate == "" {
+		return nil, nil
+	}
+
+	cycleType = normalizeCycleType(cycleType)
+	if _, ok := cycleTypeNominalDays[cycleType]; !ok {
+		return nil, fmt.Errorf("unsupported payout cycle type %q (expected weekly, biweekly, monthly or quarterly)", cycleType)
+	}
+
+	start, err := time.Parse(calendarDateLayout, startDate)
+	if err != nil {
+		return nil, fmt.Errorf("start_date must be formatted as YYYY-MM-DD: %v", err)
+	}
+
+	return &PayoutCalendar{CycleType: cycleType, StartDate: start}, nil
+}
+
+// cycleTypeNominalDays gives the approximate length of each cycle type, used to order frequencies
+var cycleTypeNominalDays = map[string]int{
+	"weekly":    7,
+	"biweekly":  14,
+	"monthly":   30,
+	"quarterly": 91,
+}
+
+// normalizeCycleType lower-cases a cycle type and accepts the "bi-weekly" spelling
+func normalizeCycleType(cycleType string) string {
+	cycleType = strings.ToLower(strings.TrimSpace(cycleType))
+	if cycleType == "bi-weekly" {
+		return "biweekly"
+	}
+	return cycleType
+}
+
+// Period returns the first and last calendar day of the given 1-based cycle
+func (c *PayoutCalendar) Period(cycle int) (time.Time, time.Time) {
+	start := c.cycleStart(cycle)
+	end := c.cycleStart(cycle+1).AddDate(0, 0, -1)
+	return start, end
+}
+
+// PayoutPeriod returns the dated period for the given cycle
+func (c *PayoutCalendar) PayoutPeriod(cycle int) PayoutPeriod {
+	start, end := c.Period(cycle)
+	return PayoutPeriod{
+		CycleNumber: cycle,
+		StartDate:   start.Format(calendarDateLayout),
+		EndDate:     end.Format(calendarDateLayout),
+		Days:        int(end.Sub(start).Hours()/24) + 1,
+	}
+}
+
+// Periods returns the dated periods for cycles 1..numberOfCycles
+func (c *PayoutCalendar) Periods(numberOfCycles int) []PayoutPeriod {
+	periods := make([]PayoutPeriod, 0, numberOfCycles)
+	for cycle := 1; cycle <= numberOfCycles; cycle++ {
+		periods = append(periods, c.PayoutPeriod(cycle))
+	}
+	return periods
+}
+
+// CycleOf returns the 1-based cycle containing the given date; dates before the start are in cycle 1
+func (c *PayoutCalendar) CycleOf(date time.Time) int {
+	days := int(date.Sub(c.StartDate).Hours() / 24)
+	cycle := 1 + days/cycleTypeNominalDays[c.CycleType]
+	if cycle < 1 {
+		return 1
+	}
+	for cycle > 1 && c.cycleStart(cycle).After(date) {
+		cycle--
+	}
+	for !c.cycleStart(cycle + 1).After(date) {
+		cycle++
+	}
+	return cycle
+}
+
+// cycleStart returns the first day of the given 1-based cycle
+func (c *PayoutCalendar) cycleStart(cycle int) time.Time {
+	switch c.CycleType {
+	case "weekly":
+		return c.StartDate.AddDate(0, 0, 7*(cycle-1))
+	case "biweekly":
+		return c.StartDate.AddDate(0, 0, 14*(cycle-1))
+	case "quarterly":
+		return addMonthsClamped(c.StartDate, 3*(cycle-1))
+	default:
+		return addMonthsClamped(c.StartDate, cycle-1)
+	}
+}
+
+// addMonthsClamped adds months to a date, clamping the day to the end of shorter months
+// (Jan 31 + 1 month = Feb 28/29 rather than Mar 3)
+func addMonthsClamped(t time.Time, months int) time.Time {
+	firstOfMonth := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).AddDate(0, months, 0)
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstOfMonth.Year(), firstOfMonth.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// IsFinerThan reports whether this calendar's cycles are shorter than the given cycle type
+func (c *PayoutCalendar) IsFinerThan(cycleType string) bool {
+	return cycleTypeNominalDays[c.CycleType] < cycleTypeNominalDays[normalizeCycleType(cycleType)]
+}
+
+// Schedule rolls cycles 1..numberOfCycles of this calendar into the periods of a coarser frequency.
+// Each cycle is assigned to the period containing its end date, which is when it would be paid.
+func (c *PayoutCalendar) Schedule(config PayoutScheduleConfig, numberOfCycles int) (PayoutSchedule, error) {
+	cycleType := normalizeCycleType(config.CycleType)
+	if _, ok := cycleTypeNominalDays[cycleType]; !ok {
+		return PayoutSchedule{}, fmt.Errorf("payout schedule %q has unsupported cycle type %q", config.Name, config.CycleType)
+	}
+	if cycleTypeNominalDays[cycleType] < cycleTypeNominalDays[c.CycleType] {
+		return PayoutSchedule{}, fmt.Errorf("payout schedule %q (%s) is finer than the simulation payout cycle (%s)", config.Name, cycleType, c.CycleType)
+	}
+
+	coarse := &PayoutCalendar{CycleType: cycleType, StartDate: c.StartDate}
+	periods := make([]PayoutPeriod, 0)
+	period := coarse.PayoutPeriod(1)
+	_, periodEnd := coarse.Period(1)
+
+	for cycle := 1; cycle <= numberOfCycles; cycle++ {
+		_, cycleEnd := c.Period(cycle)
+		for cycleEnd.After(periodEnd) {
+			periods = append(periods, period)
+			period = coarse.PayoutPeriod(period.CycleNumber + 1)
+			_, periodEnd = coarse.Period(period.CycleNumber)
+		}
+		period.BaseCycles = append(period.BaseCycles, cycle)
+	}
+	if len(period.BaseCycles) > 0 {
+		periods = append(periods, period)
+	}
+
+	return PayoutSchedule{
+		Name:      config.Name,
+		CycleType: cycleType,
+		Periods:   periods,
+	}, nil
+}
+
+// validatePayoutSchedules checks the calendar settings of a simulation before it runs
+func validatePayoutSchedules(calendar *PayoutCalendar, schedules []PayoutScheduleConfig) error {
+	if len(schedules) == 0 {
+		return nil
+	}
+	if calendar == nil {
+		return fmt.Errorf("start_date is required when payout_schedules are given")
+	}
+	for _, schedule := range schedules {
+		if _, err := calendar.Schedule(schedule, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPayoutCalendar dates every cycle of a simulation response and attaches the requested payout schedules
+func applyPayoutCalendar(response *SimulationResponse, calendar *PayoutCalendar, schedules []PayoutScheduleConfig) error {
+	if calendar == nil {
+		return nil
+	}
+
+	response.StartDate = calendar.StartDate.Format(calendarDateLayout)
+	response.Calendar = calendar.Periods(response.NumberOfCycles)
+
+	for i := range response.Cycles {
+		period := calendar.PayoutPeriod(response.Cycles[i].CycleNumber)
+		response.Cycles[i].StartDate = period.StartDate
+		response.Cycles[i].EndDate = period.EndDate
+	}
+
+	for _, config := range schedules {
+		schedule, err := calendar.Schedule(config, response.NumberOfCycles)
+		if err != nil {
+			return err
+		}
+		response.PayoutSchedules = append(response.PayoutSchedules, schedule)
+	}
+
+	return nil
+}
+
+// attachCycleDates copies the calendar dates of each simulated cycle onto the payout cycle volumes
+func attachCycleDates(volumeByPayoutCycle map[int]PayoutCycleVolume, cycles []CycleData) {
+	for _, cycle := range cycles {
+		if volume, exists := volumeByPayoutCycle[cycle.CycleNumber]; exists {
+			volume.StartDate = cycle.StartDate
+			volume.EndDate = cycle.EndDate
+			volumeByPayoutCycle[cycle.CycleNumber] = volume
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Page layout of the PDF report, in points: A4 landscape so the cycle table fits
+const (
+	pdfPageWidth  = 841.89
+	pdfPageHeight = 595.28
+	pdfMargin     = 40.0
+	pdfTableFont  = 8.0
+	pdfRowHeight  = 14.0
+)
+
+// helveticaWidths are the widths of the printable ASCII characters of Helvetica, in thousandths of
+// the font size, used to right-align and wrap text
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfWinAnsi maps the characters outside Latin-1 that the WinAnsi encoding of the standard fonts has
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// pdfDocument builds a PDF with the standard Helvetica fonts, drawing top down in points from the
+// top left corner of the page
+type pdfDocument struct {
+	pages []*bytes.Buffer // content stream of each page
+	page  *bytes.Buffer
+	y     float64 // top of the next block on the current page
+}
+
+// newPDFDocument starts a document with an empty first page
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.addPage()
+	return d
+}
+
+// addPage starts a new page and moves to its top
+func (d *pdfDocument) addPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+	d.y = pdfMargin
+}
+
+// ensure starts a new page unless height fits below the current position
+func (d *pdfDocument) ensure(height float64) {
+	if d.y+height > pdfPageHeight-pdfMargin {
+		d.addPage()
+	}
+}
+
+// text draws text with its baseline at y
+func (d *pdfDocument) text(x, y, size float64, bold bool, colour, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page, "BT /%s %.1f Tf %s rg %.2f %.2f Td (%s) Tj ET\n", font, size, pdfColour(colour), x, pdfPageHeight-y, pdfString(text))
+}
+
+// textRight draws text ending at x
+func (d *pdfDocument) textRight(x, y, size float64, bold bool, colour, text string) {
+	d.text(x-pdfTextWidth(text, size), y, size, bold, colour, text)
+}
+
+// rect fills a rectangle
+func (d *pdfDocument) rect(x, y, width, height float64, colour string) {
+	fmt.Fprintf(d.page, "%s rg %.2f %.2f %.2f %.2f re f\n", pdfColour(colour), x, pdfPageHeight-y-height, width, height)
+}
+
+// line strokes a line through the points, given as x, y pairs
+func (d *pdfDocument) line(colour string, width float64, points ...float64) {
+	fmt.Fprintf(d.page, "%s RG %.2f w", pdfColour(colour), width)
+	for i := 0; i+1 < len(points); i += 2 {
+		operator := "l"
+		if i == 0 {
+			operator = "m"
+		}
+		fmt.Fprintf(d.page, " %.2f %.2f %s", points[i], pdfPageHeight-points[i+1], operator)
+	}
+	d.page.WriteString(" S\n")
+}
+
+// write writes the document: catalog, page tree, the two fonts, then each page and its content
+func (d *pdfDocument) write(w io.Writer) error {
+	var out bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := out.WriteTo(w)
+	return err
+}
+
+// pdfColour converts a #rrggbb colour to PDF colour components
+func pdfColour(colour string) string {
+	value, err := strconv.ParseUint(strings.TrimPrefix(colour, "#"), 16, 32)
+	if err != nil {
+		value = 0
+	}
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(value>>16&0xff)/255, float64(value>>8&0xff)/255, float64(value&0xff)/255)
+}
+
+// pdfString encodes text as the body of a PDF literal string in WinAnsi; other characters become ?
+func pdfString(text string) string {
+	var encoded strings.Builder
+	for _, r := range text {
+		var b byte
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			encoded.WriteByte('\\')
+			b = byte(r)
+		case r >= 0x20 && r < 0x7f || r >= 0xa0 && r <= 0xff:
+			b = byte(r)
+		case pdfWinAnsi[r] != 0:
+			b = pdfWinAnsi[r]
+		default:
+			b = '?'
+		}
+		encoded.WriteByte(b)
+	}
+	return encoded.String()
+}
+
+// pdfTextWidth estimates the width of text in Helvetica; characters outside ASCII count as wide as n
+func pdfTextWidth(text string, size float64) float64 {
+	width := 0
+	for _, r := range text {
+		if r >= 32 && r < 127 {
+			width += helveticaWidths[r-32]
+		} else {
+			width += 556
+		}
+	}
+	return float64(width) * size / 1000
+}
+
+// fitPDFText shortens text to fit the width, marking the cut with an ellipsis
+func fitPDFText(text string, size, width float64) string {
+	if pdfTextWidth(text, size) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"…", size) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// wrapPDFText breaks text into lines that fit the width
+func wrapPDFText(text string, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && pdfTextWidth(candidate, size) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// heading draws a section heading with a rule below it, keeping room for some of the section
+func (d *pdfDocument) heading(title string) {
+	d.ensure(60)
+	d.y += 14
+	d.text(pdfMargin, d.y, 13, true, "#1d252c", title)
+	d.y += 5
+	d.line("#4e79a7", 1.5, pdfMargin, d.y, pdfPageWidth-pdfMargin, d.y)
+	d.y += 8
+}
+
+// table draws a table with a shaded header, repeated on each page it spans, and an optional bold
+// footer. Columns share the page width in proportion to their widest cell; the first column and
+// those in leftAligned are aligned left, the others right.
+func (d *pdfDocument) table(header []string, rows [][]string, footer []string, leftAligned map[int]bool, width float64) {
+	widths := make([]float64, len(header))
+	measure := func(cells []string) {
+		for i, cell := range cells {
+			if i < len(widths) {
+				widths[i] = math.Max(widths[i], pdfTextWidth(cell, pdfTableFont)+10)
+			}
+		}
+	}
+	measure(header)
+	for _, row := range rows {
+		measure(row)
+	}
+	measure(footer)
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	if total > width || len(header) > 4 {
+		for i := range widths {
+			widths[i] *= width / total
+		}
+	}
+
+	drawRow := func(cells []string, bold bool, fill string) {
+		if fill != "" {
+			d.rect(pdfMargin, d.y, width, pdfRowHeight, fill)
+		}
+		x := pdfMargin
+		for i, cell := range cells {
+			if i >= len(widths) {
+				break
+			}
+			cell = fitPDFText(cell, pdfTableFont, widths[i]-8)
+			if i == 0 || leftAligned[i] {
+				d.text(x+4, d.y+10, pdfTableFont, bold, "#1d252c", cell)
+			} else {
+				d.textRight(x+widths[i]-4, d.y+10, pdfTableFont, bold, "#1d252c", cell)
+			}
+			x += widths[i]
+		}
+		d.y += pdfRowHeight
+		d.line("#d5dade", 0.5, pdfMargin, d.y, pdfMargin+width, d.y)
+	}
+
+	d.ensure(3 * pdfRowHeight)
+	drawRow(header, true, "#f1f3f5")
+	for _, row := range rows {
+		if d.y+pdfRowHeight > pdfPageHeight-pdfMargin {
+			d.addPage()
+			drawRow(header, true, "#f1f3f5")
+		}
+		drawRow(row, false, "")
+	}
+	if footer != nil {
+		d.ensure(pdfRowHeight)
+		drawRow(footer, true, "#f8f9fa")
+	}
+}
+
+// chart draws a bar or line chart the same way chartSVG does
+func (d *pdfDocument) chart(chart reportChart) {
+	const height, left, bottom, top = 200.0, 56.0, 20.0, 24.0
+	width := pdfPageWidth - 2*pdfMargin
+	d.ensure(height)
+	originY := d.y
+	plotLeft, plotWidth, plotHeight := pdfMargin+left, width-left, height-top-bottom
+	plotBottom := originY + top + plotHeight
+	maximum := chartMaximum(chart)
+	count := len(chart.Labels)
+
+	for s, series := range chart.Series {
+		x := plotLeft + float64(s)*110
+		d.rect(x, originY+4, 8, 8, series.Colour)
+		d.text(x+12, originY+11, 8, false, "#333333", series.Name)
+	}
+	for i := 0; i <= 4; i++ {
+		y := plotBottom - plotHeight*float64(i)/4
+		d.line("#e3e6ea", 0.5, plotLeft, y, plotLeft+plotWidth, y)
+		d.textRight(plotLeft-4, y+3, 7, false, "#5f6b76", formatReportInt(int(math.Round(maximum*float64(i)/4))))
+	}
+
+	step := plotWidth / math.Max(float64(count), 1)
+	labelEvery := int(math.Ceil(float64(count) / 24))
+	for i, label := range chart.Labels {
+		if i%labelEvery == 0 {
+			x := plotLeft + step*(float64(i)+0.5)
+			d.text(x-pdfTextWidth(label, 7)/2, plotBottom+11, 7, false, "#5f6b76", label)
+		}
+	}
+
+	for s, series := range chart.Series {
+		if chart.Kind == "bar" {
+			barWidth := step * 0.7 / float64(len(chart.Series))
+			for i, value := range series.Values {
+				barHeight := plotHeight * value / maximum
+				d.rect(plotLeft+step*float64(i)+step*0.15+barWidth*float64(s), plotBottom-barHeight, barWidth, barHeight, series.Colour)
+			}
+			continue
+		}
+		points := make([]float64, 0, 2*len(series.Values))
+		for i, value := range series.Values {
+			points = append(points, plotLeft+step*(float64(i)+0.5), plotBottom-plotHeight*value/maximum)
+		}
+		if len(points) == 2 {
+			points = append(points, points[0]+0.5, points[1])
+		}
+		d.line(series.Colour, 1.5, points...)
+	}
+	d.y = originY + height
+}
+
+// renderReportPDF lays the report out as a printable PDF with numbered pages
+func renderReportPDF(w io.Writer, report *simulationReport) error {
+	d := newPDFDocument()
+	contentWidth := pdfPageWidth - 2*pdfMargin
+
+	d.text(pdfMargin, d.y+18, 20, true, "#1d252c", report.Title)
+	d.text(pdfMargin, d.y+34, 9, false, "#5f6b76", "Generated "+report.GeneratedAt)
+	d.y += 40
+
+	d.heading("Plan parameters")
+	parameterRows := make([][]string, len(report.Parameters))
+	for i, parameter := range report.Parameters {
+		parameterRows[i] = []string{parameter[0], parameter[1]}
+	}
+	d.table([]string{"Parameter", "Value"}, parameterRows, nil, map[int]bool{1: true}, 360)
+
+	d.heading("Product mix")
+	productRows := make([][]string, len(report.Products))
+	for i, product := range report.Products {
+		productRows[i] = []string{product.Name, product.Price, product.Volume, product.SalesRatio, product.Users, product.Share, product.TotalBV}
+	}
+	d.table([]string{"Product", "Price", "Business volume", "Sales ratio", "Users", "Share of users", "Total volume"}, productRows, nil, nil, contentWidth)
+
+	d.heading("Volume and payout by cycle")
+	d.table(report.CycleHeader, report.Cycles, report.Totals, map[int]bool{1: true}, contentWidth)
+
+	if len(report.Commissions) > 0 {
+		d.heading("Commissions and bonus pools")
+		commissionRows := make([][]string, len(report.Commissions))
+		for i, commission := range report.Commissions {
+			commissionRows[i] = []string{commission.Name, commission.Type, commission.PayoutCycle, commission.TotalPayout}
+		}
+		d.table([]string{"Name", "Type", "Paid", "Total payout"}, commissionRows, nil, map[int]bool{1: true, 2: true}, 420)
+	}
+
+	for _, chart := range report.Charts {
+		d.heading(chart.Title)
+		d.chart(chart)
+	}
+
+	d.heading("Methodology")
+	for _, paragraph := range report.Methodology {
+		for _, line := range wrapPDFText(paragraph, 9, contentWidth) {
+			d.ensure(13)
+			d.text(pdfMargin, d.y+10, 9, false, "#1d252c", line)
+			d.y += 13
+		}
+		d.y += 3
+	}
+
+	for i, page := range d.pages {
+		d.page = page
+		d.textRight(pdfPageWidth-pdfMargin, pdfPageHeight-pdfMargin/2, 8, false, "#5f6b76", fmt.Sprintf("Page %d of %d", i+1, len(d.pages)))
+	}
+	return d.write(w)
+}
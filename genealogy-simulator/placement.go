@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// placementRules are the child placement rules of a genealogy type
+type placementRules struct {
+	maxChildren int      // 0 allows any number of children
+	positions   []string // child slots in order, e.g. left, right; empty when children are simply appended
+}
+
+// placementRulesFor reads the placement rules of a genealogy type. Slots come from the
+// child_positions rule, defaulting to left and right for binary types; the child limit is
+// max_children_per_node, further limited by the number of slots.
+func placementRulesFor(genealogyType *GenealogyType) placementRules {
+	rules := placementRules{maxChildren: genealogyType.MaxChildrenPerNode}
+
+	if configured, ok := genealogyType.Rules["child_positions"].([]interface{}); ok {
+		for _, position := range configured {
+			if name, ok := position.(string); ok && name != "" {
+				rules.positions = append(rules.positions, strings.ToLower(name))
+			}
+		}
+	}
+	if len(rules.positions) == 0 {
+		if planKind, _ := resolvePlanKind(genealogyType, 0); planKind == "binary" {
+			rules.positions = []string{"left", "right"}
+		}
+	}
+	if len(rules.positions) > 0 && (rules.maxChildren <= 0 || rules.maxChildren > len(rules.positions)) {
+		rules.maxChildren = len(rules.positions)
+	}
+	return rules
+}
+
+// slot returns the order of a position among the children; positions without a slot sort after all slots
+func (p placementRules) slot(position string) int {
+	for i, slot := range p.positions {
+		if slot == position {
+			return i
+		}
+	}
+	return len(p.positions)
+}
+
+// choose validates the requested position for a new child of parent (its ID or label), given the
+// positions its other children hold, and returns the position to use. An empty request takes the
+// first free slot.
+func (p placementRules) choose(parent interface{}, taken []string, requested string) (string, error) {
+	if p.maxChildren > 0 && len(taken) >= p.maxChildren {
+		return "", newPlacementError(http.StatusConflict, "parent %v is full: it already has the maximum of %d children", parent, p.maxChildren)
+	}
+
+	if len(p.positions) == 0 {
+		if requested != "" && requested != "child" {
+			return "", newPlacementError(http.StatusBadRequest, "position must be child or empty for this genealogy type")
+		}
+		return "child", nil
+	}
+
+	isTaken := make(map[string]bool, len(taken))
+	for _, position := range taken {
+		isTaken[position] = true
+	}
+	requested = strings.ToLower(requested)
+	if requested == "" {
+		for _, slot := range p.positions {
+			if !isTaken[slot] {
+				return slot, nil
+			}
+		}
+		return "", newPlacementError(http.StatusConflict, "parent %v has no free position", parent)
+	}
+	if p.slot(requested) == len(p.positions) {
+		return "", newPlacementError(http.StatusBadRequest, "position must be one of %s", strings.Join(p.positions, ", "))
+	}
+	if isTaken[requested] {
+		return "", newPlacementError(http.StatusConflict, "the %s position under parent %v is already taken", requested, parent)
+	}
+	return requested, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// volumeBreakdownSections are the per-user volume breakdowns of the volume calculations
+var volumeBreakdownSections = []string{
+	"volume_calculations.personal_volume_breakdown",
+	"volume_calculations.team_volume_breakdown",
+	"volume_calculations.leg_volume_breakdown",
+}
+
+// detailExclusions lists the response paths each detail level leaves out. Paths through a list
+// apply to every element, e.g. users.genealogy_node.
+var detailExclusions = map[string][]string{
+	"summary": {"users", "genealogy_structure", "volume_calculations"},
+	"cycles":  append([]string{"users", "genealogy_structure"}, volumeBreakdownSections...),
+	"users": append([]string{
+		"users.genealogy_node",
+		"users.personal_volume_per_cycle",
+		"users.leg_volume_per_cycle",
+		"users.team_volume_per_cycle",
+		"users.volume_generation_per_cycle",
+		"users.net_position_per_cycle",
+	}, volumeBreakdownSections...),
+	"full": {},
+}
+
+// responseShape selects the parts of a business simulation response to return
+type responseShape struct {
+	detail string
+	fields []string // dotted paths to keep; empty keeps everything the detail level allows
+}
+
+// parseResponseShape reads the detail (summary, cycles, users or full) and fields query parameters.
+// Fields is a comma-separated list of paths such as simulation_summary,users.id,users.total_earnings.
+func parseResponseShape(r *http.Request) (responseShape, error) {
+	shape := responseShape{detail: r.URL.Query().Get("detail")}
+	if shape.detail == "" {
+		shape.detail = "full"
+	}
+	if _, exists := detailExclusions[shape.detail]; !exists {
+		return responseShape{}, fmt.Errorf("detail must be summary, cycles, users or full")
+	}
+
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			shape.fields = append(shape.fields, field)
+		}
+	}
+	return shape, nil
+}
+
+// isFull reports whether the shape returns the response unchanged
+func (s responseShape) isFull() bool {
+	return s.detail == "full" && len(s.fields) == 0
+}
+
+// prepare skips computing the volume breakdowns when the shape leaves them out
+func (s responseShape) prepare(req *BusinessSimulationRequest) {
+	if !s.includes("volume_calculations.team_volume_breakdown") &&
+		!s.includes("volume_calculations.personal_volume_breakdown") &&
+		!s.includes("volume_calculations.leg_volume_breakdown") {
+		req.SkipVolumeBreakdowns = true
+	}
+}
+
+// includes reports whether the shape returns the given path or any part of it
+func (s responseShape) includes(path string) bool {
+	for _, excluded := range detailExclusions[s.detail] {
+		if path == excluded || strings.HasPrefix(path, excluded+".") {
+			return false
+		}
+	}
+	if len(s.fields) == 0 {
+		return true
+	}
+	for _, field := range s.fields {
+		if path == field || strings.HasPrefix(path, field+".") || strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// shapedResponse is a business simulation response with the sections a detail level leaves out
+// omitted. Its fields shadow those of the embedded response.
+type shapedResponse struct {
+	BusinessSimulationResponse
+	Users              interface{} `json:"users,omitempty"`
+	GenealogyStructure interface{} `json:"genealogy_structure,omitempty"`
+	VolumeCalculations interface{} `json:"volume_calculations,omitempty"`
+}
+
+// shapedUser is a user without the per-cycle maps and genealogy node the users detail level leaves
+// out. The nil fields shadow those of the embedded user and are omitted.
+type shapedUser struct {
+	*SimulationUser
+	GenealogyNode            *struct{} `json:"genealogy_node,omitempty"`
+	PersonalVolumePerCycle   *struct{} `json:"personal_volume_per_cycle,omitempty"`
+	LegVolumePerCycle        *struct{} `json:"leg_volume_per_cycle,omitempty"`
+	TeamVolumePerCycle       *struct{} `json:"team_volume_per_cycle,omitempty"`
+	VolumeGenerationPerCycle *struct{} `json:"volume_generation_per_cycle,omitempty"`
+	NetPositionPerCycle      *struct{} `json:"net_position_per_cycle,omitempty"`
+}
+
+// cycleVolumeCalculations are the volume calculations without the per-user breakdowns
+type cycleVolumeCalculations struct {
+	VolumeByPayoutCycle    map[int]PayoutCycleVolume `json:"volume_by_payout_cycle"`
+	CalculationMethodology string                    `json:"calculation_methodology"`
+}
+
+// apply returns the shaped response, ready to be encoded as JSON. Detail levels leave sections out
+// of the response itself so it is encoded once; field selections go through a decoded document.
+func (s responseShape) apply(response BusinessSimulationResponse) (interface{}, error) {
+	if s.isFull() {
+		return response, nil
+	}
+	if len(s.fields) == 0 {
+		return s.applyDetail(response), nil
+	}
+
+	// Drop the largest sections before encoding when they are not wanted
+	if !s.includes("users") {
+		response.Users = nil
+	}
+	if !s.includes("volume_calculations") {
+		response.VolumeCalculations = VolumeCalculations{}
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber() // keep large integers such as the seed exact
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	for _, path := range detailExclusions[s.detail] {
+		removeJSONPath(document, strings.Split(path, "."))
+	}
+	if len(s.fields) == 0 {
+		return document, nil
+	}
+
+	selection := make(fieldSelection)
+	for _, field := range s.fields {
+		selection.add(strings.Split(field, "."))
+	}
+	return selection.apply(document), nil
+}
+
+// applyDetail leaves out the sections excluded by the detail level
+func (s responseShape) applyDetail(response BusinessSimulationResponse) shapedResponse {
+	shaped := shapedResponse{BusinessSimulationResponse: response}
+
+	switch {
+	case !s.includes("users"):
+	case !s.includes("users.genealogy_node"):
+		users := make([]shapedUser, len(response.Users))
+		for i := range response.Users {
+			users[i] = shapedUser{SimulationUser: &response.Users[i]}
+		}
+		shaped.Users = users
+	default:
+		shaped.Users = response.Users
+	}
+
+	if s.includes("genealogy_structure") {
+		shaped.GenealogyStructure = response.GenealogyStructure
+	}
+
+	switch {
+	case !s.includes("volume_calculations"):
+	case !s.includes("volume_calculations.team_volume_breakdown"):
+		shaped.VolumeCalculations = cycleVolumeCalculations{
+			VolumeByPayoutCycle:    response.VolumeCalculations.VolumeByPayoutCycle,
+			CalculationMethodology: response.VolumeCalculations.CalculationMethodology,
+		}
+	default:
+		shaped.VolumeCalculations = response.VolumeCalculations
+	}
+
+	return shaped
+}
+
+// removeJSONPath deletes a path from a decoded JSON document, descending into every element of lists
+func removeJSONPath(value interface{}, path []string) {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(container, path[0])
+			return
+		}
+		if next, exists := container[path[0]]; exists {
+			removeJSONPath(next, path[1:])
+		}
+	case []interface{}:
+		for _, element := range container {
+			removeJSONPath(element, path)
+		}
+	}
+}
+
+// fieldSelection is a tree of selected JSON keys; a key without children selects its whole value
+type fieldSelection map[string]fieldSelection
+
+// add selects a path
+func (f fieldSelection) add(path []string) {
+	child, exists := f[path[0]]
+	if len(path) == 1 {
+		// Selecting a whole value overrides any narrower selection
+		f[path[0]] = nil
+		return
+	}
+	if exists && child == nil {
+		return
+	}
+	if child == nil {
+		child = make(fieldSelection)
+		f[path[0]] = child
+	}
+	child.add(path[1:])
+}
+
+// apply keeps the selected keys of a decoded JSON value, applying the selection to every element of lists
+func (f fieldSelection) apply(value interface{}) interface{} {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		selected := make(map[string]interface{}, len(f))
+		for key, child := range f {
+			if next, exists := container[key]; exists {
+				if child == nil {
+					selected[key] = next
+				} else {
+					selected[key] = child.apply(next)
+				}
+			}
+		}
+		return selected
+	case []interface{}:
+		selected := make([]interface{}, len(container))
+		for i, element := range container {
+			selected[i] = f.apply(element)
+		}
+		return selected
+	default:
+		return value
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScenarioVariants limits the number of variants compared in one request
+const maxScenarioVariants = 10
+
+// ScenarioComparisonRequest compares variants of a base business simulation
+type ScenarioComparisonRequest struct {
+	Base     BusinessSimulationRequest `json:"base"`
+	Variants []ScenarioVariant         `json:"variants"`
+}
+
+// ScenarioVariant overrides fields of the base request by their JSON path,
+// e.g. "payout_cap", "products.0.business_volume" or "commissions.1.percentage"
+type ScenarioVariant struct {
+	Name      string                 `json:"name"`
+	Overrides map[string]interface{} `json:"overrides"`
+}
+
+// ScenarioCycleMetrics holds the key metrics of one scenario in one simulation cycle
+type ScenarioCycleMetrics struct {
+	Volume           float64 `json:"volume"`         // personal volume generated
+	MatchedVolume    float64 `json:"matched_volume"` // binary matched volume
+	Payout           float64 `json:"payout"`         // commission payout, or capped matched volume without commissions
+	PayoutPercentage float64 `json:"payout_percentage"`
+	Flush            float64 `json:"flush"` // volume or payout lost to caps and unqualified pools
+}
+
+// ScenarioCycleRow shows a scenario's metrics in one cycle and their difference from the base
+type ScenarioCycleRow struct {
+	CycleNumber int `json:"cycle_number"`
+	ScenarioCycleMetrics
+	Delta ScenarioCycleMetrics `json:"delta"`
+}
+
+// ScenarioResult shows one scenario of a comparison
+type ScenarioResult struct {
+	Name       string                 `json:"name"`
+	Overrides  map[string]interface{} `json:"overrides,omitempty"`
+	TotalUsers int                    `json:"total_users"`
+	Totals     ScenarioCycleRow       `json:"totals"`
+	Cycles     []ScenarioCycleRow     `json:"cycles"`
+}
+
+// ScenarioComparisonResponse is the diff table of a scenario comparison
+type ScenarioComparisonResponse struct {
+	Seed      int64            `json:"seed"`
+	Base      ScenarioResult   `json:"base"`
+	Variants  []ScenarioResult `json:"variants"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// handleCompareScenarios runs a base business simulation and its variants with a shared seed.
+// Invalid requests are rejected before any simulation runs; the comparison stops when the client disconnects.
+func handleCompareScenarios(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	log.Println("Received scenario comparison request")
+
+	var req ScenarioComparisonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	response, err := compareScenarios(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Scenario comparison cancelled: %v", err)
+			return
+		}
+		log.Printf("Scenario comparison error: %v", err)
+		status := placementErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			http.Error(w, "Internal server error", status)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Scenario comparison completed with %d variants", len(response.Variants))
+}
+
+// compareScenarios runs the base request and each variant with the same seed and diffs their metrics.
+// Invalid requests fail with a placement error reported as 400; other errors are internal.
+func compareScenarios(ctx context.Context, req ScenarioComparisonRequest) (*ScenarioComparisonResponse, error) {
+	if len(req.Variants) == 0 {
+		return nil, newPlacementError(http.StatusBadRequest, "at least one variant is required")
+	}
+	if len(req.Variants) > maxScenarioVariants {
+		return nil, newPlacementError(http.StatusBadRequest, "at most %d variants can be compared", maxScenarioVariants)
+	}
+
+	base := req.Base
+	if base.Seed == 0 {
+		base.Seed = time.Now().UnixNano()
+	}
+
+	// Build and validate every variant up front so a bad request fails before anything runs
+	if err := validateScenarioRequest(base); err != nil {
+		return nil, scenarioError("base", err)
+	}
+	variantRequests := make([]BusinessSimulationRequest, len(req.Variants))
+	for i, variant := range req.Variants {
+		label := scenarioLabel(variant.Name, i)
+		variantReq, err := applyScenarioOverrides(base, variant.Overrides)
+		if err != nil {
+			return nil, newPlacementError(http.StatusBadRequest, "variant %s: %v", label, err)
+		}
+		if err := validateScenarioRequest(variantReq); err != nil {
+			return nil, scenarioError("variant "+label, err)
+		}
+		variantRequests[i] = variantReq
+	}
+
+	baseResponse, err := runBusinessSimulation(ctx, base)
+	if err != nil {
+		return nil, scenarioError("base", err)
+	}
+	baseMetrics := scenarioCycleMetrics(baseResponse)
+
+	response := &ScenarioComparisonResponse{
+		Seed:      base.Seed,
+		Base:      buildScenarioResult("base", nil, baseResponse, baseMetrics, baseMetrics),
+		Variants:  make([]ScenarioResult, 0, len(req.Variants)),
+		CreatedAt: time.Now(),
+	}
+
+	for i, variant := range req.Variants {
+		label := scenarioLabel(variant.Name, i)
+		variantResponse, err := runBusinessSimulation(ctx, variantRequests[i])
+		if err != nil {
+			return nil, scenarioError("variant "+label, err)
+		}
+		metrics := scenarioCycleMetrics(variantResponse)
+		response.Variants = append(response.Variants, buildScenarioResult(label, variant.Overrides, variantResponse, metrics, baseMetrics))
+	}
+
+	return response, nil
+}
+
+// validateScenarioRequest checks a scenario's request and that its genealogy type exists. Invalid
+// requests are returned as placement errors; a failed lookup is returned as it is.
+func validateScenarioRequest(req BusinessSimulationRequest) error {
+	if err := validateBusinessSimulationRequest(req); err != nil {
+		return newPlacementError(http.StatusBadRequest, "%v", err)
+	}
+	if _, err := getGenealogyTypeIDByName(req.GenealogyType); err != nil {
+		if err == sql.ErrNoRows {
+			return newPlacementError(http.StatusBadRequest, "invalid genealogy type %q", req.GenealogyType)
+		}
+		return err
+	}
+	return nil
+}
+
+// scenarioError prefixes an error with the scenario it belongs to, keeping the status of placement errors
+func scenarioError(label string, err error) error {
+	if placement, ok := err.(*placementError); ok {
+		return newPlacementError(placement.status, "%s: %s", label, placement.message)
+	}
+	return fmt.Errorf("%s: %v", label, err)
+}
+
+// scenarioLabel names a variant, falling back to its position in the request
+func scenarioLabel(name string, index int) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("variant_%d", index+1)
+}
+
+// applyScenarioOverrides returns a copy of the base request with the overrides applied by JSON path
+func applyScenarioOverrides(base BusinessSimulationRequest, overrides map[string]interface{}) (BusinessSimulationRequest, error) {
+	encoded, err := json.Marshal(base)
+	if err != nil {
+		return BusinessSimulationRequest{}, err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return BusinessSimulationRequest{}, err
+	}
+
+	// Apply paths in a stable order so errors are reproducible
+	paths := make([]string, 0, len(overrides))
+	for path := range overrides {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := setJSONPath(document, path, overrides[path]); err != nil {
+			return BusinessSimulationRequest{}, err
+		}
+	}
+
+	encoded, err = json.Marshal(document)
+	if err != nil {
+		return BusinessSimulationRequest{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	var result BusinessSimulationRequest
+	if err := decoder.Decode(&result); err != nil {
+		return BusinessSimulationRequest{}, fmt.Errorf("invalid overrides: %v", err)
+	}
+	return result, nil
+}
+
+// setJSONPath sets a value in a decoded JSON document by a dotted path of keys and array indexes
+func setJSONPath(document map[string]interface{}, path string, value interface{}) error {
+	segments := strings.Split(path, ".")
+	var current interface{} = document
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch container := current.(type) {
+		case map[string]interface{}:
+			if last {
+				container[segment] = value
+				return nil
+			}
+			next, exists := container[segment]
+			if !exists || next == nil {
+				// Optional objects missing from the base are created; lists must already exist
+				if _, err := strconv.Atoi(segments[i+1]); err == nil {
+					return fmt.Errorf("override path %q: %s is not set in the base request", path, strings.Join(segments[:i+1], "."))
+				}
+				next = make(map[string]interface{})
+				container[segment] = next
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(container) {
+				return fmt.Errorf("override path %q: index %s is out of range", path, segment)
+			}
+			if last {
+				container[index] = value
+				return nil
+			}
+			current = container[index]
+		default:
+			return fmt.Errorf("override path %q: %s is not an object or list", path, strings.Join(segments[:i], "."))
+		}
+	}
+	return nil
+}
+
+// scenarioCycleMetrics collects the key metrics of a business simulation per simulation cycle
+func scenarioCycleMetrics(response BusinessSimulationResponse) map[int]ScenarioCycleMetrics {
+	metrics := make(map[int]ScenarioCycleMetrics)
+	for cycleNumber, cycle := range response.VolumeCalculations.VolumeByPayoutCycle {
+		metrics[cycleNumber] = ScenarioCycleMetrics{
+			Volume:        cycle.PersonalVolume,
+			MatchedVolume: cycle.MatchedVolume,
+			Payout:        cycle.PayoutVolume,
+			Flush:         cycle.CapFlush,
+		}
+	}
+
+	// With commissions, the payout and flush are the amounts of the commission engine
+	if results := response.CommissionResults; results != nil {
+		flushByCycle := make(map[int]float64)
+		for _, commission := range results.Commissions {
+			for _, period := range commission.Periods {
+				flushByCycle[period.BaseCycles[len(period.BaseCycles)-1]] += period.CapFlush
+			}
+		}
+		for _, pool := range results.Pools {
+			for _, period := range pool.Periods {
+				flushByCycle[period.BaseCycles[len(period.BaseCycles)-1]] += period.Flushed
+			}
+		}
+		for cycleNumber, cycle := range metrics {
+			cycle.Payout = results.PayoutByCycle[cycleNumber]
+			cycle.Flush = flushByCycle[cycleNumber]
+			metrics[cycleNumber] = cycle
+		}
+	}
+
+	for cycleNumber, cycle := range metrics {
+		cycle.PayoutPercentage = payoutPercentage(cycle.Payout, cycle.Volume)
+		metrics[cycleNumber] = cycle
+	}
+	return metrics
+}
+
+// buildScenarioResult lays out a scenario's metrics per cycle with their difference from the base.
+// Cycles present in only one of the two count as zero in the other.
+func buildScenarioResult(name string, overrides map[string]interface{}, response BusinessSimulationResponse, metrics, baseMetrics map[int]ScenarioCycleMetrics) ScenarioResult {
+	cycleNumbers := make([]int, 0, len(metrics))
+	for cycleNumber := range metrics {
+		cycleNumbers = append(cycleNumbers, cycleNumber)
+	}
+	for cycleNumber := range baseMetrics {
+		if _, exists := metrics[cycleNumber]; !exists {
+			cycleNumbers = append(cycleNumbers, cycleNumber)
+		}
+	}
+	sort.Ints(cycleNumbers)
+
+	result := ScenarioResult{
+		Name:       name,
+		Overrides:  overrides,
+		TotalUsers: len(response.Users),
+		Cycles:     make([]ScenarioCycleRow, 0, len(cycleNumbers)),
+	}
+	var totals, baseTotals ScenarioCycleMetrics
+	for _, cycleNumber := range cycleNumbers {
+		cycle := metrics[cycleNumber]
+		baseCycle := baseMetrics[cycleNumber]
+		result.Cycles = append(result.Cycles, ScenarioCycleRow{
+			CycleNumber:          cycleNumber,
+			ScenarioCycleMetrics: cycle,
+			Delta:                cycle.minus(baseCycle),
+		})
+		totals = totals.plus(cycle)
+		baseTotals = baseTotals.plus(baseCycle)
+	}
+	totals.PayoutPercentage = payoutPercentage(totals.Payout, totals.Volume)
+	baseTotals.PayoutPercentage = payoutPercentage(baseTotals.Payout, baseTotals.Volume)
+	result.Totals = ScenarioCycleRow{
+		ScenarioCycleMetrics: totals,
+		Delta:                totals.minus(baseTotals),
+	}
+
+	return result
+}
+
+// plus adds the amounts of two sets of metrics; the payout percentage is left for the caller
+func (m ScenarioCycleMetrics) plus(other ScenarioCycleMetrics) ScenarioCycleMetrics {
+	return ScenarioCycleMetrics{
+		Volume:        m.Volume + other.Volume,
+		MatchedVolume: m.MatchedVolume + other.MatchedVolume,
+		Payout:        m.Payout + other.Payout,
+		Flush:         m.Flush + other.Flush,
+	}
+}
+
+// minus returns the difference between two sets of metrics
+func (m ScenarioCycleMetrics) minus(other ScenarioCycleMetrics) ScenarioCycleMetrics {
+	return ScenarioCycleMetrics{
+		Volume:           m.Volume - other.Volume,
+		MatchedVolume:    m.MatchedVolume - other.MatchedVolume,
+		Payout:           m.Payout - other.Payout,
+		PayoutPercentage: m.PayoutPercentage - other.PayoutPercentage,
+		Flush:            m.Flush - other.Flush,
+	}
+}
+
+// payoutPercentage returns a payout as % of volume
+func payoutPercentage(payout, volume float64) float64 {
+	if volume <= 0 {
+		return 0
+	}
+	return payout / volume * 100
+}
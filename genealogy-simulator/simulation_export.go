@@ -0,0 +1,385 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types of the export formats
+const (
+	csvZipContentType = "application/zip"
+	xlsxContentType   = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// exportTable is one section of a simulation export: a CSV file in the zip or a sheet in the workbook.
+// Cells are strings, ints or float64s, so the workbook can store numbers as numbers.
+type exportTable struct {
+	file   string
+	sheet  string
+	header []string
+	rows   [][]interface{}
+}
+
+// handleExportBusinessSimulation runs a business simulation and returns it as a CSV zip or an XLSX
+// workbook, chosen by ?format=csv (default) or ?format=xlsx
+func handleExportBusinessSimulation(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// The export has no per-user breakdowns, so they need not be calculated
+	req.SkipVolumeBreakdowns = true
+
+	businessResponse, err := runBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Business simulation export cancelled: %v", err)
+			return
+		}
+		log.Printf("Business simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeSimulationExport(w, businessResponse, format)
+}
+
+// handleExportSimulationJob returns the result of a completed business simulation job as a CSV zip
+// or an XLSX workbook
+func handleExportSimulationJob(w http.ResponseWriter, r *http.Request) {
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, ok := completedJobResult(w, r)
+	if !ok {
+		return
+	}
+
+	businessResponse, ok := result.(BusinessSimulationResponse)
+	if !ok {
+		http.Error(w, "Only business simulation jobs can be exported", http.StatusBadRequest)
+		return
+	}
+	writeSimulationExport(w, businessResponse, format)
+}
+
+// parseExportFormat reads the format query parameter
+func parseExportFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+		return "csv", nil
+	case "csv", "xlsx":
+		return format, nil
+	default:
+		return "", fmt.Errorf("format must be csv or xlsx")
+	}
+}
+
+// writeSimulationExport writes a simulation as a download in the given format
+func writeSimulationExport(w http.ResponseWriter, response BusinessSimulationResponse, format string) {
+	tables := simulationExportTables(response)
+
+	var buf bytes.Buffer
+	var err error
+	contentType, extension := csvZipContentType, "zip"
+	if format == "xlsx" {
+		contentType, extension = xlsxContentType, "xlsx"
+		err = writeXLSX(&buf, tables)
+	} else {
+		err = writeCSVZip(&buf, tables)
+	}
+	if err != nil {
+		log.Printf("Error exporting simulation %s: %v", response.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("simulation-%s.%s", response.ID, extension)))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Error writing export: %v", err)
+		return
+	}
+	log.Printf("Exported simulation %s as %s (%d users)", response.ID, format, len(response.Users))
+}
+
+// simulationExportTables lays out the users, the volume of each payout cycle and the product
+// distribution of each cycle. Leg volume columns cover every leg present in the simulation.
+func simulationExportTables(response BusinessSimulationResponse) []exportTable {
+	userLegs := make(map[string]bool)
+	for _, user := range response.Users {
+		for leg := range user.TeamLegVolumes {
+			userLegs[leg] = true
+		}
+	}
+	cycleNumbers := make([]int, 0, len(response.VolumeCalculations.VolumeByPayoutCycle))
+	cycleLegs := make(map[string]bool)
+	for number, cycle := range response.VolumeCalculations.VolumeByPayoutCycle {
+		cycleNumbers = append(cycleNumbers, number)
+		for leg := range cycle.LegVolumes {
+			cycleLegs[leg] = true
+		}
+	}
+	sort.Ints(cycleNumbers)
+
+	users := exportTable{
+		file:   "users.csv",
+		sheet:  "Users",
+		header: []string{"user_id", "parent_id", "level", "payout_cycle", "position", "product_id", "product_name", "personal_volume", "team_volume"},
+	}
+	legs := sortedKeys(userLegs)
+	for _, leg := range legs {
+		users.header = append(users.header, leg+"_leg_volume")
+	}
+	for _, user := range response.Users {
+		row := []interface{}{user.ID, "", user.Level, user.PayoutCycle, user.GenealogyPosition, "", "", user.PersonalVolume, user.TeamVolume}
+		if user.ParentID != nil {
+			row[1] = *user.ParentID
+		}
+		if user.ProductID != nil {
+			row[5] = *user.ProductID
+		}
+		if user.ProductName != nil {
+			row[6] = *user.ProductName
+		}
+		for _, leg := range legs {
+			row = append(row, user.TeamLegVolumes[leg])
+		}
+		users.rows = append(users.rows, row)
+	}
+
+	cycles := exportTable{
+		file:   "payout_cycles.csv",
+		sheet:  "Payout Cycles",
+		header: []string{"cycle_number", "start_date", "end_date", "users_generated", "personal_volume", "team_volume"},
+	}
+	legs = sortedKeys(cycleLegs)
+	for _, leg := range legs {
+		cycles.header = append(cycles.header, leg+"_leg_volume")
+	}
+	cycles.header = append(cycles.header, "carry_forward_left", "carry_forward_right", "matched_volume", "payout_volume", "cap_flush")
+
+	products := exportTable{
+		file:   "product_distribution.csv",
+		sheet:  "Product Distribution",
+		header: []string{"cycle_number", "product_name", "users_count", "total_volume", "percentage", "average_volume_per_user"},
+	}
+
+	for _, number := range cycleNumbers {
+		cycle := response.VolumeCalculations.VolumeByPayoutCycle[number]
+		row := []interface{}{cycle.CycleNumber, cycle.StartDate, cycle.EndDate, cycle.UsersGenerated, cycle.PersonalVolume, cycle.TeamVolume}
+		for _, leg := range legs {
+			row = append(row, cycle.LegVolumes[leg])
+		}
+		row = append(row, cycle.CarryForwardLeft, cycle.CarryForwardRight, cycle.MatchedVolume, cycle.PayoutVolume, cycle.CapFlush)
+		cycles.rows = append(cycles.rows, row)
+
+		names := make([]string, 0, len(cycle.ProductDistribution))
+		for name := range cycle.ProductDistribution {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			distribution := cycle.ProductDistribution[name]
+			products.rows = append(products.rows, []interface{}{
+				cycle.CycleNumber, distribution.ProductName, distribution.UsersCount,
+				distribution.TotalVolume, distribution.Percentage, distribution.AverageVolumePerUser,
+			})
+		}
+	}
+
+	return []exportTable{users, cycles, products}
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatExportCell formats a cell for a CSV file
+func formatExportCell(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// writeCSVZip writes each table as a CSV file of a zip archive
+func writeCSVZip(w io.Writer, tables []exportTable) error {
+	archive := zip.NewWriter(w)
+	for _, table := range tables {
+		file, err := archive.Create(table.file)
+		if err != nil {
+			return err
+		}
+		writer := csv.NewWriter(file)
+		if err := writer.Write(table.header); err != nil {
+			return err
+		}
+		record := make([]string, len(table.header))
+		for _, row := range table.rows {
+			for i, cell := range row {
+				record[i] = formatExportCell(cell)
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// writeXLSX writes the tables as the sheets of an Office Open XML workbook. Strings are stored
+// inline, so the workbook needs no shared string table; header rows use a bold style.
+func writeXLSX(w io.Writer, tables []exportTable) error {
+	archive := zip.NewWriter(w)
+	write := func(name, content string) error {
+		file, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(file, xml.Header+content)
+		return err
+	}
+
+	var contentTypes, workbookSheets, workbookRels strings.Builder
+	for i := range tables {
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&workbookSheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(tables[i].sheet), i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	stylesID := len(tables) + 1
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			contentTypes.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + workbookSheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			workbookRels.String() +
+			fmt.Sprintf(`<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, stylesID) +
+			`</Relationships>`},
+		{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+	}
+	for _, part := range parts {
+		if err := write(part.name, part.content); err != nil {
+			return err
+		}
+	}
+
+	for i, table := range tables {
+		if err := write(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), worksheetXML(table)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// worksheetXML renders a table as worksheet XML, the header row frozen and bold
+func worksheetXML(table exportTable) string {
+	var sheet strings.Builder
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	sheet.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	sheet.WriteString(`<sheetData>`)
+
+	header := make([]interface{}, len(table.header))
+	for i, name := range table.header {
+		header[i] = name
+	}
+	writeRow := func(number int, cells []interface{}, style string) {
+		fmt.Fprintf(&sheet, `<row r="%d">`, number)
+		for i, cell := range cells {
+			ref := columnName(i) + strconv.Itoa(number)
+			switch v := cell.(type) {
+			case int, float64:
+				fmt.Fprintf(&sheet, `<c r="%s"%s><v>%s</v></c>`, ref, style, formatExportCell(v))
+			default:
+				text := formatExportCell(v)
+				if text == "" {
+					continue
+				}
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"%s><is><t>%s</t></is></c>`, ref, style, xmlEscape(text))
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+
+	writeRow(1, header, ` s="1"`)
+	for i, row := range table.rows {
+		writeRow(i+2, row, "")
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+	return sheet.String()
+}
+
+// columnName returns the spreadsheet column letters of a zero-based column index: A, B, ..., Z, AA, ...
+func columnName(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+// xmlEscape escapes text for an XML element or attribute
+func xmlEscape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
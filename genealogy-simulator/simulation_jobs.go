@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Limits of the simulation job subsystem
+const (
+	maxConcurrentJobs = 4
+	maxPendingJobs    = 32        // queued and running jobs; further submissions are refused
+	jobRetention      = time.Hour // finished jobs are kept this long for their results
+)
+
+// errJobQueueFull is returned when a job is submitted while maxPendingJobs are queued or running
+var errJobQueueFull = errors.New("too many simulation jobs are queued or running; try again later")
+
+// Simulation job statuses
+const (
+	jobQueued     = "queued"
+	jobRunning    = "running"
+	jobCancelling = "cancelling" // cancelled, but not yet stopped
+	jobCompleted  = "completed"
+	jobFailed     = "failed"
+	jobCancelled  = "cancelled"
+)
+
+// SimulationProgress reports how far a running simulation has got
+type SimulationProgress struct {
+	Stage       string `json:"stage"` // placing_users, assigning_products, calculating_volumes, calculating_commissions
+	Cycle       int    `json:"cycle"`
+	TotalCycles int    `json:"total_cycles"`
+	UsersPlaced int    `json:"users_placed"`
+}
+
+// progressReporterKey is the context key of the progress reporter
+type progressReporterKey struct{}
+
+// withProgressReporter returns a context whose simulations report their progress to the given function
+func withProgressReporter(ctx context.Context, report func(SimulationProgress)) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, report)
+}
+
+// reportProgress sends progress to the context's reporter, if any
+func reportProgress(ctx context.Context, progress SimulationProgress) {
+	if report, ok := ctx.Value(progressReporterKey{}).(func(SimulationProgress)); ok {
+		report(progress)
+	}
+}
+
+// SimulationJob is a simulation running in the background
+type SimulationJob struct {
+	ID         string             `json:"id"`
+	Kind       string             `json:"kind"` // simulation or business_simulation
+	Status     string             `json:"status"`
+	Progress   SimulationProgress `json:"progress"`
+	Error      string             `json:"error,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+	StartedAt  *time.Time         `json:"started_at,omitempty"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+
+	result interface{}
+	cancel context.CancelFunc
+}
+
+// simulationJobManager runs simulation jobs with a limit on how many run at once
+type simulationJobManager struct {
+	mu         sync.Mutex
+	jobs       map[string]*SimulationJob
+	slot       chan struct{}
+	pending    int // jobs queued or running
+	maxPending int
+}
+
+// simulationJobs is the process-wide job manager
+var simulationJobs = newSimulationJobManager(maxConcurrentJobs, maxPendingJobs)
+
+// newSimulationJobManager creates a job manager running at most concurrency jobs at once and
+// holding at most maxPending queued or running jobs
+func newSimulationJobManager(concurrency, maxPending int) *simulationJobManager {
+	m := &simulationJobManager{
+		jobs:       make(map[string]*SimulationJob),
+		slot:       make(chan struct{}, concurrency),
+		maxPending: maxPending,
+	}
+	go m.purgePeriodically(jobRetention / 4)
+	return m
+}
+
+// submit queues a job and returns a snapshot of it, or errJobQueueFull when too many jobs are
+// pending. The run function receives a context that is cancelled with the job and carries the
+// job's progress reporter.
+func (m *simulationJobManager) submit(kind string, run func(ctx context.Context) (interface{}, error)) (SimulationJob, error) {
+	m.mu.Lock()
+	m.purgeExpired()
+	if m.pending >= m.maxPending {
+		m.mu.Unlock()
+		return SimulationJob{}, errJobQueueFull
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &SimulationJob{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Status:    jobQueued,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	m.jobs[job.ID] = job
+	m.pending++
+	snapshot := *job
+	m.mu.Unlock()
+
+	ctx = withProgressReporter(ctx, func(progress SimulationProgress) {
+		m.mu.Lock()
+		job.Progress = progress
+		m.mu.Unlock()
+	})
+	go m.run(ctx, job, run)
+
+	log.Printf("Submitted %s job %s", kind, job.ID)
+	return snapshot, nil
+}
+
+// run waits for a free slot and runs the job, recording its outcome
+func (m *simulationJobManager) run(ctx context.Context, job *SimulationJob, run func(ctx context.Context) (interface{}, error)) {
+	defer job.cancel()
+
+	select {
+	case m.slot <- struct{}{}:
+		defer func() { <-m.slot }()
+	case <-ctx.Done():
+		m.finish(job, nil, ctx.Err())
+		return
+	}
+
+	m.mu.Lock()
+	started := time.Now()
+	if job.Status == jobQueued {
+		job.Status = jobRunning
+	}
+	job.StartedAt = &started
+	m.mu.Unlock()
+
+	result, err := run(ctx)
+	if err == nil {
+		err = ctx.Err()
+	}
+	m.finish(job, result, err)
+}
+
+// finish records the result or error of a job
+func (m *simulationJobManager) finish(job *SimulationJob, result interface{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	finished := time.Now()
+	job.FinishedAt = &finished
+	m.pending--
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		job.Status = jobCancelled
+	case err != nil:
+		job.Status = jobFailed
+		job.Error = err.Error()
+	default:
+		job.Status = jobCompleted
+		job.result = result
+	}
+	log.Printf("Simulation job %s %s", job.ID, job.Status)
+}
+
+// get returns a snapshot of a job and its result
+func (m *simulationJobManager) get(id string) (SimulationJob, interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.purgeExpired()
+	job, exists := m.jobs[id]
+	if !exists {
+		return SimulationJob{}, nil, false
+	}
+	return *job, job.result, true
+}
+
+// cancelJob cancels a queued or running job and returns its snapshot, showing the job as cancelling
+// until it has stopped
+func (m *simulationJobManager) cancelJob(id string) (SimulationJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return SimulationJob{}, false
+	}
+	if job.FinishedAt == nil {
+		job.Status = jobCancelling
+		job.cancel()
+	}
+	return *job, true
+}
+
+// purgeExpired drops finished jobs past their retention; the caller holds the lock
+func (m *simulationJobManager) purgeExpired() {
+	for id, job := range m.jobs {
+		if job.FinishedAt != nil && time.Since(*job.FinishedAt) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// purgePeriodically drops expired jobs at the given interval, so their results are released even
+// when no jobs are submitted or looked up
+func (m *simulationJobManager) purgePeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		m.purgeExpired()
+		m.mu.Unlock()
+	}
+}
+
+// handleSubmitSimulationJob validates a simulation request and runs it as a background job
+func handleSubmitSimulationJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSimulationRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := simulationJobs.submit("simulation", func(ctx context.Context) (interface{}, error) {
+		return runSimulation(ctx, req)
+	})
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	writeJob(w, http.StatusAccepted, job)
+}
+
+// handleSubmitBusinessSimulationJob validates a business simulation request and runs it as a background job
+func handleSubmitBusinessSimulationJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBusinessSimulationRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Sections left out by ?detail= or ?fields= at submission are not computed
+	shape, err := parseResponseShape(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shape.prepare(&req)
+
+	job, err := simulationJobs.submit("business_simulation", func(ctx context.Context) (interface{}, error) {
+		return runBusinessSimulation(ctx, req)
+	})
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	writeJob(w, http.StatusAccepted, job)
+}
+
+// handleGetSimulationJob reports the status and progress of a job
+func handleGetSimulationJob(w http.ResponseWriter, r *http.Request) {
+	job, _, exists := simulationJobs.get(mux.Vars(r)["job_id"])
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJob(w, http.StatusOK, job)
+}
+
+// handleGetSimulationJobResult returns the result of a completed job; business simulation results
+// can be trimmed with ?detail= and ?fields=
+func handleGetSimulationJobResult(w http.ResponseWriter, r *http.Request) {
+	shape, err := parseResponseShape(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, ok := completedJobResult(w, r)
+	if !ok {
+		return
+	}
+
+	if businessResult, ok := result.(BusinessSimulationResponse); ok {
+		result, err = shape.apply(businessResult)
+		if err != nil {
+			log.Printf("Error shaping response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// completedJobResult returns the result of the job in the path, or writes why there is none
+func completedJobResult(w http.ResponseWriter, r *http.Request) (interface{}, bool) {
+	job, result, exists := simulationJobs.get(mux.Vars(r)["job_id"])
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	switch job.Status {
+	case jobCompleted:
+		return result, true
+	case jobFailed:
+		http.Error(w, job.Error, http.StatusUnprocessableEntity)
+	case jobCancelled:
+		http.Error(w, "Job was cancelled", http.StatusGone)
+	default:
+		http.Error(w, fmt.Sprintf("Job is %s", job.Status), http.StatusConflict)
+	}
+	return nil, false
+}
+
+// handleCancelSimulationJob cancels a queued or running job
+func handleCancelSimulationJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	job, exists := simulationJobs.cancelJob(mux.Vars(r)["job_id"])
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJob(w, http.StatusAccepted, job)
+}
+
+// writeJobQueueFull refuses a submission while the job queue is full
+func writeJobQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, errJobQueueFull.Error(), http.StatusServiceUnavailable)
+}
+
+// writeJob writes a job snapshot as JSON
+func writeJob(w http.ResponseWriter, status int, job SimulationJob) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// simulationReport is a business simulation laid out for the HTML and PDF reports
+type simulationReport struct {
+	Title       string
+	GeneratedAt string
+	Parameters  [][2]string // label and value
+	Products    []reportProductRow
+	CycleHeader []string
+	Cycles      [][]string // one row per cycle, formatted for display
+	Totals      []string
+	Commissions []reportCommissionRow
+	Charts      []reportChart
+	Methodology []string
+}
+
+// reportProductRow is a product of the product mix table
+type reportProductRow struct {
+	Name       string
+	Price      string
+	Volume     string
+	SalesRatio string
+	Users      string
+	Share      string
+	TotalBV    string
+}
+
+// reportCommissionRow is a commission or bonus pool of the payout table
+type reportCommissionRow struct {
+	Name        string
+	Type        string
+	PayoutCycle string
+	TotalPayout string
+}
+
+// reportChart is a bar or line chart of values per payout cycle
+type reportChart struct {
+	Title  string
+	Kind   string // bar or line
+	Labels []string
+	Series []reportSeries
+}
+
+// reportSeries is one coloured series of a chart
+type reportSeries struct {
+	Name   string
+	Colour string
+	Values []float64
+}
+
+// handleBusinessSimulationReport runs a business simulation and returns it as a self-contained HTML
+// report, or with ?format=pdf as a printable PDF
+func handleBusinessSimulationReport(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	format, err := parseReportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.SkipVolumeBreakdowns = true
+
+	businessResponse, err := runBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Business simulation report cancelled: %v", err)
+			return
+		}
+		log.Printf("Business simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeSimulationReport(w, businessResponse, format)
+}
+
+// handleSimulationJobReport returns the result of a completed business simulation job as an HTML or PDF report
+func handleSimulationJobReport(w http.ResponseWriter, r *http.Request) {
+	format, err := parseReportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, ok := completedJobResult(w, r)
+	if !ok {
+		return
+	}
+
+	businessResponse, ok := result.(BusinessSimulationResponse)
+	if !ok {
+		http.Error(w, "Only business simulation jobs have a report", http.StatusBadRequest)
+		return
+	}
+	writeSimulationReport(w, businessResponse, format)
+}
+
+// parseReportFormat reads the format query parameter
+func parseReportFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+		return "html", nil
+	case "html", "pdf":
+		return format, nil
+	default:
+		return "", fmt.Errorf("format must be html or pdf")
+	}
+}
+
+// writeSimulationReport renders the report of a simulation in the given format
+func writeSimulationReport(w http.ResponseWriter, response BusinessSimulationResponse, format string) {
+	report := buildSimulationReport(response)
+
+	var buf bytes.Buffer
+	var err error
+	contentType := "text/html; charset=utf-8"
+	if format == "pdf" {
+		contentType = "application/pdf"
+		err = renderReportPDF(&buf, report)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("simulation-report-%s.pdf", response.ID)))
+	} else {
+		err = reportTemplate.Execute(&buf, report)
+	}
+	if err != nil {
+		log.Printf("Error rendering report for simulation %s: %v", response.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Error writing report: %v", err)
+		return
+	}
+	log.Printf("Generated %s report for simulation %s", format, response.ID)
+}
+
+// buildSimulationReport lays out the plan parameters, product mix, volume and payout of each
+// cycle, the charts and the methodology of a simulation
+func buildSimulationReport(response BusinessSimulationResponse) *simulationReport {
+	report := &simulationReport{
+		Title:       "Business Simulation Report",
+		GeneratedAt: time.Now().Format("2006-01-02 15:04 MST"),
+	}
+
+	report.Parameters = [][2]string{
+		{"Simulation ID", response.ID},
+		{"Genealogy type", response.GenealogyType},
+		{"Expected users", formatReportInt(response.MaxExpectedUsers)},
+		{"Users simulated", formatReportInt(response.SimulationSummary.TotalUsersGenerated)},
+		{"Payout cycle", fmt.Sprintf("%s, %d cycles", response.PayoutCycle, response.NumberOfPayoutCycles)},
+		{"Maximum children", formatReportInt(response.MaxChildrenCount)},
+		{"Total personal volume", formatReportNumber(response.SimulationSummary.TotalPersonalVolume)},
+		{"Total team volume", formatReportNumber(response.SimulationSummary.TotalTeamVolume)},
+	}
+	if response.SimulationCycleType != "" {
+		report.Parameters = append(report.Parameters, [2]string{"Simulated in", fmt.Sprintf("%s, %d cycles", response.SimulationCycleType, response.SimulationCycles)})
+	}
+	if response.StartDate != "" {
+		report.Parameters = append(report.Parameters, [2]string{"Start date", response.StartDate})
+	}
+	if response.Seed != 0 {
+		report.Parameters = append(report.Parameters, [2]string{"Seed", strconv.FormatInt(response.Seed, 10)})
+	}
+
+	// Product mix: the configured products with the share of users and volume they received
+	cycleNumbers := make([]int, 0, len(response.VolumeCalculations.VolumeByPayoutCycle))
+	productVolume := make(map[string]float64)
+	for number, cycle := range response.VolumeCalculations.VolumeByPayoutCycle {
+		cycleNumbers = append(cycleNumbers, number)
+		for name, distribution := range cycle.ProductDistribution {
+			productVolume[name] += distribution.TotalVolume
+		}
+	}
+	sort.Ints(cycleNumbers)
+	products := append([]BusinessProduct(nil), response.Products...)
+	sort.SliceStable(products, func(i, j int) bool { return products[i].SortOrder < products[j].SortOrder })
+	for _, product := range products {
+		distribution := response.SimulationSummary.ProductDistribution[product.ProductName]
+		report.Products = append(report.Products, reportProductRow{
+			Name:       product.ProductName,
+			Price:      formatReportNumber(product.ProductPrice),
+			Volume:     formatReportNumber(product.BusinessVolume),
+			SalesRatio: formatReportNumber(product.ProductSalesRatio) + "%",
+			Users:      formatReportInt(distribution.Count),
+			Share:      formatReportNumber(distribution.Percentage) + "%",
+			TotalBV:    formatReportNumber(productVolume[product.ProductName]),
+		})
+	}
+
+	// Volume and payout of each cycle; binary plans add their matching and carry forward
+	binary := strings.Contains(strings.ToLower(response.GenealogyType), "binary")
+	var commissionsByCycle map[int]float64
+	if response.CommissionResults != nil {
+		commissionsByCycle = response.CommissionResults.PayoutByCycle
+	}
+	report.CycleHeader = []string{"Cycle", "Period", "New users", "Personal volume", "Team volume"}
+	if binary {
+		report.CycleHeader = append(report.CycleHeader, "Left", "Right", "Matched", "Carry left", "Carry right", "Payout volume", "Cap flush")
+	}
+	if commissionsByCycle != nil {
+		report.CycleHeader = append(report.CycleHeader, "Commissions paid")
+	}
+
+	var users int
+	var personalVolume, teamVolume, matched, payoutVolume, capFlush, commissions float64
+	volumeChart := reportChart{Title: "Personal volume by cycle", Kind: "bar", Series: []reportSeries{{Name: "Personal volume", Colour: "#4e79a7"}}}
+	carryChart := reportChart{Title: "Binary carry forward by cycle", Kind: "line", Series: []reportSeries{
+		{Name: "Carry left", Colour: "#4e79a7"}, {Name: "Carry right", Colour: "#f28e2b"}, {Name: "Matched", Colour: "#59a14f"},
+	}}
+	for _, number := range cycleNumbers {
+		cycle := response.VolumeCalculations.VolumeByPayoutCycle[number]
+		period := ""
+		if cycle.StartDate != "" {
+			period = cycle.StartDate + " to " + cycle.EndDate
+		}
+		row := []string{strconv.Itoa(number), period, formatReportInt(cycle.UsersGenerated),
+			formatReportNumber(cycle.PersonalVolume), formatReportNumber(cycle.TeamVolume)}
+		if binary {
+			row = append(row, formatReportNumber(cycle.LegVolumes["left"]), formatReportNumber(cycle.LegVolumes["right"]),
+				formatReportNumber(cycle.MatchedVolume), formatReportNumber(cycle.CarryForwardLeft), formatReportNumber(cycle.CarryForwardRight),
+				formatReportNumber(cycle.PayoutVolume), formatReportNumber(cycle.CapFlush))
+		}
+		if commissionsByCycle != nil {
+			row = append(row, formatReportNumber(commissionsByCycle[number]))
+		}
+		report.Cycles = append(report.Cycles, row)
+
+		users += cycle.UsersGenerated
+		personalVolume += cycle.PersonalVolume
+		teamVolume += cycle.TeamVolume
+		matched += cycle.MatchedVolume
+		payoutVolume += cycle.PayoutVolume
+		capFlush += cycle.CapFlush
+		commissions += commissionsByCycle[number]
+
+		label := strconv.Itoa(number)
+		volumeChart.Labels = append(volumeChart.Labels, label)
+		volumeChart.Series[0].Values = append(volumeChart.Series[0].Values, cycle.PersonalVolume)
+		carryChart.Labels = append(carryChart.Labels, label)
+		carryChart.Series[0].Values = append(carryChart.Series[0].Values, cycle.CarryForwardLeft)
+		carryChart.Series[1].Values = append(carryChart.Series[1].Values, cycle.CarryForwardRight)
+		carryChart.Series[2].Values = append(carryChart.Series[2].Values, cycle.MatchedVolume)
+	}
+	report.Totals = []string{"Total", "", formatReportInt(users), formatReportNumber(personalVolume), formatReportNumber(teamVolume)}
+	if binary {
+		report.Totals = append(report.Totals, "", "", formatReportNumber(matched), "", "", formatReportNumber(payoutVolume), formatReportNumber(capFlush))
+	}
+	if commissionsByCycle != nil {
+		report.Totals = append(report.Totals, formatReportNumber(commissions))
+	}
+	report.Charts = append(report.Charts, volumeChart)
+	if binary {
+		report.Charts = append(report.Charts, carryChart)
+	}
+
+	if summary := response.CommissionResults; summary != nil {
+		for _, commission := range summary.Commissions {
+			report.Commissions = append(report.Commissions, reportCommissionRow{
+				Name: commission.Name, Type: commission.Type, PayoutCycle: commission.PayoutCycle, TotalPayout: formatReportNumber(commission.TotalPayout),
+			})
+		}
+		for _, pool := range summary.Pools {
+			report.Commissions = append(report.Commissions, reportCommissionRow{
+				Name: pool.Name, Type: "bonus pool", PayoutCycle: pool.PayoutCycle, TotalPayout: formatReportNumber(pool.TotalPaid),
+			})
+		}
+		report.Parameters = append(report.Parameters,
+			[2]string{"Total payout", formatReportNumber(summary.TotalPayout)},
+			[2]string{"Payout ratio", formatReportNumber(summary.PayoutRatio) + "%"})
+	}
+
+	for _, line := range strings.Split(response.VolumeCalculations.CalculationMethodology, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			report.Methodology = append(report.Methodology, line)
+		}
+	}
+	return report
+}
+
+// formatReportNumber formats an amount with thousands separators and two decimals
+func formatReportNumber(value float64) string {
+	text := strconv.FormatFloat(math.Abs(value), 'f', 2, 64)
+	whole, fraction := text[:len(text)-3], text[len(text)-3:]
+	formatted := groupThousands(whole) + fraction
+	if value < 0 && formatted != "0.00" {
+		formatted = "-" + formatted
+	}
+	return formatted
+}
+
+// formatReportInt formats a count with thousands separators
+func formatReportInt(value int) string {
+	if value < 0 {
+		return "-" + groupThousands(strconv.Itoa(-value))
+	}
+	return groupThousands(strconv.Itoa(value))
+}
+
+// groupThousands inserts a comma between each group of three digits
+func groupThousands(digits string) string {
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return grouped.String()
+}
+
+// chartMaximum returns the largest value of a chart, or 1 when all are zero, for scaling
+func chartMaximum(chart reportChart) float64 {
+	maximum := 0.0
+	for _, series := range chart.Series {
+		for _, value := range series.Values {
+			maximum = math.Max(maximum, value)
+		}
+	}
+	if maximum <= 0 {
+		return 1
+	}
+	return maximum
+}
+
+// chartSVG renders a chart as inline SVG with a value axis, cycle labels and a legend
+func chartSVG(chart reportChart) template.HTML {
+	const width, height, left, right, top, bottom = 640.0, 240.0, 64.0, 16.0, 28.0, 28.0
+	plotWidth, plotHeight := width-left-right, height-top-bottom
+	maximum := chartMaximum(chart)
+	count := len(chart.Labels)
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %.0f %.0f" class="chart" role="img" aria-label="%s">`,
+		width, height, template.HTMLEscapeString(chart.Title))
+	for i := 0; i <= 4; i++ {
+		y := top + plotHeight - plotHeight*float64(i)/4
+		fmt.Fprintf(&svg, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#e3e6ea"/>`, left, y, width-right, y)
+		fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" font-size="10" text-anchor="end" fill="#5f6b76">%s</text>`,
+			left-6, y+3, formatReportInt(int(math.Round(maximum*float64(i)/4))))
+	}
+
+	step := plotWidth / math.Max(float64(count), 1)
+	labelEvery := int(math.Ceil(float64(count) / 24))
+	for i, label := range chart.Labels {
+		if i%labelEvery == 0 {
+			fmt.Fprintf(&svg, `<text x="%.1f" y="%.1f" font-size="10" text-anchor="middle" fill="#5f6b76">%s</text>`,
+				left+step*(float64(i)+0.5), height-bottom+14, template.HTMLEscapeString(label))
+		}
+	}
+
+	for s, series := range chart.Series {
+		if chart.Kind == "bar" {
+			barWidth := step * 0.7 / float64(len(chart.Series))
+			for i, value := range series.Values {
+				barHeight := plotHeight * value / maximum
+				x := left + step*float64(i) + step*0.15 + barWidth*float64(s)
+				fmt.Fprintf(&svg, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>Cycle %s: %s</title></rect>`,
+					x, top+plotHeight-barHeight, barWidth, barHeight, series.Colour, chart.Labels[i], formatReportNumber(value))
+			}
+			continue
+		}
+		points := make([]string, len(series.Values))
+		for i, value := range series.Values {
+			points[i] = fmt.Sprintf("%.1f,%.1f", left+step*(float64(i)+0.5), top+plotHeight-plotHeight*value/maximum)
+		}
+		fmt.Fprintf(&svg, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, strings.Join(points, " "), series.Colour)
+	}
+
+	for s, series := range chart.Series {
+		x := left + float64(s)*120
+		fmt.Fprintf(&svg, `<rect x="%.1f" y="6" width="10" height="10" fill="%s"/><text x="%.1f" y="15" font-size="11" fill="#333333">%s</text>`,
+			x, series.Colour, x+14, template.HTMLEscapeString(series.Name))
+	}
+	svg.WriteString(`</svg>`)
+	return template.HTML(svg.String())
+}
+
+// reportTemplate is the self-contained HTML report; its styles are inline and its charts inline SVG
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"chart": chartSVG}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+  body { font-family: Helvetica, Arial, sans-serif; color: #1d252c; margin: 32px auto; max-width: 1100px; padding: 0 24px; }
+  h1 { font-size: 24px; margin-bottom: 4px; }
+  h2 { font-size: 17px; margin-top: 32px; border-bottom: 2px solid #4e79a7; padding-bottom: 4px; }
+  .generated { color: #5f6b76; font-size: 12px; }
+  table { border-collapse: collapse; width: 100%; font-size: 12px; margin-top: 8px; }
+  th, td { border: 1px solid #d5dade; padding: 5px 8px; text-align: right; }
+  th { background: #f1f3f5; }
+  th:first-child, td:first-child, .text { text-align: left; }
+  tfoot td { font-weight: bold; background: #f8f9fa; }
+  table.parameters { width: auto; min-width: 420px; }
+  .chart { width: 100%; max-width: 760px; height: auto; margin-top: 12px; }
+  .methodology p { margin: 4px 0; font-size: 13px; }
+  @media print { body { margin: 0; max-width: none; } h2 { break-after: avoid; } table { break-inside: auto; } }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="generated">Generated {{.GeneratedAt}}</div>
+
+<h2>Plan parameters</h2>
+<table class="parameters">
+{{range .Parameters}}<tr><th>{{index . 0}}</th><td class="text">{{index . 1}}</td></tr>
+{{end}}</table>
+
+<h2>Product mix</h2>
+<table>
+<thead><tr><th>Product</th><th>Price</th><th>Business volume</th><th>Sales ratio</th><th>Users</th><th>Share of users</th><th>Total volume</th></tr></thead>
+<tbody>
+{{range .Products}}<tr><td>{{.Name}}</td><td>{{.Price}}</td><td>{{.Volume}}</td><td>{{.SalesRatio}}</td><td>{{.Users}}</td><td>{{.Share}}</td><td>{{.TotalBV}}</td></tr>
+{{end}}</tbody>
+</table>
+
+<h2>Volume and payout by cycle</h2>
+<table>
+<thead><tr>{{range .CycleHeader}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Cycles}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</tbody>
+<tfoot><tr>{{range .Totals}}<td>{{.}}</td>{{end}}</tr></tfoot>
+</table>
+{{if .Commissions}}
+<h2>Commissions and bonus pools</h2>
+<table>
+<thead><tr><th>Name</th><th class="text">Type</th><th class="text">Paid</th><th>Total payout</th></tr></thead>
+<tbody>
+{{range .Commissions}}<tr><td>{{.Name}}</td><td class="text">{{.Type}}</td><td class="text">{{.PayoutCycle}}</td><td>{{.TotalPayout}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}
+{{range .Charts}}
+<h2>{{.Title}}</h2>
+{{chart .}}
+{{end}}
+<h2>Methodology</h2>
+<div class="methodology">
+{{range .Methodology}}<p>{{.}}</p>
+{{end}}</div>
+</body>
+</html>
+`))
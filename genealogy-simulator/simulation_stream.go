@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// cycleListenerKey is the context key of the cycle listener
+type cycleListenerKey struct{}
+
+// withCycleListener returns a context whose simulators pass each cycle to the given function once placed
+func withCycleListener(ctx context.Context, listener func(CycleData)) context.Context {
+	return context.WithValue(ctx, cycleListenerKey{}, listener)
+}
+
+// reportCycle passes a placed cycle to the context's listener, if any
+func reportCycle(ctx context.Context, cycle CycleData) {
+	if listener, ok := ctx.Value(cycleListenerKey{}).(func(CycleData)); ok {
+		listener(cycle)
+	}
+}
+
+// recordListenerKey is the context key of the result record listener
+type recordListenerKey struct{}
+
+// recordListener receives the payout cycles and users of a business simulation once they are final
+type recordListener struct {
+	payoutCycle func(PayoutCycleVolume)
+	user        func(SimulationUser)
+}
+
+// withRecordListener returns a context whose business simulations pass each payout cycle to
+// payoutCycle once its volumes are calculated, and each user to user once their earnings are
+func withRecordListener(ctx context.Context, payoutCycle func(PayoutCycleVolume), user func(SimulationUser)) context.Context {
+	return context.WithValue(ctx, recordListenerKey{}, recordListener{payoutCycle: payoutCycle, user: user})
+}
+
+// reportPayoutCycles passes the payout cycles, in order, to the context's listener, if any
+func reportPayoutCycles(ctx context.Context, volumeByPayoutCycle map[int]PayoutCycleVolume) {
+	listener, ok := ctx.Value(recordListenerKey{}).(recordListener)
+	if !ok {
+		return
+	}
+	cycleNumbers := make([]int, 0, len(volumeByPayoutCycle))
+	for cycleNumber := range volumeByPayoutCycle {
+		cycleNumbers = append(cycleNumbers, cycleNumber)
+	}
+	sort.Ints(cycleNumbers)
+	for _, cycleNumber := range cycleNumbers {
+		listener.payoutCycle(volumeByPayoutCycle[cycleNumber])
+	}
+}
+
+// reportUsers passes the users to the context's listener, if any
+func reportUsers(ctx context.Context, users []SimulationUser) {
+	listener, ok := ctx.Value(recordListenerKey{}).(recordListener)
+	if !ok {
+		return
+	}
+	for i := range users {
+		listener.user(users[i])
+	}
+}
+
+// simulationStream writes simulation events as newline-delimited JSON or server-sent events
+type simulationStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+	err     error
+}
+
+// streamEvent is one NDJSON line
+type streamEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// send writes one event and flushes it to the client. After a write error further events are dropped.
+func (s *simulationStream) send(eventType string, data interface{}) {
+	if s.err != nil {
+		return
+	}
+
+	if s.sse {
+		payload, err := json.Marshal(data)
+		if err == nil {
+			_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventType, payload)
+		}
+		s.err = err
+	} else {
+		s.err = json.NewEncoder(s.w).Encode(streamEvent{Type: eventType, Data: data})
+	}
+
+	if s.err != nil {
+		log.Printf("Error writing %s event: %v", eventType, s.err)
+		return
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// handleBusinessSimulationStream runs a business simulation and streams its results as they are produced:
+// progress and placed cycles while the genealogy grows, the volume of each payout cycle as soon as the
+// volumes are calculated, each user (with their children, which make up the genealogy structure) once
+// their earnings are final, and finally a summary whose size does not depend on the number of users.
+// Every event is bounded, so neither the server nor the client builds one large document; the server
+// still holds the tree in memory while it runs, as volumes and commissions are calculated over all of
+// it. Per-user volume breakdowns are always skipped. Use ?format=sse (or an Accept: text/event-stream
+// header) for server-sent events; the default is NDJSON.
+func handleBusinessSimulationStream(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	log.Println("Received streaming business simulation request")
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBusinessSimulationRequest(req); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.SkipVolumeBreakdowns = true
+
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		format = "sse"
+	}
+	if format != "" && format != "sse" && format != "ndjson" {
+		http.Error(w, "format must be ndjson or sse", http.StatusBadRequest)
+		return
+	}
+
+	stream := &simulationStream{w: w, sse: format == "sse"}
+	stream.flusher, _ = w.(http.Flusher)
+	if stream.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("X-Accel-Buffering", "no") // keep proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	// Events are sent from the simulation goroutine, which is this handler's
+	ctx := withProgressReporter(r.Context(), func(progress SimulationProgress) {
+		stream.send("progress", progress)
+	})
+	ctx = withCycleListener(ctx, func(cycle CycleData) {
+		stream.send("cycle", cycle)
+	})
+	ctx = withRecordListener(ctx, func(volume PayoutCycleVolume) {
+		stream.send("payout_cycle", volume)
+	}, func(user SimulationUser) {
+		stream.send("user", user)
+	})
+
+	response, err := runBusinessSimulation(ctx, req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Streaming business simulation cancelled: %v", err)
+			return
+		}
+		log.Printf("Streaming business simulation error: %v", err)
+		stream.send("error", map[string]string{"message": err.Error()})
+		return
+	}
+
+	// The summary leaves out what has already been streamed; the genealogy structure is in the
+	// children of the user events
+	summary := response
+	summary.Users = nil
+	summary.GenealogyStructure = nil
+	summary.VolumeCalculations.VolumeByPayoutCycle = nil
+	stream.send("summary", summary)
+	stream.send("done", map[string]interface{}{"id": response.ID, "users": len(response.Users)})
+
+	log.Printf("Streamed business simulation %s with %d users", response.ID, len(response.Users))
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// StoredSimulationRequest runs a business simulation on a genealogy stored in genealogy_nodes, such as
+// an imported client tree, instead of a generated one. The stored members keep their payout cycles;
+// number_of_payout_cycles and max_expected_users are derived from the stored tree and the projection.
+type StoredSimulationRequest struct {
+	BusinessSimulationRequest
+	GenealogyTypeID int    `json:"genealogy_type_id"`
+	SimulationID    string `json:"simulation_id,omitempty"` // only the nodes saved or imported under this ID
+	// Optional projected growth: new members joining in further cycles after the stored ones, either
+	// projected_users spread evenly or, with addressable_market, recruited at the saturating rate
+	ProjectionCycles int `json:"projection_cycles,omitempty"`
+	ProjectedUsers   int `json:"projected_users,omitempty"`
+}
+
+// storedGenealogy is a genealogy loaded for a stored simulation
+type storedGenealogy struct {
+	nodes    []GenealogyNode // in left bound order
+	tree     *genealogyTree
+	cycles   int        // highest stored payout cycle
+	earliest *time.Time // earliest join date of an imported member
+}
+
+// handleStoredBusinessSimulation runs a business simulation on a stored genealogy
+func handleStoredBusinessSimulation(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req StoredSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shape, err := parseResponseShape(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shape.prepare(&req.BusinessSimulationRequest)
+
+	businessResponse, err := runStoredBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Stored business simulation cancelled: %v", err)
+			return
+		}
+		log.Printf("Stored business simulation error: %v", err)
+		http.Error(w, fmt.Sprintf("Error simulating stored genealogy: %v", err), placementErrorStatus(err))
+		return
+	}
+
+	shapedResponse, err := shape.apply(businessResponse)
+	if err != nil {
+		log.Printf("Error shaping response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shapedResponse); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Stored business simulation completed for %d users", len(businessResponse.Users))
+}
+
+// runStoredBusinessSimulation loads a stored genealogy, projects its growth when asked and applies
+// the business logic to it. The calendar starts at start_date or, for imported trees, the earliest
+// join date, which is where the import counted payout cycles from.
+func runStoredBusinessSimulation(ctx context.Context, req StoredSimulationRequest) (BusinessSimulationResponse, error) {
+	if req.ProjectionCycles < 0 || req.ProjectedUsers < 0 {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "projection_cycles and projected_users must not be negative")
+	}
+	if req.ProjectionCycles == 0 && req.ProjectedUsers > 0 {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "projected_users requires projection_cycles")
+	}
+	if req.ProjectionCycles > 0 && req.ProjectedUsers == 0 && req.AddressableMarket <= 0 {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "projection_cycles requires projected_users or addressable_market")
+	}
+	if req.SimulationMode == "agent" {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "simulation_mode agent is not supported for stored genealogies")
+	}
+	if req.PayoutCycle == "" {
+		req.PayoutCycle = "monthly"
+	}
+	if _, exists := cycleTypeNominalDays[normalizeCycleType(req.PayoutCycle)]; !exists {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "payout_cycle must be weekly, biweekly, monthly or quarterly")
+	}
+	if req.Seed == 0 {
+		req.Seed = time.Now().UnixNano()
+	}
+
+	genealogyType, err := getGenealogyTypeByID(req.GenealogyTypeID)
+	if err != nil {
+		return BusinessSimulationResponse{}, err
+	}
+	stored, err := loadStoredGenealogy(req.GenealogyTypeID, req.SimulationID)
+	if err != nil {
+		return BusinessSimulationResponse{}, err
+	}
+	if len(stored.nodes) == 0 {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusNotFound, "genealogy type %d has no stored nodes", req.GenealogyTypeID)
+	}
+
+	planKind, maxChildrenCount := resolvePlanKind(genealogyType, req.MaxChildrenCount)
+	rules := placementRulesFor(genealogyType)
+	if rules.maxChildren <= 0 {
+		rules.maxChildren = maxChildrenCount
+	}
+
+	// The business request describes the stored tree and its projection
+	req.GenealogyType = planKind
+	req.MaxChildrenCount = rules.maxChildren
+	req.NumberOfPayoutCycles = stored.cycles + req.ProjectionCycles
+	req.MaxExpectedUsers = len(stored.nodes) + req.ProjectedUsers
+	if req.StartDate == "" && stored.earliest != nil {
+		req.StartDate = stored.earliest.Format(calendarDateLayout)
+	}
+	if err := validateBusinessSimulationRequest(req.BusinessSimulationRequest); err != nil {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "%v", err)
+	}
+
+	// Commissions cannot make the simulation run at a finer frequency, as the stored cycles are fixed
+	simulationCycleType, _, err := resolveSimulationCycles(req.BusinessSimulationRequest)
+	if err != nil {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "%v", err)
+	}
+	if normalizeCycleType(simulationCycleType) != normalizeCycleType(req.PayoutCycle) {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "commissions on a stored genealogy cannot pay more often than payout_cycle")
+	}
+
+	simulationID := fmt.Sprintf("stored_sim_%d", time.Now().UnixNano())
+	log.Printf("Running stored business simulation %s on %d nodes of genealogy type %d", simulationID, len(stored.nodes), req.GenealogyTypeID)
+
+	simResponse := SimulationResponse{
+		SimulationID:     simulationID,
+		GenealogyTypeID:  req.GenealogyTypeID,
+		MaxExpectedUsers: req.MaxExpectedUsers,
+		PayoutCycleType:  req.PayoutCycle,
+		NumberOfCycles:   req.NumberOfPayoutCycles,
+		Seed:             req.Seed,
+		CreatedAt:        time.Now(),
+	}
+	if req.ProjectionCycles > 0 {
+		simResponse.GrowthAnalysis, err = projectStoredGenealogy(ctx, stored, rules, simulationID, req)
+		if err != nil {
+			return BusinessSimulationResponse{}, err
+		}
+	}
+	simResponse.Nodes = stored.nodes
+	simResponse.TotalNodesGenerated = len(stored.nodes)
+	simResponse.Cycles = storedCycles(stored.nodes, req.NumberOfPayoutCycles)
+	simResponse.UsersPerCycle = len(stored.nodes) / req.NumberOfPayoutCycles
+	simResponse.TreeStructure = storedTreeStructure(stored)
+
+	calendar, _ := NewPayoutCalendar(req.PayoutCycle, req.StartDate)
+	if err := applyPayoutCalendar(&simResponse, calendar, req.PayoutSchedules); err != nil {
+		return BusinessSimulationResponse{}, newPlacementError(http.StatusBadRequest, "%v", err)
+	}
+
+	return enhanceSimulationWithBusinessLogic(ctx, simResponse, req.BusinessSimulationRequest)
+}
+
+// loadStoredGenealogy loads the nodes of a genealogy type, or only those saved under a simulation ID
+func loadStoredGenealogy(genealogyTypeID int, simulationID string) (*storedGenealogy, error) {
+	query := `
+		SELECT id, user_id, genealogy_type_id, parent_id, left_bound, right_bound, depth, position,
+		       simulation_id, payout_cycle, cycle_position, status, joined_at, member_id, sponsor_node_id,
+		       purchase_volume, created_at, updated_at
+		FROM genealogy_nodes
+		WHERE genealogy_type_id = $1`
+	args := []interface{}{genealogyTypeID}
+	if simulationID != "" {
+		query += " AND simulation_id = $2"
+		args = append(args, simulationID)
+	}
+	rows, err := db.Query(query+" ORDER BY left_bound", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := &storedGenealogy{}
+	var ordered []*treeNode
+	var purchases []float64
+	recordedPurchases := false
+	for rows.Next() {
+		var node GenealogyNode
+		var joinedAt sql.NullTime
+		var purchaseVolume float64
+		err := rows.Scan(&node.ID, &node.UserID, &node.GenealogyTypeID, &node.ParentID,
+			&node.LeftBound, &node.RightBound, &node.Depth, &node.Position,
+			&node.SimulationID, &node.PayoutCycle, &node.CyclePosition, &node.Status,
+			&joinedAt, &node.MemberID, &node.SponsorNodeID, &purchaseVolume, &node.CreatedAt, &node.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, purchaseVolume)
+		if node.MemberID != nil && purchaseVolume > 0 {
+			recordedPurchases = true
+		}
+
+		// Nodes added before payout cycles were tracked count as joining in the first cycle
+		if node.PayoutCycle < 1 {
+			node.PayoutCycle = 1
+		}
+		if node.PayoutCycle > stored.cycles {
+			stored.cycles = node.PayoutCycle
+		}
+		if joinedAt.Valid && (stored.earliest == nil || joinedAt.Time.Before(*stored.earliest)) {
+			stored.earliest = &joinedAt.Time
+		}
+
+		stored.nodes = append(stored.nodes, node)
+		ordered = append(ordered, &treeNode{id: node.ID, parentID: node.ParentID, left: node.LeftBound,
+			right: node.RightBound, depth: node.Depth, position: node.Position})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Imported members keep their purchases, including those who bought nothing, unless the import
+	// recorded none at all, in which case products are assigned as for simulated members
+	if recordedPurchases {
+		for i := range stored.nodes {
+			if stored.nodes[i].MemberID != nil {
+				stored.nodes[i].PurchaseVolume = &purchases[i]
+			}
+		}
+	}
+
+	stored.tree = newGenealogyTree(genealogyTypeID, ordered)
+	return stored, nil
+}
+
+// projectStoredGenealogy adds the projected members of each projection cycle to a stored genealogy.
+// They take the open positions breadth first, those of the stored members before those of earlier
+// projected members, and are numbered after the stored nodes. Bounds and depths are then recomputed.
+func projectStoredGenealogy(ctx context.Context, stored *storedGenealogy, rules placementRules, simulationID string, req StoredSimulationRequest) (*GrowthAnalysis, error) {
+	growthReq := SimulationRequest{
+		MaxExpectedUsers:  req.MaxExpectedUsers,
+		NumberOfCycles:    req.ProjectionCycles,
+		AddressableMarket: req.AddressableMarket,
+		RecruitmentRate:   req.RecruitmentRate,
+	}
+	if req.ProjectedUsers == 0 {
+		growthReq.MaxExpectedUsers = 0 // grow until the market is saturated
+	}
+	userCounts, growthAnalysis := growCycleUserCounts(growthReq, len(stored.nodes), stored.cycles+1)
+
+	// Open positions are offered in depth order, then left to right
+	queue := make([]*treeNode, 0, len(stored.nodes))
+	nextID := 0
+	for _, node := range stored.nodes {
+		queue = append(queue, stored.tree.nodes[node.ID])
+		if node.ID > nextID {
+			nextID = node.ID
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		if queue[i].depth != queue[j].depth {
+			return queue[i].depth < queue[j].depth
+		}
+		return queue[i].left < queue[j].left
+	})
+	storedCount := len(queue)
+
+	head := 0
+	for i, count := range userCounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cycle := stored.cycles + 1 + i
+
+		for cyclePosition := 1; cyclePosition <= count; cyclePosition++ {
+			var parent *treeNode
+			var position string
+			for ; head < len(queue); head++ {
+				taken := make([]string, len(queue[head].children))
+				for j, child := range queue[head].children {
+					taken[j] = child.position
+				}
+				chosen, err := rules.choose(queue[head].id, taken, "")
+				if err == nil {
+					parent, position = queue[head], chosen
+					break
+				}
+			}
+			if parent == nil {
+				return nil, fmt.Errorf("no open position left for projected members")
+			}
+
+			nextID++
+			node := &treeNode{id: nextID}
+			stored.tree.nodes[node.id] = node
+			stored.tree.attach(node, parent, position, rules)
+			queue = append(queue, node)
+
+			parentID := parent.id
+			stored.nodes = append(stored.nodes, GenealogyNode{
+				ID:              node.id,
+				GenealogyTypeID: req.GenealogyTypeID,
+				ParentID:        &parentID,
+				Position:        position,
+				SimulationID:    &simulationID,
+				PayoutCycle:     cycle,
+				CyclePosition:   cyclePosition,
+				Status:          "projected",
+				CreatedAt:       time.Now(),
+				UpdatedAt:       time.Now(),
+			})
+		}
+		reportProgress(ctx, SimulationProgress{Stage: "placing_users", Cycle: cycle, TotalCycles: req.NumberOfPayoutCycles, UsersPlaced: len(stored.nodes)})
+	}
+
+	stored.tree.renumber()
+	for i := range stored.nodes {
+		node := stored.tree.nodes[stored.nodes[i].ID]
+		stored.nodes[i].LeftBound = node.left
+		stored.nodes[i].RightBound = node.right
+		stored.nodes[i].Depth = node.depth
+	}
+	log.Printf("Projected %d members over %d cycles", len(queue)-storedCount, req.ProjectionCycles)
+	return growthAnalysis, nil
+}
+
+// storedCycles groups the nodes of a stored simulation by payout cycle, numbering the users of each
+// cycle after those of the earlier cycles
+func storedCycles(nodes []GenealogyNode, numberOfCycles int) []CycleData {
+	nodesByCycle := make(map[int][]GenealogyNode)
+	for _, node := range nodes {
+		nodesByCycle[node.PayoutCycle] = append(nodesByCycle[node.PayoutCycle], node)
+	}
+
+	cycles := make([]CycleData, 0, numberOfCycles)
+	totalUsers := 0
+	for cycle := 1; cycle <= numberOfCycles; cycle++ {
+		cycleNodes := nodesByCycle[cycle]
+		if cycleNodes == nil {
+			cycleNodes = make([]GenealogyNode, 0)
+		}
+		cycles = append(cycles, CycleData{
+			CycleNumber:  cycle,
+			StartUser:    totalUsers + 1,
+			EndUser:      totalUsers + len(cycleNodes),
+			UsersInCycle: len(cycleNodes),
+			NodesInCycle: cycleNodes,
+		})
+		totalUsers += len(cycleNodes)
+	}
+	return cycles
+}
+
+// storedTreeStructure builds the tree structure of a stored simulation from its first root
+func storedTreeStructure(stored *storedGenealogy) map[string]interface{} {
+	if len(stored.tree.roots) == 0 {
+		return map[string]interface{}{}
+	}
+
+	nodesByID := make(map[int]GenealogyNode, len(stored.nodes))
+	for _, node := range stored.nodes {
+		nodesByID[node.ID] = node
+	}
+	var build func(node *treeNode) TreeNode
+	build = func(node *treeNode) TreeNode {
+		children := make([]TreeNode, 0, len(node.children))
+		for _, child := range node.children {
+			children = append(children, build(child))
+		}
+		return TreeNode{
+			ID:       node.id,
+			UserID:   nodesByID[node.id].UserID,
+			Position: node.position,
+			Children: children,
+			Cycle:    nodesByID[node.id].PayoutCycle,
+		}
+	}
+
+	return map[string]interface{}{
+		"root":        build(stored.tree.roots[0]),
+		"total_nodes": len(stored.nodes),
+	}
+}
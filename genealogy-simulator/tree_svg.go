@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Layout of a rendered genealogy tree, in SVG user units
+const (
+	maxSVGNodes      = 5000 // larger trees must be rendered as a subtree or with a depth limit
+	svgNodeWidth     = 104
+	svgNodeHeight    = 38
+	svgSlotWidth     = 120 // horizontal space of one leaf
+	svgLevelHeight   = 84
+	svgMargin        = 24
+	svgLegendHeight  = 22
+	svgLegendEntry   = 132
+	svgMinimumWidth  = 480
+	svgNeutralColour = "#cfd4da"
+)
+
+// svgPalette colours the values of the colour attribute in order
+var svgPalette = []string{
+	"#4e79a7", "#f28e2b", "#59a14f", "#e15759", "#76b7b2", "#edc948",
+	"#b07aa1", "#ff9da7", "#9c755f", "#86bcb6", "#8cd17d", "#d4a6c8",
+}
+
+// svgColourAttributes maps the accepted ?color_by= values to the node attribute they colour by
+var svgColourAttributes = map[string]string{
+	"cycle":   "payout_cycle",
+	"product": "product",
+	"rank":    "rank",
+}
+
+// svgOptions are the query parameters of a tree rendering
+type svgOptions struct {
+	root     string // node to render from; empty renders from the genealogy root
+	maxDepth int    // levels below the root to render; -1 renders all of them
+	colourBy string // a key of svgColourAttributes
+	width    int    // width of the image; 0 keeps the layout's own size
+}
+
+// svgTreeNode is a node placed in a rendered tree
+type svgTreeNode struct {
+	node     *graphNode
+	position string
+	children []*svgTreeNode
+	hidden   int // descendants below the depth limit
+	x, y     float64
+}
+
+// handleBusinessSimulationSVG runs a business simulation and renders its genealogy as SVG
+func handleBusinessSimulationSVG(w http.ResponseWriter, r *http.Request) {
+	// Handle OPTIONS request for CORS preflight
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	options, err := parseSVGOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req BusinessSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.SkipVolumeBreakdowns = true
+
+	businessResponse, err := runBusinessSimulation(r.Context(), req)
+	if err != nil {
+		if r.Context().Err() != nil {
+			log.Printf("Business simulation rendering cancelled: %v", err)
+			return
+		}
+		log.Printf("Business simulation error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeGenealogySVG(w, simulatedGenealogyGraph(businessResponse), options)
+}
+
+// handleSimulationJobSVG renders the genealogy of a completed simulation job as SVG
+func handleSimulationJobSVG(w http.ResponseWriter, r *http.Request) {
+	options, err := parseSVGOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, ok := completedJobResult(w, r)
+	if !ok {
+		return
+	}
+
+	writeGenealogySVG(w, jobGenealogyGraph(result), options)
+}
+
+// handleStoredGenealogySVG renders a stored genealogy as SVG, optionally only the nodes saved or
+// imported under ?simulation_id=. Stored nodes carry no product or rank, so they are coloured by cycle.
+func handleStoredGenealogySVG(w http.ResponseWriter, r *http.Request) {
+	genealogyTypeID, err := strconv.Atoi(mux.Vars(r)["genealogy_type_id"])
+	if err != nil {
+		http.Error(w, "Invalid genealogy type ID", http.StatusBadRequest)
+		return
+	}
+	options, err := parseSVGOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stored, err := loadStoredGenealogy(genealogyTypeID, r.URL.Query().Get("simulation_id"))
+	if err != nil {
+		log.Printf("Error loading genealogy type %d: %v", genealogyTypeID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(stored.nodes) == 0 {
+		http.Error(w, "Genealogy has no nodes", http.StatusNotFound)
+		return
+	}
+
+	writeGenealogySVG(w, nodesGenealogyGraph(fmt.Sprintf("genealogy_%d", genealogyTypeID), stored.nodes), options)
+}
+
+// parseSVGOptions reads the root, max_depth, color_by (cycle, product or rank) and width query parameters
+func parseSVGOptions(r *http.Request) (svgOptions, error) {
+	query := r.URL.Query()
+	options := svgOptions{root: query.Get("root"), maxDepth: -1, colourBy: "cycle"}
+
+	if raw := query.Get("max_depth"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			return options, fmt.Errorf("Invalid max_depth")
+		}
+		options.maxDepth = value
+	}
+	if raw := query.Get("width"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value <= 0 {
+			return options, fmt.Errorf("Invalid width")
+		}
+		options.width = value
+	}
+	if colourBy := strings.ToLower(query.Get("color_by")); colourBy != "" {
+		if _, exists := svgColourAttributes[colourBy]; !exists {
+			return options, fmt.Errorf("color_by must be cycle, product or rank")
+		}
+		options.colourBy = colourBy
+	}
+	return options, nil
+}
+
+// writeGenealogySVG renders a genealogy graph and writes it as an SVG image
+func writeGenealogySVG(w http.ResponseWriter, graph *genealogyGraph, options svgOptions) {
+	root, count, err := buildSVGTree(graph, options)
+	if err != nil {
+		http.Error(w, err.Error(), placementErrorStatus(err))
+		return
+	}
+
+	var buf bytes.Buffer
+	renderSVGTree(&buf, root, options)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Error writing SVG: %v", err)
+		return
+	}
+	log.Printf("Rendered genealogy %s as SVG (%d nodes)", graph.id, count)
+}
+
+// buildSVGTree links the graph into a tree from the requested root, or the first node without a
+// parent, down to the depth limit, and returns it with the number of nodes to draw
+func buildSVGTree(graph *genealogyGraph, options svgOptions) (*svgTreeNode, int, error) {
+	nodesByID := make(map[string]*graphNode, len(graph.nodes))
+	for i := range graph.nodes {
+		nodesByID[graph.nodes[i].id] = &graph.nodes[i]
+	}
+	childrenOf := make(map[string][]graphEdge)
+	hasParent := make(map[string]bool, len(graph.edges))
+	for _, edge := range graph.edges {
+		childrenOf[edge.source] = append(childrenOf[edge.source], edge)
+		hasParent[edge.target] = true
+	}
+
+	rootID := options.root
+	if rootID == "" {
+		for _, node := range graph.nodes {
+			if !hasParent[node.id] {
+				rootID = node.id
+				break
+			}
+		}
+	}
+	if nodesByID[rootID] == nil {
+		return nil, 0, newPlacementError(http.StatusNotFound, "node %q is not in this genealogy", rootID)
+	}
+
+	// Stored genealogies and plain simulations have no products or ranks to colour by
+	colourAttribute := svgColourAttributes[options.colourBy]
+	available := false
+	for _, attribute := range graph.attributes {
+		if attribute.name == colourAttribute {
+			available = true
+			break
+		}
+	}
+	if !available {
+		return nil, 0, newPlacementError(http.StatusBadRequest, "color_by %s is only available for business simulations", options.colourBy)
+	}
+
+	// Binary children are drawn left then right
+	for _, edges := range childrenOf {
+		sort.SliceStable(edges, func(i, j int) bool {
+			return binarySlot(edges[i].position) < binarySlot(edges[j].position)
+		})
+	}
+
+	// Nodes are visited once, so parent links that loop cannot recurse forever
+	seen := make(map[string]bool)
+	var countBelow func(id string) int
+	countBelow = func(id string) int {
+		count := 0
+		for _, edge := range childrenOf[id] {
+			if !seen[edge.target] {
+				seen[edge.target] = true
+				count += 1 + countBelow(edge.target)
+			}
+		}
+		return count
+	}
+
+	count := 0
+	var build func(id, position string, depth int) *svgTreeNode
+	build = func(id, position string, depth int) *svgTreeNode {
+		count++
+		seen[id] = true
+		node := &svgTreeNode{node: nodesByID[id], position: position}
+		if options.maxDepth >= 0 && depth == options.maxDepth {
+			node.hidden = countBelow(id)
+			return node
+		}
+		for _, edge := range childrenOf[id] {
+			if count > maxSVGNodes {
+				break
+			}
+			if !seen[edge.target] {
+				node.children = append(node.children, build(edge.target, edge.position, depth+1))
+			}
+		}
+		return node
+	}
+	root := build(rootID, "", 0)
+	if count > maxSVGNodes {
+		return nil, 0, newPlacementError(http.StatusBadRequest, "the tree has more than %d nodes; render a subtree with root or limit it with max_depth", maxSVGNodes)
+	}
+	return root, count, nil
+}
+
+// binarySlot orders binary positions; other positions keep their order after them
+func binarySlot(position string) int {
+	switch position {
+	case "left":
+		return 0
+	case "right":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// layoutSVGTree places the nodes: each leaf takes the next slot and each parent is centred over its
+// children. A binary child without a sibling keeps an empty slot on the other side, so its side shows.
+func layoutSVGTree(root *svgTreeNode) (slots int, depth int) {
+	var place func(node *svgTreeNode, level int)
+	place = func(node *svgTreeNode, level int) {
+		node.y = float64(level)
+		if level > depth {
+			depth = level
+		}
+		if len(node.children) == 0 {
+			node.x = float64(slots)
+			slots++
+			return
+		}
+
+		if len(node.children) == 1 && binarySlot(node.children[0].position) < 2 {
+			child := node.children[0]
+			if child.position == "right" {
+				slots++
+			}
+			place(child, level+1)
+			if child.position == "left" {
+				slots++
+			}
+			node.x = child.x + 0.5 - float64(binarySlot(child.position))
+			return
+		}
+
+		for _, child := range node.children {
+			place(child, level+1)
+		}
+		node.x = (node.children[0].x + node.children[len(node.children)-1].x) / 2
+	}
+	place(root, 0)
+	return slots, depth
+}
+
+// renderSVGTree writes a laid out tree as an SVG document with a legend of the node colours
+func renderSVGTree(buf *bytes.Buffer, root *svgTreeNode, options svgOptions) {
+	slots, depth := layoutSVGTree(root)
+	attribute := svgColourAttributes[options.colourBy]
+
+	// Colours follow the sorted values of the colour attribute
+	var nodes []*svgTreeNode
+	var collect func(node *svgTreeNode)
+	collect = func(node *svgTreeNode) {
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			collect(child)
+		}
+	}
+	collect(root)
+	valueSet := make(map[string]interface{})
+	for _, node := range nodes {
+		if value, exists := node.node.values[attribute]; exists && formatExportCell(value) != "" {
+			valueSet[formatExportCell(value)] = value
+		}
+	}
+	values := make([]string, 0, len(valueSet))
+	for value := range valueSet {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		a, aIsInt := valueSet[values[i]].(int)
+		b, bIsInt := valueSet[values[j]].(int)
+		if aIsInt && bIsInt {
+			return a < b
+		}
+		return values[i] < values[j]
+	})
+	colours := make(map[string]string, len(values))
+	for i, value := range values {
+		colours[value] = svgPalette[i%len(svgPalette)]
+	}
+	colourOf := func(node *svgTreeNode) (string, string) {
+		if value, exists := node.node.values[attribute]; exists {
+			if colour, exists := colours[formatExportCell(value)]; exists {
+				return colour, formatExportCell(value)
+			}
+		}
+		return svgNeutralColour, ""
+	}
+
+	width := math.Max(float64(slots*svgSlotWidth+2*svgMargin), svgMinimumWidth)
+	perRow := int((width - 2*svgMargin) / svgLegendEntry)
+	legendRows := (len(values) + perRow - 1) / perRow
+	top := float64(svgMargin + legendRows*svgLegendHeight + svgMargin/2)
+	height := top + float64(depth)*svgLevelHeight + svgNodeHeight + svgMargin + 14
+	centre := func(node *svgTreeNode) (float64, float64) {
+		return svgMargin + node.x*svgSlotWidth + svgSlotWidth/2, top + node.y*svgLevelHeight
+	}
+
+	outputWidth, outputHeight := width, height
+	if options.width > 0 {
+		outputWidth = float64(options.width)
+		outputHeight = height * outputWidth / width
+	}
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="Helvetica, Arial, sans-serif">`+"\n",
+		outputWidth, outputHeight, width, height)
+	fmt.Fprintf(buf, `<rect width="%.0f" height="%.0f" fill="#ffffff"/>`+"\n", width, height)
+
+	// Legend
+	legendLabel := map[string]string{"cycle": "Cycle ", "product": "", "rank": ""}[options.colourBy]
+	for i, value := range values {
+		x := float64(svgMargin + (i%perRow)*svgLegendEntry)
+		y := float64(svgMargin + (i/perRow)*svgLegendHeight)
+		fmt.Fprintf(buf, `<rect x="%.1f" y="%.1f" width="14" height="14" rx="3" fill="%s"/>`, x, y, colours[value])
+		fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="12" fill="#333333">%s</text>`+"\n", x+20, y+11, xmlEscape(truncateSVGText(legendLabel+value, 16)))
+	}
+
+	// Edges, labelled with the binary side
+	buf.WriteString(`<g stroke="#8a939c" stroke-width="1.2" fill="none">` + "\n")
+	var edgeLabels strings.Builder
+	for _, node := range nodes {
+		px, py := centre(node)
+		for _, child := range node.children {
+			cx, cy := centre(child)
+			midY := (py + svgNodeHeight + cy) / 2
+			fmt.Fprintf(buf, `<path d="M%.1f %.1fC%.1f %.1f %.1f %.1f %.1f %.1f"/>`+"\n", px, py+svgNodeHeight, px, midY, cx, midY, cx, cy)
+			if side := map[string]string{"left": "L", "right": "R"}[child.position]; side != "" {
+				fmt.Fprintf(&edgeLabels, `<text x="%.1f" y="%.1f" font-size="10" fill="#5f6b76" text-anchor="middle">%s</text>`+"\n", (px+cx)/2, midY-3, side)
+			}
+		}
+	}
+	buf.WriteString("</g>\n")
+	buf.WriteString(edgeLabels.String())
+
+	// Nodes, with their attributes as a tooltip
+	for _, node := range nodes {
+		x, y := centre(node)
+		colour, value := colourOf(node)
+		fmt.Fprintf(buf, `<g><title>%s</title>`, xmlEscape(svgTooltip(node.node)))
+		fmt.Fprintf(buf, `<rect x="%.1f" y="%.1f" width="%d" height="%d" rx="6" fill="%s" stroke="#4a545e" stroke-width="0.8"/>`,
+			x-svgNodeWidth/2, y, svgNodeWidth, svgNodeHeight, colour)
+		fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="12" text-anchor="middle" fill="#1d252c">%s</text>`,
+			x, y+16, xmlEscape(truncateSVGText(node.node.label, 15)))
+		if value != "" {
+			fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="10" text-anchor="middle" fill="#1d252c">%s</text>`,
+				x, y+30, xmlEscape(truncateSVGText(legendLabel+value, 18)))
+		}
+		if node.hidden > 0 {
+			fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="10" text-anchor="middle" fill="#5f6b76">+%d below</text>`,
+				x, y+svgNodeHeight+13, node.hidden)
+		}
+		buf.WriteString("</g>\n")
+	}
+	buf.WriteString("</svg>\n")
+}
+
+// svgTooltip lists a node's attributes, one per line
+func svgTooltip(node *graphNode) string {
+	names := make([]string, 0, len(node.values))
+	for name := range node.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{node.label}
+	for _, name := range names {
+		if text := formatExportCell(node.values[name]); text != "" {
+			lines = append(lines, name+": "+text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncateSVGText shortens text to fit a node, marking the cut with an ellipsis
+func truncateSVGText(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
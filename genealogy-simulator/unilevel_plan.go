@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 )
 
@@ -24,25 +25,27 @@ func NewUnilevelPlanSimulator(simulationID string, maxChildrenCount int) *Unilev
 	}
 }
 
-func (u *UnilevelPlanSimulator) Simulate(req SimulationRequest) SimulationResponse {
+func (u *UnilevelPlanSimulator) Simulate(ctx context.Context, req SimulationRequest) (SimulationResponse, error) {
 	usersPerCycle := req.MaxExpectedUsers / req.NumberOfCycles
 	if req.MaxExpectedUsers%req.NumberOfCycles != 0 {
 		usersPerCycle++
 	}
 
+	userCounts, growthAnalysis := cycleUserCounts(req)
 	cycles := make([]CycleData, 0)
 	totalNodes := 0
 
 	for cycle := 1; cycle <= req.NumberOfCycles; cycle++ {
-		cycleStartUser := totalNodes + 1
-		cycleEndUser := cycleStartUser + usersPerCycle - 1
-		if cycleEndUser > req.MaxExpectedUsers {
-			cycleEndUser = req.MaxExpectedUsers
+		if err := ctx.Err(); err != nil {
+			return SimulationResponse{}, err
 		}
+		cycleStartUser := totalNodes + 1
+		cycleEndUser := cycleStartUser + userCounts[cycle-1] - 1
 		usersInCycle := cycleEndUser - cycleStartUser + 1
 
 		cycleNodes := u.generateCycleNodes(cycle, cycleStartUser, cycleEndUser, req.GenealogyTypeID)
 		totalNodes += len(cycleNodes)
+		reportProgress(ctx, SimulationProgress{Stage: "placing_users", Cycle: cycle, TotalCycles: req.NumberOfCycles, UsersPlaced: totalNodes})
 
 		cycles = append(cycles, CycleData{
 			CycleNumber:  cycle,
@@ -51,6 +54,7 @@ func (u *UnilevelPlanSimulator) Simulate(req SimulationRequest) SimulationRespon
 			UsersInCycle: usersInCycle,
 			NodesInCycle: cycleNodes,
 		})
+		reportCycle(ctx, cycles[len(cycles)-1])
 	}
 
 	treeStructure := u.buildTreeStructure()
@@ -66,8 +70,9 @@ func (u *UnilevelPlanSimulator) Simulate(req SimulationRequest) SimulationRespon
 		Nodes:               u.nodes,
 		Cycles:              cycles,
 		TreeStructure:       treeStructure,
+		GrowthAnalysis:      growthAnalysis,
 		CreatedAt:           time.Now(),
-	}
+	}, nil
 }
 
 // generateCycleNodes generates nodes for a specific cycle
@@ -152,6 +152,18 @@ if ! apply_migration_file "database/run_migrations.sql" "Migration Runner"; then
     exit 1
 fi
 
+# 5. Apply genealogy node status migration
+if ! apply_migration_file "database/migration_genealogy_node_status.sql" "Genealogy Node Status Migration"; then
+    print_error "Genealogy node status migration failed"
+    exit 1
+fi
+
+# 6. Apply genealogy member import migration
+if ! apply_migration_file "database/migration_genealogy_member_import.sql" "Genealogy Member Import Migration"; then
+    print_error "Genealogy member import migration failed"
+    exit 1
+fi
+
 echo ""
 echo "🔍 Verifying Migration Results..."
 echo "================================"
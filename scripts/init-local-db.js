@@ -32,7 +32,9 @@ const files = [
     'migration_business_plan_tables.sql',
     'migration_add_product_sales_ratio.sql',
     'migration_add_commission_config.sql',
-    'insert_default_admin.sql'
+    'insert_default_admin.sql',
+    'migration_genealogy_node_status.sql',
+    'migration_genealogy_member_import.sql'
 ];
 
 async function run() {